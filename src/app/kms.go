@@ -0,0 +1,133 @@
+/*
+	Opendrm, an open source implementation of industry-grade DRM
+	(Digital Rights Management) or Key System.
+	Copyright (C) 2018  wilkk
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"core/key"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+)
+
+// Content keys of keyStore and seeds of the seed file are wrapped by kms when
+// -kms is set, so that dumps of them expose no key. The built-in seed is not.
+var kms *key.LocalKMS
+
+var (
+	kmsFile = flag.String("kms", "", "KMS file of the KEKs wrapping content keys and seeds, keys are kept in the clear if empty")
+	rewrap  = flag.Bool("rewrap", false, "wrap keys and seeds by the current KEK at start, e.g. after app kms -rotate")
+	migrate = flag.Bool("migrate", false, "with -rewrap, wrap content keys stored in the clear before -kms was set")
+)
+
+// The KMS passphrase is read from the environment, never from a flag.
+func openKMS(path string) (*key.LocalKMS, error) {
+	return key.OpenLocalKMS(path, os.Getenv("OPENDRM_KMS_PASSPHRASE"))
+}
+
+// readSeeds reads the seed file, unwrapping its seeds if they're wrapped.
+func readSeeds(path string) (key.SeedSet, error) {
+	ss, err := key.ReadSeeds(path)
+	if err != nil || kms == nil {
+		return ss, err
+	}
+	return ss, ss.Unwrap(kms)
+}
+
+// rewrapKeys wraps the seed file and the content keys of es by the current
+// KEK. Seeds kept in the clear are wrapped as well, content keys only with
+// -migrate.
+func rewrapKeys(es *key.EncryptedStore) error {
+	if *seedsFile != "" {
+		ss, err := readSeeds(*seedsFile)
+		if err != nil {
+			return err
+		}
+		if err := ss.Wrap(kms); err != nil {
+			return err
+		}
+		if err := key.WriteSeeds(*seedsFile, ss); err != nil {
+			return err
+		}
+	}
+
+	n, err := es.Rewrap(*migrate)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%d content keys rewrapped by KEK %s.\n", n, kms.KeyId())
+	return nil
+}
+
+// manageKMS is the admin command that manages the KMS file:
+//
+//	app kms -kms kms.json -init
+//	app kms -kms kms.json -rotate
+//	app kms -kms kms.json -remove <KEK id>
+//
+// The passphrase is read from OPENDRM_KMS_PASSPHRASE. After -rotate, start
+// the server once with -rewrap, then -remove the old KEK. To set -kms on a
+// content store of keys in the clear, start the server once with -rewrap
+// -migrate.
+func manageKMS(args []string) error {
+	fs := flag.NewFlagSet("kms", flag.ContinueOnError)
+	path := fs.String("kms", "kms.json", "KMS file to update")
+	create := fs.Bool("init", false, "create the KMS file with a new KEK")
+	rotate := fs.Bool("rotate", false, "add a new KEK and make it current")
+	remove := fs.String("remove", "", "id of the KEK to remove, once no key is wrapped by it")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	passphrase := os.Getenv("OPENDRM_KMS_PASSPHRASE")
+	if passphrase == "" {
+		return errors.New("OPENDRM_KMS_PASSPHRASE is not set")
+	}
+
+	var lk *key.LocalKMS
+	var err error
+	if *create {
+		lk, err = key.CreateLocalKMS(*path, passphrase)
+	} else {
+		lk, err = key.OpenLocalKMS(*path, passphrase)
+	}
+	if err != nil {
+		return err
+	}
+
+	if *rotate {
+		if _, err := lk.Rotate(); err != nil {
+			return err
+		}
+	}
+	if *remove != "" {
+		if err := lk.Remove(*remove); err != nil {
+			return err
+		}
+	}
+
+	for _, id := range lk.KeyIds() {
+		state := ""
+		if id == lk.KeyId() {
+			state = "current"
+		}
+		fmt.Printf("%s\t%s\n", id, state)
+	}
+	return nil
+}
@@ -20,28 +20,185 @@
 package main
 
 import (
+	"core/cert"
 	"core/key"
 	"core/license"
 	"core/server"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
 	"io/ioutil"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
 )
 
+// Device keys are derived from device id by the current seed of the device
+// seed file, which is kept like the content seed file. Devices are
+// provisioned with keys derived the same way.
+var deviceKeys *key.KeyGenerator
+
+var deviceSeedsFile = flag.String("device-seeds", "", "seed file of device keys, licenses are not issued if empty")
+
+// Issued licenses are recorded in registry.
+var registry license.Registry
+
+// Licenses are signed by the current key of keyring, which is loaded at
+// start and reloaded on SIGHUP.
+var keyring *license.Keyring
+
+var (
+	keyringFile = flag.String("keyring", "", "keyring file of signing keys, -key is used if empty")
+	keyFile     = flag.String("key", "test/rsa_private_key.pem", "private key of license signing, in pem")
+	certId      = flag.String("cert-id", "47946232-dad5-4b46-b1e6-4f0b581108dc", "id of the certificate of the signing key")
+)
+
+// Content keys of KIDs packaged by /genkey?mode=seed are derived from the seed
+// their KID was assigned to.
+var seeds *key.SeedRegistry
+
+var (
+	seedsFile = flag.String("seeds", "", "seed file of content keys, the built-in seed is used if empty")
+	seedIndex = flag.String("seed-index", "kids.jsonl", "index of the seed each KID is derived from")
+)
+
+// Random content keys from /genkey are kept in keyStore, and served at license
+// time. A KID is owned either by keyStore or by seeds, never both.
+var keyStore key.Store
+
+var keyStoreFile = flag.String("key-store", "keys.jsonl", "file of the random content keys from /genkey")
+
+// openKeyStore opens the content key store, builds with other store backends
+// may replace it.
+var openKeyStore = func() (key.Store, error) {
+	return key.OpenFileStore(*keyStoreFile)
+}
+
+var errKidOwned = errors.New("kid is already owned by another key source")
+
+// contentKeys gives the content key of a KID from the source that owns it:
+// seeds if the KID was assigned to a seed, keyStore otherwise. A KID in
+// neither is refused, a stored key is never replaced by a derived one.
+type contentKeys struct{}
+
+func (contentKeys) ContentKey(kid string) ([]byte, error) {
+	if _, ok := seeds.SeedOf(kid); ok {
+		return seeds.ContentKey(kid)
+	}
+	e, err := keyStore.Get(kid)
+	if err != nil {
+		return nil, fmt.Errorf("content key of %s: %w", kid, err)
+	}
+	return e.Key, nil
+}
+
+// Rights are granted within the entitlement of every KID of a license, never
+// as asked for. The entitlement file is a JSON object from KID to entitlement,
+// KIDs not in it get the "default" entry, or play only.
+var entitlements = map[string]license.Entitlement{}
+
+var entitlementsFile = flag.String("entitlements", "", "JSON file of the rights each KID is entitled to, play only if empty")
+
+func entitlementOf(kid string) license.Entitlement {
+	if e, ok := entitlements[kid]; ok {
+		return e
+	}
+	if e, ok := entitlements["default"]; ok {
+		return e
+	}
+	return license.Entitlement{{Type: "play"}}
+}
+
+// Certificate chains of signing keys, served to clients by id.
+var certStore *cert.Store
+
+var (
+	rootsFile = flag.String("roots", "", "root certificates of trust in pem, certificates are not served if empty")
+	certsDir  = flag.String("certs", "certs", "directory of certificate chains, stored as <cert-id>.pem")
+	crlFile   = flag.String("crl", "", "optional DER encoded CRL of revoked signing certificates")
+)
+
+// loadSigner loads the signing key from -key, builds with other key backends
+// may replace it.
+var loadSigner = func() (license.Signer, error) {
+	return license.LoadPemSigner(*keyFile, *certId)
+}
+
+// openTokenKeys opens the token that holds the token keys of -keyring, nil if
+// there is none. Builds with a token backend replace it.
+var openTokenKeys = func() (license.TokenKeys, error) {
+	return nil, nil
+}
+
 type KeyResp struct {
 	Key []byte `json:"key"`
 	Kid string `json:"kid"`
 }
 
+// GenKey gives the content key of new content to package. With mode=seed, the
+// key is derived from the current seed and the KID, random or named by kid,
+// is assigned to it; otherwise the key is random and stored. A KID named again
+// is refused, its key is only given with a license.
 func GenKey(w http.ResponseWriter, r *http.Request) {
 	r.ParseForm()
-	//kid := r.Form["kid"]
 
 	kengen := key.NewKeyGenerator(nil)
-	key, kid := kengen.GenRandKey()
+	if r.Form.Get("mode") == "seed" {
+		kid := r.Form.Get("kid")
+		if kid == "" {
+			var err error
+			if kid, err = kengen.GenUUID(); err != nil {
+				log.Printf("Generate kid failed. err=%s", err)
+				return
+			}
+		}
+		if _, err := keyStore.Get(kid); err != key.ErrNotFound {
+			if err == nil {
+				err = errKidOwned
+			}
+			log.Printf("Assign kid %s failed. err=%s", kid, err)
+			return
+		}
+		ck, err := seeds.Assign(kid)
+		if err != nil {
+			log.Printf("Assign kid %s failed. err=%s", kid, err)
+			return
+		}
+		writeKey(w, ck, kid)
+		return
+	}
+
+	ck, kid, err := kengen.GenRandKey()
+	if err != nil {
+		log.Printf("Generate key failed. err=%s", err)
+		return
+	}
+	if _, ok := seeds.SeedOf(kid); ok {
+		log.Printf("Store key %s failed. err=%s", kid, errKidOwned)
+		return
+	}
+	// The key can't be derived again, it's stored before it's handed out.
+	entry := key.Entry{Kid: kid, Key: ck}
+	if cid := r.Form.Get("content_id"); cid != "" {
+		entry.Meta = map[string]string{"content_id": cid}
+	}
+	if err := keyStore.Put(entry); err != nil {
+		log.Printf("Store key failed. err=%s", err)
+		return
+	}
+	writeKey(w, ck, kid)
+}
+
+func writeKey(w http.ResponseWriter, ck []byte, kid string) {
 	resp := KeyResp{
-		Key: key,
+		Key: ck,
 		Kid: kid,
 	}
 	data, _ := json.Marshal(&resp)
@@ -57,6 +214,11 @@ type LicenseRequest struct {
 	ClientId *string
 	// optional
 	ContentId *string `json:"content_id"`
+	// optional, play right is asked for if absent. Rights are granted
+	// within the entitlement of the KIDs only.
+	Rights []license.RightSpec `json:"rights"`
+	// optional, license version 1 is issued if absent.
+	Capabilities *license.Capabilities `json:"capabilities"`
 }
 
 type LicenseResp struct {
@@ -82,30 +244,417 @@ func AcquireLicense(w http.ResponseWriter, r *http.Request) {
 	}
 	log.Printf("kids:%v", req)
 
+	licenseStr, err := issueLicense(req)
+	if err != nil {
+		log.Printf("Issue license failed. err=%s", err)
+		return
+	}
+	writeLicense(w, req.DeviceId, licenseStr)
+}
+
+type RenewRequest struct {
+	LicenseRequest
+	// required, a license issued to the device before, in base64. Its KIDs
+	// are renewed, Kids of the request are ignored.
+	License string `json:"license"`
+}
+
+// RenewLicense issues a new license for the KIDs of a license issued before,
+// unless it has been revoked.
+func RenewLicense(w http.ResponseWriter, r *http.Request) {
+	reqData, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		log.Printf("Read request failed. err=%s", err)
+		return
+	}
+
+	req := &RenewRequest{}
+	if err := json.Unmarshal(reqData, req); err != nil {
+		log.Printf("Unmarshal request failed. err=%s", err)
+		return
+	}
+	data, err := base64.StdEncoding.DecodeString(req.License)
+	if err != nil {
+		log.Printf("Decode license failed. err=%s", err)
+		return
+	}
+	_, rec, err := license.VerifyRegisteredLicense(data, keyring, registry)
+	if err != nil {
+		log.Printf("Verify license failed. err=%s", err)
+		return
+	}
+	if rec.DeviceId != req.DeviceId {
+		log.Printf("License %d not issued to device %s.", rec.Id, req.DeviceId)
+		return
+	}
+
+	req.Kids = rec.Kids
+	licenseStr, err := issueLicense(&req.LicenseRequest)
+	if err != nil {
+		log.Printf("Issue license failed. err=%s", err)
+		return
+	}
+	writeLicense(w, req.DeviceId, licenseStr)
+}
+
+// issueLicense issues and registers the license of req, in base64.
+func issueLicense(req *LicenseRequest) (string, error) {
+	// Content keys are issued encrypted by the device key.
+	if deviceKeys == nil {
+		return "", errors.New("no device seeds, licenses are not issued")
+	}
+	deviceKey, err := deviceKeys.DeriveKey(req.DeviceId)
+	if err != nil {
+		return "", fmt.Errorf("derive device key: %w", err)
+	}
+
 	// Query objects to be authorized
 	objs := []string{"07fba7c4-a5d3-43b2-973b-0b474a0b9ede"}
-	certId := "47946232-dad5-4b46-b1e6-4f0b581108dc"
 	// Generate license
-	lic := license.NewCommonLicense(req.Kids, objs, certId)
-	licenseStr := lic.Base64String()
+	lic, err := license.NewCommonLicenseFrom(contentKeys{}, req.Kids, objs, *certId)
+	if err != nil {
+		return "", fmt.Errorf("derive content keys: %w", err)
+	}
+	specs := req.Rights
+	if len(specs) == 0 {
+		specs = []license.RightSpec{{Type: "play"}}
+	}
+	rights := []license.Right{}
+	for _, spec := range specs {
+		for _, kid := range req.Kids {
+			if err := entitlementOf(kid).Check(spec); err != nil {
+				return "", fmt.Errorf("right refused for kid %s: %w", kid, err)
+			}
+		}
+		right, err := spec.Right()
+		if err != nil {
+			return "", err
+		}
+		rights = append(rights, right)
+	}
+	lic.SetRights(rights...)
+	if err := lic.Negotiate(req.Capabilities); err != nil {
+		return "", err
+	}
 
+	err = lic.EncryptKeys(license.NewDeviceKey(req.DeviceId, deviceKey))
+	if err != nil {
+		return "", err
+	}
+	signingKey, err := keyring.Current()
+	if err != nil {
+		return "", err
+	}
+	if _, err := lic.Sign(signingKey, true); err != nil {
+		return "", err
+	}
+	licenseStr, err := lic.Base64String()
+	if err != nil {
+		return "", err
+	}
+
+	if err := registry.Register(license.NewRecord(lic, req.DeviceId)); err != nil {
+		return "", err
+	}
+	return licenseStr, nil
+}
+
+func writeLicense(w http.ResponseWriter, deviceId, licenseStr string) {
 	resp := &LicenseResp{
-		DeviceId: req.DeviceId,
+		DeviceId: deviceId,
 		Licenses: []string{licenseStr},
 	}
 
 	respData, err := json.Marshal(resp)
 	if err != nil {
-		log.Fatalf("Marshal response failed. Err=%s", err)
+		log.Printf("Marshal response failed. Err=%s", err)
 		return
 	}
 	w.Write(respData)
+}
+
+// GetCerts serves the certificate chain of /certs/{id} in pem, leaf first.
+func GetCerts(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/certs/")
+	if certStore == nil || id == "" {
+		http.NotFound(w, r)
+		return
+	}
 
+	data, err := certStore.ChainPem(id)
+	if err != nil {
+		log.Printf("Get certificate chain failed. err=%s", err)
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-pem-file")
+	w.Write(data)
+}
+
+type SigningKeyResp struct {
+	CertId    string    `json:"cert_id"`
+	NotBefore time.Time `json:"not_before"`
+	NotAfter  time.Time `json:"not_after"`
+	PublicKey string    `json:"public_key"`
+}
+
+// GetKeys serves the public keys that licenses are verified by, including the
+// previous ones that have not expired and the scheduled ones.
+func GetKeys(w http.ResponseWriter, r *http.Request) {
+	resp := []SigningKeyResp{}
+	for _, k := range keyring.Published() {
+		pub, err := license.MarshalPublicKeyPem(k.Public())
+		if err != nil {
+			log.Printf("Marshal public key failed. err=%s", err)
+			return
+		}
+		resp = append(resp, SigningKeyResp{
+			CertId:    k.CertificateId(),
+			NotBefore: k.NotBefore,
+			NotAfter:  k.NotAfter,
+			PublicKey: string(pub),
+		})
+	}
+
+	data, _ := json.Marshal(resp)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
+
+func loadKeyring() (*license.Keyring, error) {
+	if *keyringFile == "" {
+		s, err := loadSigner()
+		if err != nil {
+			return nil, err
+		}
+		return license.NewKeyring(license.SigningKey{Signer: s})
+	}
+
+	specs, err := license.ReadKeySpecs(*keyringFile)
+	if err != nil {
+		return nil, err
+	}
+	tokens, err := openTokenKeys()
+	if err != nil {
+		return nil, err
+	}
+	return license.LoadKeyring(filepath.Dir(*keyringFile), specs, tokens)
+}
+
+// checkSigningKey checks that clients can fetch a trusted chain of k, which
+// certifies it.
+func checkSigningKey(k license.SigningKey) error {
+	if certStore == nil {
+		return nil
+	}
+	return certStore.CheckKey(k.CertificateId(), k.Public())
+}
+
+func loadSeeds() (*key.SeedRegistry, error) {
+	ss := key.DefaultSeeds()
+	if *seedsFile != "" {
+		var err error
+		if ss, err = readSeeds(*seedsFile); err != nil {
+			return nil, err
+		}
+	}
+
+	sr, err := key.NewSeedRegistry(ss)
+	if err != nil {
+		return nil, err
+	}
+	if err := sr.OpenIndex(*seedIndex); err != nil {
+		return nil, err
+	}
+	return sr, nil
+}
+
+func loadEntitlements() (map[string]license.Entitlement, error) {
+	data, err := ioutil.ReadFile(*entitlementsFile)
+	if err != nil {
+		return nil, err
+	}
+	es := map[string]license.Entitlement{}
+	if err := json.Unmarshal(data, &es); err != nil {
+		return nil, err
+	}
+	return es, nil
+}
+
+// loadDeviceKeys loads the device seed file. The built-in seed is public, it
+// can't be the device seed.
+func loadDeviceKeys() (*key.KeyGenerator, error) {
+	ss, err := readSeeds(*deviceSeedsFile)
+	if err != nil {
+		return nil, err
+	}
+	if ss.Current == key.DefaultSeeds().Current {
+		return nil, errors.New("the built-in seed can't derive device keys")
+	}
+	return ss.Generator()
+}
+
+// reload reloads the keyring file and the seed file on SIGHUP, to pick up a
+// scheduled rollover or a seed rotation.
+func reload() {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGHUP)
+	for range sigs {
+		if *seedsFile != "" {
+			ss, err := readSeeds(*seedsFile)
+			if err == nil {
+				err = seeds.Reload(ss)
+			}
+			if err != nil {
+				log.Printf("Reload seeds failed. err=%s", err)
+			} else {
+				log.Printf("Seeds reloaded, current seed %s.", ss.Current)
+			}
+		}
+		if *keyringFile == "" {
+			continue
+		}
+
+		specs, err := license.ReadKeySpecs(*keyringFile)
+		if err == nil {
+			err = keyring.Reload(filepath.Dir(*keyringFile), specs, checkSigningKey)
+		}
+		if err != nil {
+			log.Printf("Reload keyring failed. err=%s", err)
+			continue
+		}
+		log.Printf("Keyring reloaded, %d keys.", len(specs))
+	}
+}
+
+func loadCertStore() (*cert.Store, error) {
+	roots, err := cert.LoadRoots(*rootsFile)
+	if err != nil {
+		return nil, err
+	}
+
+	store := cert.NewStore(roots)
+	if err := store.LoadDir(*certsDir); err != nil {
+		return nil, err
+	}
+	if *crlFile != "" {
+		data, err := ioutil.ReadFile(*crlFile)
+		if err != nil {
+			return nil, err
+		}
+		if err := store.AddCRL(data); err != nil {
+			return nil, err
+		}
+	}
+	return store, nil
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "rollover" {
+		if err := rollover(os.Args[2:]); err != nil {
+			log.Fatalf("Rollover failed. err=%s", err)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "seed" {
+		if err := rotateSeed(os.Args[2:]); err != nil {
+			log.Fatalf("Seed rotation failed. err=%s", err)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "kms" {
+		if err := manageKMS(os.Args[2:]); err != nil {
+			log.Fatalf("KMS update failed. err=%s", err)
+		}
+		return
+	}
+	flag.Parse()
+
+	if *kmsFile != "" {
+		lk, err := openKMS(*kmsFile)
+		if err != nil {
+			log.Fatalf("Open KMS failed. err=%s", err)
+		}
+		kms = lk
+	}
+
+	if *rootsFile != "" {
+		store, err := loadCertStore()
+		if err != nil {
+			log.Fatalf("Load certificates failed. err=%s", err)
+		}
+		certStore = store
+	}
+
+	kr, err := loadKeyring()
+	if err != nil {
+		log.Fatalf("Load signing keys failed. err=%s", err)
+	}
+	keyring = kr
+
+	sr, err := loadSeeds()
+	if err != nil {
+		log.Fatalf("Load key seeds failed. err=%s", err)
+	}
+	defer sr.Close()
+	seeds = sr
+
+	if *entitlementsFile != "" {
+		es, err := loadEntitlements()
+		if err != nil {
+			log.Fatalf("Load entitlements failed. err=%s", err)
+		}
+		entitlements = es
+	}
+	if *deviceSeedsFile != "" {
+		kg, err := loadDeviceKeys()
+		if err != nil {
+			log.Fatalf("Load device seeds failed. err=%s", err)
+		}
+		deviceKeys = kg
+	}
+
+	ks, err := openKeyStore()
+	if err != nil {
+		log.Fatalf("Open key store failed. err=%s", err)
+	}
+	defer ks.Close()
+	keyStore = ks
+	if kms != nil {
+		es := key.NewEncryptedStore(ks, kms)
+		if *rewrap {
+			if err := rewrapKeys(es); err != nil {
+				log.Fatalf("Rewrap keys failed. err=%s", err)
+			}
+		}
+		keyStore = es
+	}
+	if *importKids != "" {
+		n, err := importKidFile(*importKids, *importSeed)
+		if err != nil {
+			log.Fatalf("Import kids failed. err=%s", err)
+		}
+		log.Printf("%d kids imported with seed %s.", n, *importSeed)
+	}
+	go reload()
+	for _, k := range keyring.Published() {
+		if err := checkSigningKey(k); err != nil {
+			log.Fatalf("Signing certificate not trusted. err=%s", err)
+		}
+	}
+
+	reg, err := license.OpenFileRegistry("licenses.jsonl")
+	if err != nil {
+		log.Fatalf("Open license registry failed. err=%s", err)
+	}
+	defer reg.Close()
+	registry = reg
+
 	keyServer := server.NewKeyServer(":8090")
 	http.HandleFunc("/genkey", GenKey)
 	http.HandleFunc("/acquirelicense", AcquireLicense)
+	http.HandleFunc("/renewlicense", RenewLicense)
+	http.HandleFunc("/certs/", GetCerts)
+	http.HandleFunc("/keys", GetKeys)
 	keyServer.Start()
 }
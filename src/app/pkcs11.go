@@ -0,0 +1,64 @@
+//go:build pkcs11
+// +build pkcs11
+
+/*
+	Opendrm, an open source implementation of industry-grade DRM
+	(Digital Rights Management) or Key System.
+	Copyright (C) 2018  wilkk
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"core/license"
+	"flag"
+	"os"
+)
+
+var (
+	pkcs11Module = flag.String("pkcs11-module", "", "PKCS#11 library of the token holding the signing keys, -key is used if empty")
+	pkcs11Slot   = flag.Uint("pkcs11-slot", 0, "slot of the token")
+	pkcs11Label  = flag.String("pkcs11-label", "opendrm-license", "label of the signing key in the token")
+	pkcs11Pool   = flag.Int("pkcs11-sessions", 4, "max number of sessions open to the token")
+)
+
+func pkcs11Config() license.PKCS11Config {
+	// The pin is taken from environment, so that it isn't seen in ps.
+	return license.PKCS11Config{
+		Module:   *pkcs11Module,
+		Slot:     *pkcs11Slot,
+		Pin:      os.Getenv("OPENDRM_PKCS11_PIN"),
+		Label:    *pkcs11Label,
+		PoolSize: *pkcs11Pool,
+	}
+}
+
+func init() {
+	loadPem := loadSigner
+	loadSigner = func() (license.Signer, error) {
+		if *pkcs11Module == "" {
+			return loadPem()
+		}
+		return license.OpenPKCS11Signer(pkcs11Config())
+	}
+	// Keys of a keyring name their CKA_ID by token_key.
+	openTokenKeys = func() (license.TokenKeys, error) {
+		if *pkcs11Module == "" {
+			return nil, nil
+		}
+		return license.OpenPKCS11Token(pkcs11Config())
+	}
+}
@@ -0,0 +1,94 @@
+/*
+	Opendrm, an open source implementation of industry-grade DRM
+	(Digital Rights Management) or Key System.
+	Copyright (C) 2018  wilkk
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"core/license"
+	"errors"
+	"flag"
+	"fmt"
+	"path/filepath"
+	"time"
+)
+
+// rollover is the admin command that schedules a new signing key:
+//
+//	app rollover -keyring keyring.json -key next.pem -cert-id <id> -at <RFC 3339 time>
+//
+// A key kept in the PKCS#11 token is named by -token-key <CKA_ID> instead of
+// -key; it's looked up when the server reloads the keyring.
+//
+// The older keys expire -overlap after the new one takes over, so that the
+// licenses they signed keep verifying until then. The server picks up the
+// change on SIGHUP.
+func rollover(args []string) error {
+	fs := flag.NewFlagSet("rollover", flag.ContinueOnError)
+	path := fs.String("keyring", "keyring.json", "keyring file to update")
+	keyFile := fs.String("key", "", "private key of the new signing key, in pem")
+	tokenKey := fs.String("token-key", "", "CKA_ID of the new signing key in the PKCS#11 token, instead of -key")
+	certId := fs.String("cert-id", "", "id of the certificate of the new signing key")
+	at := fs.String("at", "", "time the new key takes over, in RFC 3339")
+	overlap := fs.Duration("overlap", 366*24*time.Hour, "time the older keys stay valid after rollover")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if (*keyFile == "") == (*tokenKey == "") {
+		return errors.New("one of -key and -token-key is required")
+	}
+	if *certId == "" || *at == "" {
+		return errors.New("-cert-id and -at are required")
+	}
+
+	notBefore, err := time.Parse(time.RFC3339, *at)
+	if err != nil {
+		return err
+	}
+	if *keyFile != "" {
+		// Make sure that the key can sign before it's scheduled.
+		if _, err := license.LoadPemSigner(*keyFile, *certId); err != nil {
+			return err
+		}
+		if abs, err := filepath.Abs(*keyFile); err == nil {
+			*keyFile = abs
+		}
+	}
+
+	specs, err := license.ReadKeySpecs(*path)
+	if err != nil {
+		return err
+	}
+	specs, err = license.ScheduleRollover(specs, license.KeySpec{
+		CertId:    *certId,
+		KeyFile:   *keyFile,
+		TokenKey:  *tokenKey,
+		NotBefore: notBefore,
+	}, *overlap)
+	if err != nil {
+		return err
+	}
+	if err := license.WriteKeySpecs(*path, specs); err != nil {
+		return err
+	}
+
+	for _, spec := range specs {
+		fmt.Printf("%s\t%s\t%s\n", spec.CertId, spec.NotBefore.Format(time.RFC3339), spec.NotAfter.Format(time.RFC3339))
+	}
+	return nil
+}
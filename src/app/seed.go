@@ -0,0 +1,138 @@
+/*
+	Opendrm, an open source implementation of industry-grade DRM
+	(Digital Rights Management) or Key System.
+	Copyright (C) 2018  wilkk
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"core/key"
+	"crypto/rand"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+)
+
+// KIDs packaged before the seed index are not in it, and their licenses are
+// refused until they're imported with the seed their keys were derived from.
+var (
+	importKids = flag.String("import-kids", "", "file of KIDs packaged before the seed index, one per line, imported at start")
+	importSeed = flag.String("import-seed", "default", "seed the KIDs of -import-kids were derived from")
+)
+
+// importKidFile records the KIDs of path with seed id. A KID with a stored
+// key is owned by keyStore and refused. Importing the file again does nothing.
+func importKidFile(path, id string) (int, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+
+	n := 0
+	for _, kid := range strings.Fields(string(data)) {
+		if _, err := keyStore.Get(kid); err != key.ErrNotFound {
+			if err == nil {
+				err = errKidOwned
+			}
+			return n, fmt.Errorf("import kid %s: %w", kid, err)
+		}
+		if err := seeds.Import(kid, id); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
+
+// rotateSeed is the admin command that manages the seed file:
+//
+//	app seed -seeds seeds.json -new [-mode playready] [-kms kms.json]
+//	app seed -seeds seeds.json -retire <seed id>
+//
+// -new adds a random seed and makes it current, a missing seed file starts
+// with the built-in seed. -retire stops a leaked seed from deriving new KIDs.
+// With -kms, seeds in the clear are wrapped before the file is written. The
+// server picks up the change on SIGHUP.
+//
+// The device seed file of -device-seeds is made the same way, in legacy mode
+// unless device ids are GUIDs. It's loaded at start only.
+func rotateSeed(args []string) error {
+	fs := flag.NewFlagSet("seed", flag.ContinueOnError)
+	path := fs.String("seeds", "seeds.json", "seed file to update")
+	newSeed := fs.Bool("new", false, "add a random seed and make it current")
+	mode := fs.String("mode", "playready", "derivation of the new seed, playready or legacy")
+	retire := fs.String("retire", "", "id of the seed to retire")
+	kmsPath := fs.String("kms", "", "KMS file wrapping the seeds, seeds are kept in the clear if empty")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *newSeed == (*retire != "") {
+		return errors.New("one of -new and -retire is required")
+	}
+
+	ss, err := key.ReadSeeds(*path)
+	if os.IsNotExist(err) {
+		ss, err = key.DefaultSeeds(), nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if *newSeed {
+		var m key.SeedMode
+		if err := m.UnmarshalText([]byte(*mode)); err != nil {
+			return err
+		}
+		s, err := key.NewSeed(rand.Reader, m)
+		if err != nil {
+			return err
+		}
+		if err := ss.Rotate(s); err != nil {
+			return err
+		}
+	} else if err := ss.Retire(*retire); err != nil {
+		return err
+	}
+	if *kmsPath != "" {
+		lk, err := openKMS(*kmsPath)
+		if err != nil {
+			return err
+		}
+		if err := ss.Wrap(lk); err != nil {
+			return err
+		}
+	}
+	if err := key.WriteSeeds(*path, ss); err != nil {
+		return err
+	}
+
+	for _, s := range ss.Seeds {
+		state := ""
+		if s.Id == ss.Current {
+			state = "current"
+		} else if s.Retired {
+			state = "retired"
+		}
+		mode, _ := s.Mode.MarshalText()
+		fmt.Printf("%s\t%s\t%s\t%s\n", s.Id, mode, s.Created.Format(time.RFC3339), state)
+	}
+	return nil
+}
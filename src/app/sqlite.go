@@ -0,0 +1,47 @@
+//go:build sqlite
+// +build sqlite
+
+/*
+	Opendrm, an open source implementation of industry-grade DRM
+	(Digital Rights Management) or Key System.
+	Copyright (C) 2018  wilkk
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"core/key"
+	"database/sql"
+	"flag"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+var sqliteStore = flag.String("sqlite-store", "", "SQLite database of content keys, -key-store is used if empty")
+
+func init() {
+	open := openKeyStore
+	openKeyStore = func() (key.Store, error) {
+		if *sqliteStore == "" {
+			return open()
+		}
+		db, err := sql.Open("sqlite3", *sqliteStore)
+		if err != nil {
+			return nil, err
+		}
+		return key.NewSQLStore(db, "content_keys")
+	}
+}
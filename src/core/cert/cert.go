@@ -0,0 +1,342 @@
+/*
+	Opendrm, an open source implementation of industry-grade DRM
+	(Digital Rights Management) or Key System.
+	Copyright (C) 2018  wilkk
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+/*
+	Package cert keeps the certificates of license signing keys, stored by the
+	certificate id that a license carries in Signature.CertificatId.
+
+	Each id maps to a chain, leaf first. A chain is trusted if it leads to one
+	of the roots of trust, every certificate of it is valid at the time, and
+	none has been revoked by a CRL of its issuer. When a signing key is
+	rotated, the new certificate is added under a new id and the old one stays,
+	so licenses signed by either key verify until the old one is revoked.
+
+	crypto/x509 doesn't know SM2, so chains of SM2 keys are parsed and
+	verified by github.com/emmansun/gmsm/smx509 in builds with the gmsm tag.
+*/
+
+package cert
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrUnknownCert = errors.New("cert: unknown certificate id")
+	ErrRevoked     = errors.New("cert: certificate revoked")
+	ErrNoCert      = errors.New("cert: no certificate found")
+	ErrCRLIssuer   = errors.New("cert: crl is not issued by a trusted certificate")
+	ErrCRLExpired  = errors.New("cert: crl expired")
+	ErrKeyMismatch = errors.New("cert: certificate doesn't match the signing key")
+)
+
+// Certificate operations that crypto/x509 can't do on SM2 chains, replaced by
+// builds with the gmsm tag (see gmsm.go).
+var (
+	parseCertificate  = x509.ParseCertificate
+	verifyChain       = verifyX509Chain
+	checkCRLSignature = func(crl *x509.RevocationList, issuer *x509.Certificate) error {
+		return crl.CheckSignatureFrom(issuer)
+	}
+	publicKeyOf = func(cert *x509.Certificate) crypto.PublicKey {
+		return cert.PublicKey
+	}
+)
+
+type revokedKey struct {
+	issuer string
+	serial string
+}
+
+// Store is a repository of certificate chains. It implements the
+// license.CertResolver interface.
+type Store struct {
+	lock    sync.RWMutex
+	roots   []*x509.Certificate
+	chains  map[string][]*x509.Certificate
+	revoked map[revokedKey]time.Time
+	// now returns the time certificates are checked at.
+	now func() time.Time
+}
+
+// NewStore creates a store that trusts chains leading to roots.
+func NewStore(roots []*x509.Certificate) *Store {
+	return &Store{
+		roots:   roots,
+		chains:  map[string][]*x509.Certificate{},
+		revoked: map[revokedKey]time.Time{},
+		now:     time.Now,
+	}
+}
+
+// ParsePem parses all certificates in pem data, in order.
+func ParsePem(data []byte) ([]*x509.Certificate, error) {
+	certs := []*x509.Certificate{}
+	for {
+		block, rest := pem.Decode(data)
+		if block == nil {
+			break
+		}
+		data = rest
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+
+		cert, err := parseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) == 0 {
+		return nil, ErrNoCert
+	}
+
+	return certs, nil
+}
+
+func revokedKeyOf(cert *x509.Certificate) revokedKey {
+	return revokedKey{
+		issuer: string(cert.RawIssuer),
+		serial: cert.SerialNumber.String(),
+	}
+}
+
+// verifyX509Chain returns the paths from the leaf of chain to roots at time
+// now.
+func verifyX509Chain(chain, roots []*x509.Certificate, now time.Time) ([][]*x509.Certificate, error) {
+	pool := x509.NewCertPool()
+	for _, c := range roots {
+		pool.AddCert(c)
+	}
+	inters := x509.NewCertPool()
+	for _, c := range chain[1:] {
+		inters.AddCert(c)
+	}
+
+	return chain[0].Verify(x509.VerifyOptions{
+		Roots:         pool,
+		Intermediates: inters,
+		CurrentTime:   now,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	})
+}
+
+// verify checks chain at time now, the caller holds the lock.
+func (s *Store) verify(chain []*x509.Certificate, now time.Time) error {
+	paths, err := verifyChain(chain, s.roots, now)
+	if err != nil {
+		return err
+	}
+
+	// Any path through a revoked certificate is not trusted.
+	for _, path := range paths {
+		revoked := false
+		for _, c := range path {
+			if at, ok := s.revoked[revokedKeyOf(c)]; ok && !now.Before(at) {
+				revoked = true
+				break
+			}
+		}
+		if !revoked {
+			return nil
+		}
+	}
+	return ErrRevoked
+}
+
+// Add stores chain, leaf first, by id. The chain must be trusted now.
+func (s *Store) Add(id string, chain []*x509.Certificate) error {
+	if len(chain) == 0 {
+		return ErrNoCert
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if err := s.verify(chain, s.now()); err != nil {
+		return fmt.Errorf("cert: add %q: %w", id, err)
+	}
+	s.chains[id] = chain
+	return nil
+}
+
+// AddPem stores the chain in pem data by id.
+func (s *Store) AddPem(id string, data []byte) error {
+	chain, err := ParsePem(data)
+	if err != nil {
+		return err
+	}
+
+	return s.Add(id, chain)
+}
+
+// LoadDir stores the chain in every <id>.pem file of dir.
+func (s *Store) LoadDir(dir string) error {
+	files, err := filepath.Glob(filepath.Join(dir, "*.pem"))
+	if err != nil {
+		return err
+	}
+
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		id := strings.TrimSuffix(filepath.Base(file), ".pem")
+		if err := s.AddPem(id, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// issuer returns the trusted certificate that signed crl.
+func (s *Store) issuer(crl *x509.RevocationList) *x509.Certificate {
+	candidates := append([]*x509.Certificate{}, s.roots...)
+	for _, chain := range s.chains {
+		candidates = append(candidates, chain[1:]...)
+	}
+
+	for _, c := range candidates {
+		if !bytes.Equal(c.RawSubject, crl.RawIssuer) {
+			continue
+		}
+		if checkCRLSignature(crl, c) == nil {
+			return c
+		}
+	}
+	return nil
+}
+
+// AddCRL adds the revoked certificates of a DER encoded CRL. The CRL must be
+// signed by a root, or by an intermediate of a stored chain.
+func (s *Store) AddCRL(der []byte) error {
+	crl, err := x509.ParseRevocationList(der)
+	if err != nil {
+		return err
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.issuer(crl) == nil {
+		return ErrCRLIssuer
+	}
+	if !crl.NextUpdate.IsZero() && s.now().After(crl.NextUpdate) {
+		return ErrCRLExpired
+	}
+
+	for _, entry := range crl.RevokedCertificateEntries {
+		key := revokedKey{
+			issuer: string(crl.RawIssuer),
+			serial: entry.SerialNumber.String(),
+		}
+		s.revoked[key] = entry.RevocationTime
+	}
+	return nil
+}
+
+// Revoke revokes the certificate with serial, issued by issuer, from now on.
+func (s *Store) Revoke(issuer *x509.Certificate, serial *big.Int) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	key := revokedKey{
+		issuer: string(issuer.RawSubject),
+		serial: serial.String(),
+	}
+	s.revoked[key] = s.now()
+}
+
+// Chain returns the chain stored by id, if it's still trusted.
+func (s *Store) Chain(id string) ([]*x509.Certificate, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	chain, ok := s.chains[id]
+	if !ok {
+		return nil, fmt.Errorf("%w: %q", ErrUnknownCert, id)
+	}
+	if err := s.verify(chain, s.now()); err != nil {
+		return nil, err
+	}
+	return chain, nil
+}
+
+// ChainPem returns the chain stored by id in pem, leaf first.
+func (s *Store) ChainPem(id string) ([]byte, error) {
+	chain, err := s.Chain(id)
+	if err != nil {
+		return nil, err
+	}
+
+	buff := &bytes.Buffer{}
+	for _, c := range chain {
+		pem.Encode(buff, &pem.Block{Type: "CERTIFICATE", Bytes: c.Raw})
+	}
+	return buff.Bytes(), nil
+}
+
+// PublicKey returns the public key of the leaf certificate of id, if its
+// chain is trusted.
+func (s *Store) PublicKey(certId string) (crypto.PublicKey, error) {
+	chain, err := s.Chain(certId)
+	if err != nil {
+		return nil, err
+	}
+
+	return publicKeyOf(chain[0]), nil
+}
+
+// CheckKey checks that the leaf certificate of id, if its chain is trusted,
+// certifies pub, the public key of a signing key.
+func (s *Store) CheckKey(certId string, pub crypto.PublicKey) error {
+	certPub, err := s.PublicKey(certId)
+	if err != nil {
+		return err
+	}
+
+	k, ok := certPub.(interface{ Equal(crypto.PublicKey) bool })
+	if !ok || !k.Equal(pub) {
+		return fmt.Errorf("%w: %q", ErrKeyMismatch, certId)
+	}
+	return nil
+}
+
+// LoadRoots reads the roots of trust from a pem file.
+func LoadRoots(pemFile string) ([]*x509.Certificate, error) {
+	data, err := ioutil.ReadFile(pemFile)
+	if err != nil {
+		return nil, err
+	}
+
+	return ParsePem(data)
+}
@@ -0,0 +1,183 @@
+/*
+	Opendrm, an open source implementation of industry-grade DRM
+	(Digital Rights Management) or Key System.
+	Copyright (C) 2018  wilkk
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package cert
+
+import (
+	"core/license"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"math/big"
+	"testing"
+	"time"
+)
+
+var now = time.Unix(1600000000, 0)
+
+type testCert struct {
+	cert *x509.Certificate
+	key  *rsa.PrivateKey
+}
+
+func newCert(t *testing.T, name string, serial int64, parent *testCert, ca bool, notAfter time.Time) *testCert {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("GenerateKey failed. err=%s", err)
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(serial),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              notAfter,
+		BasicConstraintsValid: true,
+		IsCA:                  ca,
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+	}
+	if ca {
+		tmpl.KeyUsage |= x509.KeyUsageCertSign | x509.KeyUsageCRLSign
+	}
+
+	signer, signerCert := key, tmpl
+	if parent != nil {
+		signer, signerCert = parent.key, parent.cert
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signerCert, &key.PublicKey, signer)
+	if err != nil {
+		t.Fatalf("CreateCertificate failed. err=%s", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("ParseCertificate failed. err=%s", err)
+	}
+
+	return &testCert{cert: cert, key: key}
+}
+
+func newCRL(t *testing.T, issuer *testCert, serials ...int64) []byte {
+	entries := []x509.RevocationListEntry{}
+	for _, serial := range serials {
+		entries = append(entries, x509.RevocationListEntry{
+			SerialNumber:   big.NewInt(serial),
+			RevocationTime: now.Add(-time.Minute),
+		})
+	}
+
+	der, err := x509.CreateRevocationList(rand.Reader, &x509.RevocationList{
+		Number:                    big.NewInt(1),
+		ThisUpdate:                now.Add(-time.Hour),
+		NextUpdate:                now.Add(24 * time.Hour),
+		RevokedCertificateEntries: entries,
+	}, issuer.cert, issuer.key)
+	if err != nil {
+		t.Fatalf("CreateRevocationList failed. err=%s", err)
+	}
+	return der
+}
+
+func TestStore(t *testing.T) {
+	year := now.AddDate(1, 0, 0)
+	root := newCert(t, "root", 1, nil, true, year)
+	inter := newCert(t, "intermediate", 2, root, true, year)
+	oldLeaf := newCert(t, "signing 1", 3, inter, false, year)
+	newLeaf := newCert(t, "signing 2", 4, inter, false, year)
+	expired := newCert(t, "expired", 5, inter, false, now.Add(time.Minute))
+	other := newCert(t, "other root", 6, nil, true, year)
+
+	s := NewStore([]*x509.Certificate{root.cert})
+	s.now = func() time.Time { return now }
+
+	if err := s.Add("old", []*x509.Certificate{oldLeaf.cert, inter.cert}); err != nil {
+		t.Fatalf("Add failed. err=%s", err)
+	}
+	if err := s.Add("new", []*x509.Certificate{newLeaf.cert, inter.cert}); err != nil {
+		t.Fatalf("Add failed. err=%s", err)
+	}
+	if err := s.Add("expired", []*x509.Certificate{expired.cert, inter.cert}); err != nil {
+		t.Fatalf("Add failed. err=%s", err)
+	}
+	if err := s.Add("untrusted", []*x509.Certificate{other.cert}); err == nil {
+		t.Fatalf("chain of untrusted root added.")
+	}
+
+	data, err := s.ChainPem("new")
+	if err != nil {
+		t.Fatalf("ChainPem failed. err=%s", err)
+	}
+	chain, err := ParsePem(data)
+	if err != nil || len(chain) != 2 || !chain[0].Equal(newLeaf.cert) {
+		t.Fatalf("ChainPem mismatch. err=%v", err)
+	}
+	if err := s.CheckKey("new", &newLeaf.key.PublicKey); err != nil {
+		t.Fatalf("CheckKey failed. err=%s", err)
+	}
+	if err := s.CheckKey("new", &oldLeaf.key.PublicKey); !errors.Is(err, ErrKeyMismatch) {
+		t.Fatalf("certificate matched another key. err=%v", err)
+	}
+	if _, err := s.Chain("none"); !errors.Is(err, ErrUnknownCert) {
+		t.Fatalf("unknown id: err=%v", err)
+	}
+
+	s.now = func() time.Time { return now.Add(time.Hour) }
+	if _, err := s.PublicKey("expired"); err == nil {
+		t.Fatalf("expired certificate trusted.")
+	}
+
+	// Licenses signed by either key verify until the old one is revoked.
+	sign := func(certId string, tc *testCert) []byte {
+		signer, err := license.NewKeySigner(tc.key, certId)
+		if err != nil {
+			t.Fatalf("NewKeySigner failed. err=%s", err)
+		}
+		cl := license.NewCommonLicense([]string{"123456789"}, nil, "")
+		if _, err := cl.Sign(signer, true); err != nil {
+			t.Fatalf("Sign failed. err=%s", err)
+		}
+		return cl.Serialize(true, true)
+	}
+	oldLic := sign("old", oldLeaf)
+	newLic := sign("new", newLeaf)
+	for _, data := range [][]byte{oldLic, newLic} {
+		if _, err := license.VerifyLicense(data, s); err != nil {
+			t.Fatalf("VerifyLicense failed. err=%s", err)
+		}
+	}
+
+	if err := s.AddCRL(newCRL(t, other, 3)); err != ErrCRLIssuer {
+		t.Fatalf("crl of untrusted issuer: err=%v", err)
+	}
+	if err := s.AddCRL(newCRL(t, inter, 3)); err != nil {
+		t.Fatalf("AddCRL failed. err=%s", err)
+	}
+	if _, err := license.VerifyLicense(oldLic, s); err != ErrRevoked {
+		t.Fatalf("license of revoked certificate: err=%v", err)
+	}
+	if _, err := license.VerifyLicense(newLic, s); err != nil {
+		t.Fatalf("VerifyLicense failed. err=%s", err)
+	}
+
+	// Revoking the intermediate revokes every chain through it.
+	s.Revoke(root.cert, inter.cert.SerialNumber)
+	if _, err := s.PublicKey("new"); err != ErrRevoked {
+		t.Fatalf("chain of revoked intermediate: err=%v", err)
+	}
+}
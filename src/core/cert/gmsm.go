@@ -0,0 +1,96 @@
+//go:build gmsm
+// +build gmsm
+
+/*
+	Opendrm, an open source implementation of industry-grade DRM
+	(Digital Rights Management) or Key System.
+	Copyright (C) 2018  wilkk
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package cert
+
+import (
+	"core/crypto/sm2"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/x509"
+	"math/big"
+	"time"
+
+	gmsm "github.com/emmansun/gmsm/sm2"
+	"github.com/emmansun/gmsm/smx509"
+)
+
+func init() {
+	parseCertificate = func(der []byte) (*x509.Certificate, error) {
+		cert, err := smx509.ParseCertificate(der)
+		if err != nil {
+			return nil, err
+		}
+		return (*x509.Certificate)(cert), nil
+	}
+	verifyChain = verifySM2Chain
+	checkCRLSignature = func(crl *x509.RevocationList, issuer *x509.Certificate) error {
+		if !gmsm.IsSM2PublicKey(issuer.PublicKey) {
+			return crl.CheckSignatureFrom(issuer)
+		}
+		// crypto/x509 parses the CRL, but doesn't know its SM2 signature.
+		return (*smx509.Certificate)(issuer).CheckSignature(smx509.SM2WithSM3, crl.RawTBSRevocationList, crl.Signature)
+	}
+	publicKeyOf = func(cert *x509.Certificate) crypto.PublicKey {
+		pub, ok := cert.PublicKey.(*ecdsa.PublicKey)
+		if !ok || !gmsm.IsSM2PublicKey(pub) {
+			return cert.PublicKey
+		}
+		key := &sm2.PublicKey{
+			X: new(big.Int).Set(pub.X),
+			Y: new(big.Int).Set(pub.Y),
+		}
+		key.Curve = sm2.P256()
+		return key
+	}
+}
+
+// verifySM2Chain is verifyX509Chain by smx509, which checks both RSA and SM2
+// signatures.
+func verifySM2Chain(chain, roots []*x509.Certificate, now time.Time) ([][]*x509.Certificate, error) {
+	pool := smx509.NewCertPool()
+	for _, c := range roots {
+		pool.AddCert((*smx509.Certificate)(c))
+	}
+	inters := smx509.NewCertPool()
+	for _, c := range chain[1:] {
+		inters.AddCert((*smx509.Certificate)(c))
+	}
+
+	paths, err := (*smx509.Certificate)(chain[0]).Verify(smx509.VerifyOptions{
+		Roots:         pool,
+		Intermediates: inters,
+		CurrentTime:   now,
+		KeyUsages:     []smx509.ExtKeyUsage{smx509.ExtKeyUsageAny},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	x509Paths := make([][]*x509.Certificate, len(paths))
+	for i, path := range paths {
+		for _, c := range path {
+			x509Paths[i] = append(x509Paths[i], (*x509.Certificate)(c))
+		}
+	}
+	return x509Paths, nil
+}
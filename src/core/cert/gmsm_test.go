@@ -0,0 +1,124 @@
+//go:build gmsm
+// +build gmsm
+
+/*
+	Opendrm, an open source implementation of industry-grade DRM
+	(Digital Rights Management) or Key System.
+	Copyright (C) 2018  wilkk
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package cert
+
+import (
+	"core/crypto/sm2"
+	"core/license"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"testing"
+	"time"
+
+	gmsm "github.com/emmansun/gmsm/sm2"
+	"github.com/emmansun/gmsm/smx509"
+)
+
+func newSM2Cert(t *testing.T, name string, serial int64, parent *x509.Certificate, parentKey *gmsm.PrivateKey) (*x509.Certificate, *gmsm.PrivateKey) {
+	key, err := gmsm.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey failed. err=%s", err)
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(serial),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.AddDate(1, 0, 0),
+		BasicConstraintsValid: true,
+		IsCA:                  parent == nil,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+	}
+	if parent == nil {
+		parent, parentKey = tmpl, key
+	}
+	der, err := smx509.CreateCertificate(rand.Reader, tmpl, parent, key.Public(), parentKey)
+	if err != nil {
+		t.Fatalf("CreateCertificate failed. err=%s", err)
+	}
+	certs, err := ParsePem(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+	if err != nil {
+		t.Fatalf("ParsePem failed. err=%s", err)
+	}
+
+	return certs[0], key
+}
+
+func TestSM2Chain(t *testing.T) {
+	root, rootKey := newSM2Cert(t, "sm2 root", 1, nil, nil)
+	leaf, leafKey := newSM2Cert(t, "sm2 signing", 2, root, rootKey)
+	other, _ := newSM2Cert(t, "sm2 other", 3, root, rootKey)
+
+	s := NewStore([]*x509.Certificate{root})
+	s.now = func() time.Time { return now }
+	if err := s.Add("sm2", []*x509.Certificate{leaf}); err != nil {
+		t.Fatalf("Add failed. err=%s", err)
+	}
+
+	priv, err := sm2.NewPrivateKey(leafKey.D)
+	if err != nil {
+		t.Fatalf("NewPrivateKey failed. err=%s", err)
+	}
+	if err := s.CheckKey("sm2", priv.Public()); err != nil {
+		t.Fatalf("CheckKey failed. err=%s", err)
+	}
+	otherPub := publicKeyOf(other)
+	if err := s.CheckKey("sm2", otherPub); err == nil {
+		t.Fatalf("certificate matched another key.")
+	}
+
+	signer, err := license.NewKeySigner(priv, "sm2")
+	if err != nil {
+		t.Fatalf("NewKeySigner failed. err=%s", err)
+	}
+	cl := license.NewCommonLicense([]string{"123456789"}, nil, "")
+	if _, err := cl.Sign(signer, true); err != nil {
+		t.Fatalf("Sign failed. err=%s", err)
+	}
+	data := cl.Serialize(true, true)
+	if _, err := license.VerifyLicense(data, s); err != nil {
+		t.Fatalf("VerifyLicense failed. err=%s", err)
+	}
+
+	der, err := smx509.CreateRevocationList(rand.Reader, &x509.RevocationList{
+		Number:     big.NewInt(1),
+		ThisUpdate: now.Add(-time.Hour),
+		NextUpdate: now.Add(24 * time.Hour),
+		// smx509 only encodes the deprecated field.
+		RevokedCertificates: []pkix.RevokedCertificate{
+			{SerialNumber: leaf.SerialNumber, RevocationTime: now.Add(-time.Minute)},
+		},
+	}, (*smx509.Certificate)(root), rootKey)
+	if err != nil {
+		t.Fatalf("CreateRevocationList failed. err=%s", err)
+	}
+	if err := s.AddCRL(der); err != nil {
+		t.Fatalf("AddCRL failed. err=%s", err)
+	}
+	if _, err := license.VerifyLicense(data, s); err != ErrRevoked {
+		t.Fatalf("license of revoked certificate: err=%v", err)
+	}
+}
@@ -0,0 +1,58 @@
+//go:build gmsm
+// +build gmsm
+
+/*
+	Opendrm, an open source implementation of industry-grade DRM
+	(Digital Rights Management) or Key System.
+	Copyright (C) 2018  wilkk
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package sm2
+
+import (
+	"io"
+	"math/big"
+
+	gmsm "github.com/emmansun/gmsm/sm2"
+)
+
+func init() {
+	generateKey = func(rand io.Reader) (*PrivateKey, error) {
+		key, err := gmsm.GenerateKey(rand)
+		if err != nil {
+			return nil, err
+		}
+		return fromGmsm(key), nil
+	}
+	newPrivateKey = func(d *big.Int) (*PrivateKey, error) {
+		key, err := gmsm.NewPrivateKeyFromInt(d)
+		if err != nil {
+			return nil, err
+		}
+		return fromGmsm(key), nil
+	}
+}
+
+func fromGmsm(key *gmsm.PrivateKey) *PrivateKey {
+	priv := &PrivateKey{
+		D:      new(big.Int).Set(key.D),
+		signer: key,
+	}
+	priv.Curve = P256()
+	priv.X = new(big.Int).Set(key.X)
+	priv.Y = new(big.Int).Set(key.Y)
+	return priv
+}
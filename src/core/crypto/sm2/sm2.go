@@ -0,0 +1,220 @@
+/*
+	Opendrm, an open source implementation of industry-grade DRM
+	(Digital Rights Management) or Key System.
+	Copyright (C) 2018  wilkk
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+/*
+	Package sm2 implements the SM2 digital signature algorithm over the
+	recommended 256 bits curve, as defined in GB/T 32918-2016 (GM/T 0003-2012).
+
+	Signing is split the same way as crypto/ecdsa: Digest computes e, the SM3
+	hash of Z and message, then PrivateKey.Sign and Verify work on e.
+
+	The curve arithmetic of this package is generic and not constant time, so
+	it's only used on public values, to verify. Operations on private keys are
+	done by github.com/emmansun/gmsm in builds with the gmsm tag (see gmsm.go);
+	other builds can't load or sign by SM2 private keys.
+*/
+
+package sm2
+
+import (
+	"core/crypto/sm3"
+	"crypto"
+	"crypto/elliptic"
+	"encoding/asn1"
+	"errors"
+	"io"
+	"math/big"
+	"sync"
+)
+
+// DefaultUID is the user id used to compute Z when none is agreed on.
+const DefaultUID = "1234567812345678"
+
+var (
+	errInvalidDigest = errors.New("sm2: digest must be 32 bytes")
+	errInvalidKey    = errors.New("sm2: invalid private key")
+
+	ErrNoPrivateKeys = errors.New("sm2: private keys need the gmsm build tag")
+)
+
+var (
+	initOnce sync.Once
+	sm2P256  *elliptic.CurveParams
+	sm2A     *big.Int
+)
+
+func initP256() {
+	sm2P256 = &elliptic.CurveParams{Name: "SM2-P-256", BitSize: 256}
+	sm2P256.P, _ = new(big.Int).SetString("FFFFFFFEFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFF00000000FFFFFFFFFFFFFFFF", 16)
+	sm2P256.N, _ = new(big.Int).SetString("FFFFFFFEFFFFFFFFFFFFFFFFFFFFFFFF7203DF6B21C6052B53BBF40939D54123", 16)
+	sm2P256.B, _ = new(big.Int).SetString("28E9FA9E9D9F5E344D5A9E4BCF6509A7F39789F515AB8F92DDBCBD414D940E93", 16)
+	sm2P256.Gx, _ = new(big.Int).SetString("32C4AE2C1F1981195F9904466A39C9948FE30BBFF2660BE1715A4589334C74C7", 16)
+	sm2P256.Gy, _ = new(big.Int).SetString("BC3736A2F4F6779C59BDCEE36B692153D0A9877CC62A474002DF32E52139F0A0", 16)
+	// a = p - 3, which is what elliptic.CurveParams assumes.
+	sm2A = new(big.Int).Sub(sm2P256.P, big.NewInt(3))
+}
+
+// P256 returns the SM2 recommended curve.
+func P256() elliptic.Curve {
+	initOnce.Do(initP256)
+	return sm2P256
+}
+
+type PublicKey struct {
+	elliptic.Curve
+	X, Y *big.Int
+}
+
+// Equal reports whether pub and x are the same SM2 public key.
+func (pub *PublicKey) Equal(x crypto.PublicKey) bool {
+	xx, ok := x.(*PublicKey)
+	if !ok || pub.X == nil || xx.X == nil {
+		return false
+	}
+	return pub.X.Cmp(xx.X) == 0 && pub.Y.Cmp(xx.Y) == 0
+}
+
+type PrivateKey struct {
+	PublicKey
+	D *big.Int
+
+	// signer signs in constant time.
+	signer crypto.Signer
+}
+
+// Public returns the public key of priv, it implements crypto.Signer.
+func (priv *PrivateKey) Public() crypto.PublicKey {
+	return &priv.PublicKey
+}
+
+// Private key operations in constant time, set by builds with the gmsm tag.
+var (
+	generateKey   func(rand io.Reader) (*PrivateKey, error)
+	newPrivateKey func(d *big.Int) (*PrivateKey, error)
+)
+
+// PrivateKeys reports whether private keys can be loaded and sign in this
+// build.
+func PrivateKeys() bool {
+	return newPrivateKey != nil
+}
+
+// GenerateKey generates a key pair. The private key d is in [1, n-2], as
+// 1+d must be invertible.
+func GenerateKey(rand io.Reader) (*PrivateKey, error) {
+	if generateKey == nil {
+		return nil, ErrNoPrivateKeys
+	}
+	return generateKey(rand)
+}
+
+// NewPrivateKey creates the key pair of private key d.
+func NewPrivateKey(d *big.Int) (*PrivateKey, error) {
+	n := P256().Params().N
+	if d.Sign() <= 0 || d.Cmp(new(big.Int).Sub(n, big.NewInt(1))) >= 0 {
+		return nil, errInvalidKey
+	}
+	if newPrivateKey == nil {
+		return nil, ErrNoPrivateKeys
+	}
+	return newPrivateKey(d)
+}
+
+func putInt(h io.Writer, v *big.Int) {
+	b := make([]byte, 32)
+	v.FillBytes(b)
+	h.Write(b)
+}
+
+// Digest returns e = SM3(Z || msg), where Z is the hash of uid, curve
+// parameters and the public key.
+func Digest(pub *PublicKey, uid, msg []byte) []byte {
+	params := P256().Params()
+
+	z := sm3.New()
+	entl := len(uid) * 8
+	z.Write([]byte{byte(entl >> 8), byte(entl)})
+	z.Write(uid)
+	putInt(z, sm2A)
+	putInt(z, params.B)
+	putInt(z, params.Gx)
+	putInt(z, params.Gy)
+	putInt(z, pub.X)
+	putInt(z, pub.Y)
+
+	e := sm3.New()
+	e.Write(z.Sum(nil))
+	e.Write(msg)
+	return e.Sum(nil)
+}
+
+type signature struct {
+	R, S *big.Int
+}
+
+// Sign signs digest, which must be computed by Digest, and returns the ASN.1
+// DER encoded signature. opts is not used.
+func (priv *PrivateKey) Sign(rand io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	if len(digest) != sm3.Size {
+		return nil, errInvalidDigest
+	}
+	if priv.signer == nil {
+		return nil, ErrNoPrivateKeys
+	}
+
+	// The signer takes digest as e when opts is nil.
+	return priv.signer.Sign(rand, digest, nil)
+}
+
+// Verify reports whether sig is a valid signature of digest by pub.
+func Verify(pub *PublicKey, digest, sig []byte) bool {
+	if len(digest) != sm3.Size {
+		return false
+	}
+
+	rs := signature{}
+	rest, err := asn1.Unmarshal(sig, &rs)
+	if err != nil || len(rest) != 0 || rs.R == nil || rs.S == nil {
+		return false
+	}
+
+	c := P256()
+	n := c.Params().N
+	r, s := rs.R, rs.S
+	if r.Sign() <= 0 || r.Cmp(n) >= 0 || s.Sign() <= 0 || s.Cmp(n) >= 0 {
+		return false
+	}
+	if pub.X == nil || pub.Y == nil || !c.IsOnCurve(pub.X, pub.Y) {
+		return false
+	}
+
+	t := new(big.Int).Add(r, s)
+	t.Mod(t, n)
+	if t.Sign() == 0 {
+		return false
+	}
+
+	x1, y1 := c.ScalarBaseMult(s.Bytes())
+	x2, y2 := c.ScalarMult(pub.X, pub.Y, t.Bytes())
+	x, _ := c.Add(x1, y1, x2, y2)
+
+	v := new(big.Int).Add(new(big.Int).SetBytes(digest), x)
+	v.Mod(v, n)
+	return v.Cmp(r) == 0
+}
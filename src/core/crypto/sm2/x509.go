@@ -0,0 +1,179 @@
+/*
+	Opendrm, an open source implementation of industry-grade DRM
+	(Digital Rights Management) or Key System.
+	Copyright (C) 2018  wilkk
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+/*
+	Encoding of SM2 keys in PKCS#8, SEC 1 and PKIX forms, compatible with keys
+	generated by 'openssl genpkey -algorithm SM2'.
+*/
+
+package sm2
+
+import (
+	"crypto/elliptic"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+	"math/big"
+)
+
+var (
+	oidPublicKeyECDSA = asn1.ObjectIdentifier{1, 2, 840, 10045, 2, 1}
+	oidNamedCurveSM2  = asn1.ObjectIdentifier{1, 2, 156, 10197, 1, 301}
+)
+
+var (
+	errNotSM2Key    = errors.New("sm2: not an SM2 key")
+	errInvalidPoint = errors.New("sm2: invalid public key point")
+)
+
+// IsSM2Curve reports whether the named curve of an EC key is SM2.
+func IsSM2Curve(oid asn1.ObjectIdentifier) bool {
+	return oid.Equal(oidNamedCurveSM2)
+}
+
+type pkcs8 struct {
+	Version    int
+	Algo       pkix.AlgorithmIdentifier
+	PrivateKey []byte
+}
+
+type ecPrivateKey struct {
+	Version       int
+	PrivateKey    []byte
+	NamedCurveOID asn1.ObjectIdentifier `asn1:"optional,explicit,tag:0"`
+	PublicKey     asn1.BitString        `asn1:"optional,explicit,tag:1"`
+}
+
+type publicKeyInfo struct {
+	Algorithm pkix.AlgorithmIdentifier
+	PublicKey asn1.BitString
+}
+
+func curveAlgorithm() (pkix.AlgorithmIdentifier, error) {
+	params, err := asn1.Marshal(oidNamedCurveSM2)
+	if err != nil {
+		return pkix.AlgorithmIdentifier{}, err
+	}
+	return pkix.AlgorithmIdentifier{
+		Algorithm:  oidPublicKeyECDSA,
+		Parameters: asn1.RawValue{FullBytes: params},
+	}, nil
+}
+
+func checkAlgorithm(algo pkix.AlgorithmIdentifier) error {
+	if !algo.Algorithm.Equal(oidPublicKeyECDSA) {
+		return errNotSM2Key
+	}
+	var curve asn1.ObjectIdentifier
+	if _, err := asn1.Unmarshal(algo.Parameters.FullBytes, &curve); err != nil {
+		return err
+	}
+	if !IsSM2Curve(curve) {
+		return errNotSM2Key
+	}
+	return nil
+}
+
+// ParseECPrivateKey parses an SM2 private key in SEC 1 form ("EC PRIVATE KEY").
+func ParseECPrivateKey(der []byte) (*PrivateKey, error) {
+	key := ecPrivateKey{}
+	if _, err := asn1.Unmarshal(der, &key); err != nil {
+		return nil, err
+	}
+	if key.NamedCurveOID != nil && !IsSM2Curve(key.NamedCurveOID) {
+		return nil, errNotSM2Key
+	}
+
+	return NewPrivateKey(new(big.Int).SetBytes(key.PrivateKey))
+}
+
+// ParsePKCS8PrivateKey parses an SM2 private key in PKCS#8 form ("PRIVATE KEY").
+func ParsePKCS8PrivateKey(der []byte) (*PrivateKey, error) {
+	key := pkcs8{}
+	if _, err := asn1.Unmarshal(der, &key); err != nil {
+		return nil, err
+	}
+	if err := checkAlgorithm(key.Algo); err != nil {
+		return nil, err
+	}
+
+	return ParseECPrivateKey(key.PrivateKey)
+}
+
+// MarshalPKCS8PrivateKey encodes priv in PKCS#8 form.
+func MarshalPKCS8PrivateKey(priv *PrivateKey) ([]byte, error) {
+	algo, err := curveAlgorithm()
+	if err != nil {
+		return nil, err
+	}
+
+	d := make([]byte, 32)
+	priv.D.FillBytes(d)
+	ec, err := asn1.Marshal(ecPrivateKey{
+		Version:    1,
+		PrivateKey: d,
+		PublicKey: asn1.BitString{
+			Bytes:     elliptic.Marshal(P256(), priv.X, priv.Y),
+			BitLength: 8 * (1 + 2*32),
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return asn1.Marshal(pkcs8{
+		Version:    0,
+		Algo:       algo,
+		PrivateKey: ec,
+	})
+}
+
+// ParsePKIXPublicKey parses an SM2 public key in PKIX form ("PUBLIC KEY").
+func ParsePKIXPublicKey(der []byte) (*PublicKey, error) {
+	info := publicKeyInfo{}
+	if _, err := asn1.Unmarshal(der, &info); err != nil {
+		return nil, err
+	}
+	if err := checkAlgorithm(info.Algorithm); err != nil {
+		return nil, err
+	}
+
+	x, y := elliptic.Unmarshal(P256(), info.PublicKey.RightAlign())
+	if x == nil {
+		return nil, errInvalidPoint
+	}
+	return &PublicKey{Curve: P256(), X: x, Y: y}, nil
+}
+
+// MarshalPKIXPublicKey encodes pub in PKIX form.
+func MarshalPKIXPublicKey(pub *PublicKey) ([]byte, error) {
+	algo, err := curveAlgorithm()
+	if err != nil {
+		return nil, err
+	}
+
+	point := elliptic.Marshal(P256(), pub.X, pub.Y)
+	return asn1.Marshal(publicKeyInfo{
+		Algorithm: algo,
+		PublicKey: asn1.BitString{
+			Bytes:     point,
+			BitLength: 8 * len(point),
+		},
+	})
+}
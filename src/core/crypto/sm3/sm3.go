@@ -0,0 +1,176 @@
+/*
+	Opendrm, an open source implementation of industry-grade DRM
+	(Digital Rights Management) or Key System.
+	Copyright (C) 2018  wilkk
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+/*
+	Package sm3 implements the SM3 hash algorithm as defined in GB/T 32905-2016
+	(GM/T 0004-2012).
+*/
+
+package sm3
+
+import (
+	"encoding/binary"
+	"hash"
+	"math/bits"
+)
+
+// The size of an SM3 checksum in bytes.
+const Size = 32
+
+// The blocksize of SM3 in bytes.
+const BlockSize = 64
+
+var iv = [8]uint32{
+	0x7380166f, 0x4914b2b9, 0x172442d7, 0xda8a0600,
+	0xa96f30bc, 0x163138aa, 0xe38dee4d, 0xb0fb0e4e,
+}
+
+type digest struct {
+	h   [8]uint32
+	x   [BlockSize]byte
+	nx  int
+	len uint64
+}
+
+// New returns a new hash.Hash computing the SM3 checksum.
+func New() hash.Hash {
+	d := &digest{}
+	d.Reset()
+	return d
+}
+
+// Sum returns the SM3 checksum of data.
+func Sum(data []byte) [Size]byte {
+	d := &digest{}
+	d.Reset()
+	d.Write(data)
+	var sum [Size]byte
+	copy(sum[:], d.Sum(nil))
+	return sum
+}
+
+func (d *digest) Reset() {
+	d.h = iv
+	d.nx = 0
+	d.len = 0
+}
+
+func (d *digest) Size() int { return Size }
+
+func (d *digest) BlockSize() int { return BlockSize }
+
+func (d *digest) Write(p []byte) (int, error) {
+	n := len(p)
+	d.len += uint64(n)
+	if d.nx > 0 {
+		c := copy(d.x[d.nx:], p)
+		d.nx += c
+		p = p[c:]
+		if d.nx == BlockSize {
+			block(&d.h, d.x[:])
+			d.nx = 0
+		}
+	}
+	for len(p) >= BlockSize {
+		block(&d.h, p[:BlockSize])
+		p = p[BlockSize:]
+	}
+	if len(p) > 0 {
+		d.nx = copy(d.x[:], p)
+	}
+	return n, nil
+}
+
+func (d *digest) Sum(in []byte) []byte {
+	// Work on a copy so that the caller can keep writing.
+	d0 := *d
+
+	// Padding: 0x80, zeros, then message length in bits, big endian.
+	var tmp [BlockSize + 8]byte
+	tmp[0] = 0x80
+	n := 56 - int(d0.len%BlockSize)
+	if n <= 0 {
+		n += BlockSize
+	}
+	binary.BigEndian.PutUint64(tmp[n:], d0.len<<3)
+	d0.Write(tmp[:n+8])
+
+	var out [Size]byte
+	for i, v := range d0.h {
+		binary.BigEndian.PutUint32(out[4*i:], v)
+	}
+	return append(in, out[:]...)
+}
+
+func p0(x uint32) uint32 {
+	return x ^ bits.RotateLeft32(x, 9) ^ bits.RotateLeft32(x, 17)
+}
+
+func p1(x uint32) uint32 {
+	return x ^ bits.RotateLeft32(x, 15) ^ bits.RotateLeft32(x, 23)
+}
+
+func block(h *[8]uint32, p []byte) {
+	var w [68]uint32
+	for i := 0; i < 16; i++ {
+		w[i] = binary.BigEndian.Uint32(p[4*i:])
+	}
+	for j := 16; j < 68; j++ {
+		w[j] = p1(w[j-16]^w[j-9]^bits.RotateLeft32(w[j-3], 15)) ^
+			bits.RotateLeft32(w[j-13], 7) ^ w[j-6]
+	}
+
+	a, b, c, d, e, f, g, hh := h[0], h[1], h[2], h[3], h[4], h[5], h[6], h[7]
+	for j := 0; j < 64; j++ {
+		var t, ff, gg uint32
+		if j < 16 {
+			t = 0x79cc4519
+			ff = a ^ b ^ c
+			gg = e ^ f ^ g
+		} else {
+			t = 0x7a879d8a
+			ff = (a & b) | (a & c) | (b & c)
+			gg = (e & f) | (^e & g)
+		}
+
+		a12 := bits.RotateLeft32(a, 12)
+		ss1 := bits.RotateLeft32(a12+e+bits.RotateLeft32(t, j%32), 7)
+		ss2 := ss1 ^ a12
+		tt1 := ff + d + ss2 + (w[j] ^ w[j+4])
+		tt2 := gg + hh + ss1 + w[j]
+
+		d = c
+		c = bits.RotateLeft32(b, 9)
+		b = a
+		a = tt1
+		hh = g
+		g = bits.RotateLeft32(f, 19)
+		f = e
+		e = p0(tt2)
+	}
+
+	h[0] ^= a
+	h[1] ^= b
+	h[2] ^= c
+	h[3] ^= d
+	h[4] ^= e
+	h[5] ^= f
+	h[6] ^= g
+	h[7] ^= hh
+}
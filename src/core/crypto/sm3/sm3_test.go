@@ -0,0 +1,57 @@
+/*
+	Opendrm, an open source implementation of industry-grade DRM
+	(Digital Rights Management) or Key System.
+	Copyright (C) 2018  wilkk
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package sm3
+
+import (
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+// Examples of GB/T 32905-2016, appendix A.
+func TestSum(t *testing.T) {
+	cases := []struct {
+		in, out string
+	}{
+		{"abc", "66c7f0f462eeedd9d1f2d46bdc10e4e24167c4875cf2f7a2297da02b8f4ba8e0"},
+		{strings.Repeat("abcd", 16), "debe9ff92275b8a138604889c18e5a4d6fdb70e5387e5765293dcba39c0c5732"},
+		{"", "1ab21d8355cfa17f8e61194831e81a8f22bec8c728fefb747ed035eb5082aa2b"},
+		// Padding boundaries, checked with OpenSSL.
+		{strings.Repeat("x", 55), "ff8f8d58b95a1f90e39d96f739fa873eee33c0a80e59c7bbbf184eb7d9b1f112"},
+		{strings.Repeat("x", 56), "c4c1c6206d36c325e66ae5432948b26f04acff8dfc0ea2606a79d59b83a16d61"},
+		{strings.Repeat("x", 64), "ad6af8cbe6a5a10beac0ecd1df9fa779228553fd7ead00313765349b32bd81ce"},
+		{strings.Repeat("x", 1000), "f698c23cad9bf84f65509038c7000bc7ab60e7a1206cb4e4e21674952e3d028d"},
+	}
+	for _, c := range cases {
+		sum := Sum([]byte(c.in))
+		if got := hex.EncodeToString(sum[:]); got != c.out {
+			t.Fatalf("Sum(%q) = %s, want %s", c.in, got, c.out)
+		}
+
+		// Write byte by byte to go through partial blocks.
+		h := New()
+		for i := 0; i < len(c.in); i++ {
+			h.Write([]byte{c.in[i]})
+		}
+		if got := hex.EncodeToString(h.Sum(nil)); got != c.out {
+			t.Fatalf("hash of %q = %s, want %s", c.in, got, c.out)
+		}
+	}
+}
@@ -0,0 +1,97 @@
+/*
+	Opendrm, an open source implementation of industry-grade DRM
+	(Digital Rights Management) or Key System.
+	Copyright (C) 2018  wilkk
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package sm4
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+)
+
+func unhex(s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+func TestCipher(t *testing.T) {
+	cases := []struct {
+		key, in, out string
+	}{
+		// Example 1 of GB/T 32907-2016, appendix A.
+		{"0123456789abcdeffedcba9876543210", "0123456789abcdeffedcba9876543210", "681edf34d206965e86b3e94f536e4246"},
+		// Checked with 'openssl enc -sm4-ecb -nopad'.
+		{"000102030405060708090a0b0c0d0e0f", "00112233445566778899aabbccddeeff", "74c046048161bbf3d4ceff33d3f429be"},
+		{"000102030405060708090a0b0c0d0e0f", "0123456789abcdeffedcba9876543210", "1a5e703aacf55cddf1198771f2fd791a"},
+	}
+	for _, c := range cases {
+		block, err := NewCipher(unhex(c.key))
+		if err != nil {
+			t.Fatalf("NewCipher failed. err=%s", err)
+		}
+
+		out := make([]byte, BlockSize)
+		block.Encrypt(out, unhex(c.in))
+		if !bytes.Equal(out, unhex(c.out)) {
+			t.Fatalf("Encrypt(%s) = %x, want %s", c.in, out, c.out)
+		}
+		block.Decrypt(out, out)
+		if !bytes.Equal(out, unhex(c.in)) {
+			t.Fatalf("Decrypt(%s) = %x, want %s", c.out, out, c.in)
+		}
+	}
+
+	if _, err := NewCipher(make([]byte, 24)); err == nil {
+		t.Fatalf("24 bytes key accepted.")
+	}
+}
+
+// tau must substitute every byte, in every position, as the S-box table does.
+func TestTau(t *testing.T) {
+	for x := 0; x < 256; x++ {
+		for pos := 0; pos < 32; pos += 8 {
+			// The other bytes are x+1, so that a wrong position shows.
+			a := uint32(byte(x+1))*0x01010101&^(0xff<<pos) | uint32(x)<<pos
+			want := uint32(sbox[byte(x+1)])*0x01010101&^(0xff<<pos) | uint32(sbox[x])<<pos
+			if got := tau(a); got != want {
+				t.Fatalf("tau(%08x) = %08x, want %08x", a, got, want)
+			}
+		}
+	}
+}
+
+// Example 2 of GB/T 32907-2016, appendix A: encrypt 1000000 times.
+func TestCipherIterated(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipped in short mode")
+	}
+
+	key := unhex("0123456789abcdeffedcba9876543210")
+	block, _ := NewCipher(key)
+	out := append([]byte{}, key...)
+	for i := 0; i < 1000000; i++ {
+		block.Encrypt(out, out)
+	}
+	if want := unhex("595298c7c6fd271f0402f804c33d3f66"); !bytes.Equal(out, want) {
+		t.Fatalf("got %x, want %x", out, want)
+	}
+}
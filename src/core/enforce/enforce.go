@@ -0,0 +1,168 @@
+/*
+	Opendrm, an open source implementation of industry-grade DRM
+	(Digital Rights Management) or Key System.
+	Copyright (C) 2018  wilkk
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+/*
+	Package enforce is the reference implementation of client side policy
+	enforcement. It enforces the key rules of Policy units of a license:
+
+		start time:     the key can't be used before it.
+		end time:       the key can't be used after it.
+		play times:     the content can be played this many times.
+		time span:      the key can be used for this long since it's first used.
+		accu time span: the content can be played for this long in total.
+
+	The usage state that rules depend on is kept in a Store per KID.
+*/
+
+package enforce
+
+import (
+	"core/license"
+	"errors"
+	"sync"
+	"time"
+)
+
+var (
+	ErrNotAllowed     = errors.New("enforce: play is not allowed by rights")
+	ErrNoPolicy       = errors.New("enforce: no policy for kid")
+	ErrNotStarted     = errors.New("enforce: license is not valid yet")
+	ErrExpired        = errors.New("enforce: license is expired")
+	ErrPlayTimes      = errors.New("enforce: play times are used up")
+	ErrTimeSpan       = errors.New("enforce: time span since first use is over")
+	ErrAccuTimeSpan   = errors.New("enforce: accumulated play time is used up")
+	ErrClockRollback  = errors.New("enforce: clock is set back")
+	ErrNegativePlayed = errors.New("enforce: negative play time")
+)
+
+type Enforcer struct {
+	lock  sync.Mutex
+	lic   *license.CommonLicense
+	store Store
+}
+
+// New creates an Enforcer of lic, which should be a verified license.
+func New(lic *license.CommonLicense, store Store) *Enforcer {
+	return &Enforcer{
+		lic:   lic,
+		store: store,
+	}
+}
+
+func (e *Enforcer) check(kid string, now time.Time, u Usage) error {
+	allowed, err := e.lic.Allowed(license.ActionPlay)
+	if err != nil {
+		return err
+	}
+	if !allowed {
+		return ErrNotAllowed
+	}
+
+	plc := e.lic.Policys.Get(kid)
+	if plc == nil {
+		return ErrNoPolicy
+	}
+	rules, err := plc.Rules()
+	if err != nil {
+		return err
+	}
+
+	if now.Before(u.LastUse) {
+		return ErrClockRollback
+	}
+	if rules.StartTime != nil && now.Before(*rules.StartTime) {
+		return ErrNotStarted
+	}
+	if rules.EndTime != nil && now.After(*rules.EndTime) {
+		return ErrExpired
+	}
+	if rules.PlayTimes != nil && u.PlayTimes >= *rules.PlayTimes {
+		return ErrPlayTimes
+	}
+	if rules.TimeSpan != nil && !u.FirstUse.IsZero() && !now.Before(u.FirstUse.Add(*rules.TimeSpan)) {
+		return ErrTimeSpan
+	}
+	if rules.AccuTimeSpan != nil && u.AccuTime >= *rules.AccuTimeSpan {
+		return ErrAccuTimeSpan
+	}
+
+	return nil
+}
+
+// CanPlay returns nil if kid can be played at now, or the error of the rule
+// that forbids it.
+func (e *Enforcer) CanPlay(kid string, now time.Time) error {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	u, err := e.store.Get(kid)
+	if err != nil {
+		return err
+	}
+
+	return e.check(kid, now, u)
+}
+
+// StartPlay checks and records a play of kid at now. The first play starts the
+// time span of the key, and each play counts against play times.
+func (e *Enforcer) StartPlay(kid string, now time.Time) error {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	u, err := e.store.Get(kid)
+	if err != nil {
+		return err
+	}
+	if err := e.check(kid, now, u); err != nil {
+		return err
+	}
+
+	if u.FirstUse.IsZero() {
+		u.FirstUse = now
+	}
+	u.LastUse = now
+	u.PlayTimes++
+
+	return e.store.Put(kid, u)
+}
+
+// RecordPlayed adds played to the accumulated play time of kid. Players
+// should call it periodically during playback and when playback stops, then
+// stop playback if CanPlay fails.
+func (e *Enforcer) RecordPlayed(kid string, now time.Time, played time.Duration) error {
+	if played < 0 {
+		return ErrNegativePlayed
+	}
+
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	u, err := e.store.Get(kid)
+	if err != nil {
+		return err
+	}
+	if now.Before(u.LastUse) {
+		return ErrClockRollback
+	}
+
+	u.AccuTime += played
+	u.LastUse = now
+
+	return e.store.Put(kid, u)
+}
@@ -0,0 +1,151 @@
+/*
+	Opendrm, an open source implementation of industry-grade DRM
+	(Digital Rights Management) or Key System.
+	Copyright (C) 2018  wilkk
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package enforce
+
+import (
+	"core/license"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+var start = time.Unix(1500000000, 0)
+
+func newLicense(t *testing.T, pb *license.PolicyBuilder) *license.CommonLicense {
+	plc, err := pb.Build()
+	if err != nil {
+		t.Fatalf("Build policy failed. err=%s", err)
+	}
+	cl := license.NewCommonLicense([]string{"kid"}, nil, "cert")
+	cl.SetPolicy(plc)
+	return cl
+}
+
+func TestWindow(t *testing.T) {
+	cl := newLicense(t, license.NewPolicyBuilder("kid").
+		StartTime(start).
+		EndTime(start.Add(time.Hour)))
+	e := New(cl, NewMemoryStore())
+
+	if err := e.CanPlay("kid", start.Add(-time.Second)); err != ErrNotStarted {
+		t.Fatalf("before start: err=%v", err)
+	}
+	if err := e.CanPlay("kid", start); err != nil {
+		t.Fatalf("at start: err=%v", err)
+	}
+	if err := e.CanPlay("kid", start.Add(time.Hour+time.Second)); err != ErrExpired {
+		t.Fatalf("after end: err=%v", err)
+	}
+	if err := e.CanPlay("other", start); err != ErrNoPolicy {
+		t.Fatalf("unknown kid: err=%v", err)
+	}
+}
+
+func TestPlayTimesAndTimeSpan(t *testing.T) {
+	cl := newLicense(t, license.NewPolicyBuilder("kid").
+		PlayTimes(2).
+		TimeSpan(48*time.Hour))
+	e := New(cl, NewMemoryStore())
+
+	now := start
+	for i := 0; i < 2; i++ {
+		if err := e.StartPlay("kid", now); err != nil {
+			t.Fatalf("play %d: err=%v", i, err)
+		}
+		now = now.Add(time.Hour)
+	}
+	if err := e.StartPlay("kid", now); err != ErrPlayTimes {
+		t.Fatalf("third play: err=%v", err)
+	}
+
+	cl = newLicense(t, license.NewPolicyBuilder("kid").TimeSpan(48*time.Hour))
+	e = New(cl, NewMemoryStore())
+	if err := e.CanPlay("kid", start.Add(1000*time.Hour)); err != nil {
+		t.Fatalf("time span starts before first use: err=%v", err)
+	}
+	if err := e.StartPlay("kid", start); err != nil {
+		t.Fatalf("first play: err=%v", err)
+	}
+	if err := e.CanPlay("kid", start.Add(47*time.Hour)); err != nil {
+		t.Fatalf("within time span: err=%v", err)
+	}
+	if err := e.CanPlay("kid", start.Add(48*time.Hour)); err != ErrTimeSpan {
+		t.Fatalf("after time span: err=%v", err)
+	}
+	if err := e.CanPlay("kid", start.Add(-time.Hour)); err != ErrClockRollback {
+		t.Fatalf("clock rollback: err=%v", err)
+	}
+}
+
+func TestAccuTimeSpanPersisted(t *testing.T) {
+	dir, err := ioutil.TempDir("", "enforce")
+	if err != nil {
+		t.Fatalf("TempDir failed. err=%s", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "usage.json")
+
+	cl := newLicense(t, license.NewPolicyBuilder("kid").AccuTimeSpan(2*time.Hour))
+	store, err := OpenFileStore(path)
+	if err != nil {
+		t.Fatalf("OpenFileStore failed. err=%s", err)
+	}
+	e := New(cl, store)
+	if err := e.StartPlay("kid", start); err != nil {
+		t.Fatalf("StartPlay failed. err=%v", err)
+	}
+	if err := e.RecordPlayed("kid", start.Add(90*time.Minute), 90*time.Minute); err != nil {
+		t.Fatalf("RecordPlayed failed. err=%v", err)
+	}
+
+	// Usage state survives restart.
+	store, err = OpenFileStore(path)
+	if err != nil {
+		t.Fatalf("OpenFileStore failed. err=%s", err)
+	}
+	u, _ := store.Get("kid")
+	if u.PlayTimes != 1 || u.AccuTime != 90*time.Minute || !u.FirstUse.Equal(start) {
+		t.Fatalf("usage mismatch. got %+v", u)
+	}
+
+	e = New(cl, store)
+	now := start.Add(2 * time.Hour)
+	if err := e.CanPlay("kid", now); err != nil {
+		t.Fatalf("within accumulated time: err=%v", err)
+	}
+	if err := e.RecordPlayed("kid", now, 30*time.Minute); err != nil {
+		t.Fatalf("RecordPlayed failed. err=%v", err)
+	}
+	if err := e.CanPlay("kid", now); err != ErrAccuTimeSpan {
+		t.Fatalf("accumulated time used up: err=%v", err)
+	}
+}
+
+func TestRightsDenied(t *testing.T) {
+	cl := newLicense(t, license.NewPolicyBuilder("kid"))
+	cl.SetRights(license.NewRecordRight())
+	e := New(cl, NewMemoryStore())
+
+	if err := e.CanPlay("kid", start); err != ErrNotAllowed {
+		t.Fatalf("play without play right: err=%v", err)
+	}
+}
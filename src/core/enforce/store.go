@@ -0,0 +1,152 @@
+/*
+	Opendrm, an open source implementation of industry-grade DRM
+	(Digital Rights Management) or Key System.
+	Copyright (C) 2018  wilkk
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package enforce
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Usage is the usage state of a KID, which is kept across plays.
+type Usage struct {
+	FirstUse  time.Time     `json:"first_use"`  // zero if never used
+	LastUse   time.Time     `json:"last_use"`   // latest time seen, to detect clock rollback
+	PlayTimes uint32        `json:"play_times"` // times the content has been played
+	AccuTime  time.Duration `json:"accu_time"`  // accumulated play time
+}
+
+// Store keeps the usage state of each KID. Get returns zero Usage for a KID
+// that has never been used.
+type Store interface {
+	Get(kid string) (Usage, error)
+	Put(kid string, u Usage) error
+}
+
+// MemoryStore is a Store that lives as long as the process.
+type MemoryStore struct {
+	lock   sync.Mutex
+	usages map[string]Usage
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		usages: map[string]Usage{},
+	}
+}
+
+func (ms *MemoryStore) Get(kid string) (Usage, error) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+
+	return ms.usages[kid], nil
+}
+
+func (ms *MemoryStore) Put(kid string, u Usage) error {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+
+	ms.usages[kid] = u
+	return nil
+}
+
+// FileStore is a Store persisted as a JSON file. Every Put rewrites the file
+// atomically, so the state survives restart of the player.
+type FileStore struct {
+	lock   sync.Mutex
+	path   string
+	usages map[string]Usage
+}
+
+// OpenFileStore loads the usage state in path. A missing file is an empty store.
+func OpenFileStore(path string) (*FileStore, error) {
+	fs := &FileStore{
+		path:   path,
+		usages: map[string]Usage{},
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return fs, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &fs.usages); err != nil {
+		return nil, err
+	}
+
+	return fs, nil
+}
+
+func (fs *FileStore) Get(kid string) (Usage, error) {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+
+	return fs.usages[kid], nil
+}
+
+func (fs *FileStore) Put(kid string, u Usage) error {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+
+	old, existed := fs.usages[kid]
+	fs.usages[kid] = u
+	if err := fs.save(); err != nil {
+		if existed {
+			fs.usages[kid] = old
+		} else {
+			delete(fs.usages, kid)
+		}
+		return err
+	}
+
+	return nil
+}
+
+func (fs *FileStore) save() error {
+	data, err := json.Marshal(fs.usages)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(fs.path), filepath.Base(fs.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), fs.path)
+}
@@ -0,0 +1,115 @@
+//go:build bolt
+// +build bolt
+
+/*
+	Opendrm, an open source implementation of industry-grade DRM
+	(Digital Rights Management) or Key System.
+	Copyright (C) 2018  wilkk
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package key
+
+import (
+	"encoding/json"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var bucketKeys = []byte("content_keys")
+
+// BoltStore is a Store in a bbolt file, an embedded key value store. Entries
+// are kept as JSON by KID, which bbolt orders.
+type BoltStore struct {
+	db *bolt.DB
+}
+
+// OpenBoltStore opens or creates the store file at path. The file is locked
+// while it's open, by this process only.
+func OpenBoltStore(path string) (*BoltStore, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(bucketKeys)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &BoltStore{
+		db: db,
+	}, nil
+}
+
+func (bs *BoltStore) Put(e Entry) error {
+	e, err := prepare(e)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	return bs.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketKeys).Put([]byte(e.Kid), data)
+	})
+}
+
+func (bs *BoltStore) Get(kid string) (Entry, error) {
+	e := Entry{}
+	err := bs.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(bucketKeys).Get([]byte(kid))
+		if data == nil {
+			return ErrNotFound
+		}
+		return json.Unmarshal(data, &e)
+	})
+	return e, err
+}
+
+func (bs *BoltStore) List() ([]Entry, error) {
+	entries := []Entry{}
+	err := bs.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketKeys).ForEach(func(k, v []byte) error {
+			e := Entry{}
+			if err := json.Unmarshal(v, &e); err != nil {
+				return err
+			}
+			entries = append(entries, e)
+			return nil
+		})
+	})
+	return entries, err
+}
+
+func (bs *BoltStore) Delete(kid string) error {
+	return bs.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucketKeys)
+		if b.Get([]byte(kid)) == nil {
+			return ErrNotFound
+		}
+		return b.Delete([]byte(kid))
+	})
+}
+
+func (bs *BoltStore) Close() error {
+	return bs.db.Close()
+}
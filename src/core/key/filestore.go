@@ -0,0 +1,153 @@
+/*
+	Opendrm, an open source implementation of industry-grade DRM
+	(Digital Rights Management) or Key System.
+	Copyright (C) 2018  wilkk
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package key
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"os"
+	"sync"
+)
+
+// storeLine is a line of a FileStore, an entry or the deletion of its KID.
+type storeLine struct {
+	Entry
+	Deleted bool `json:"deleted,omitempty"`
+}
+
+// FileStore is a Store kept in memory and journaled to a file of JSON lines,
+// which is replayed when the store is opened. Each change is synced before
+// it's applied, so that a key handed out is never lost on restart.
+type FileStore struct {
+	*MemoryStore
+
+	lock sync.Mutex
+	file *os.File
+}
+
+func OpenFileStore(path string) (*FileStore, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	ms := NewMemoryStore()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		l := storeLine{}
+		if err := json.Unmarshal(scanner.Bytes(), &l); err != nil {
+			file.Close()
+			return nil, err
+		}
+		if l.Deleted {
+			delete(ms.entries, l.Kid)
+		} else {
+			ms.entries[l.Kid] = l.Entry
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return &FileStore{
+		MemoryStore: ms,
+		file:        file,
+	}, nil
+}
+
+func (fs *FileStore) append(l storeLine) error {
+	data, err := json.Marshal(l)
+	if err != nil {
+		return err
+	}
+	if _, err := fs.file.Write(append(data, '\n')); err != nil {
+		return err
+	}
+	return fs.file.Sync()
+}
+
+func (fs *FileStore) Put(e Entry) error {
+	e, err := prepare(e)
+	if err != nil {
+		return err
+	}
+
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+
+	if err := fs.append(storeLine{Entry: e}); err != nil {
+		return err
+	}
+	return fs.MemoryStore.Put(e)
+}
+
+func (fs *FileStore) Delete(kid string) error {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+
+	if _, err := fs.MemoryStore.Get(kid); err != nil {
+		return err
+	}
+	if err := fs.append(storeLine{Entry: Entry{Kid: kid}, Deleted: true}); err != nil {
+		return err
+	}
+	return fs.MemoryStore.Delete(kid)
+}
+
+// Compact rewrites the journal atomically with the current entries only, so
+// that replaced and deleted keys are no longer in the file.
+func (fs *FileStore) Compact() error {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+
+	entries, err := fs.MemoryStore.List()
+	if err != nil {
+		return err
+	}
+	buff := &bytes.Buffer{}
+	for _, e := range entries {
+		data, err := json.Marshal(storeLine{Entry: e})
+		if err != nil {
+			return err
+		}
+		buff.Write(append(data, '\n'))
+	}
+
+	path := fs.file.Name()
+	if err := writeSecretFile(path, buff.Bytes()); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	fs.file.Close()
+	fs.file = file
+	return nil
+}
+
+func (fs *FileStore) Close() error {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+
+	return fs.file.Close()
+}
@@ -20,20 +20,38 @@
 /*
 	This file can be used to generate encryption&decryption key. You can use the
 	GenKeyBySeed method to spawn&respawn the same key without storing the relationship
-	between KID and Key in db.
+	between KID and Key in db. Random keys and KIDs are drawn from crypto/rand,
+	unless another entropy source is given.
+
+	Keys are derived from a seed in one of two modes. SeedModePlayReady follows
+	the PlayReady key seed spec byte for byte, so that keys can be shared with
+	PlayReady packagers. SeedModeLegacy is the derivation of earlier releases,
+	which hashes the KID text and gets the third hash wrong; it stays the
+	default so that keys already issued can be derived again.
 */
 
 package key
 
 import (
+	"crypto/rand"
 	"crypto/sha256"
-	"log"
-	"math/rand"
-	"os/exec"
-	"strings"
+	"errors"
+	"io"
 	"time"
 )
 
+var errSeedLen = errors.New("key: key seed shorter than 30 bytes")
+
+type SeedMode uint8
+
+const (
+	SeedModeLegacy SeedMode = iota
+	SeedModePlayReady
+)
+
+// Length of key seed used by derivation, longer seeds are truncated.
+const seedLen = 30
+
 // At least 30 bytes
 var defaultKeySeed = []byte("b1cc1aa664122baca692107d4ba5d6d21ef9787ee82f8020ec93adcc25d44b8f")
 
@@ -41,28 +59,77 @@ type KeyGenerator struct {
 	// Key seed used for GenKeyBySeed.
 	// Set to nil if not used.
 	seed []byte
+	// Entropy source of random keys and KIDs.
+	rand io.Reader
+	// Derivation of DeriveKey.
+	mode SeedMode
 }
 
 func NewKeyGenerator(seed []byte) *KeyGenerator {
+	return NewKeyGeneratorWithRand(seed, rand.Reader)
+}
+
+// NewKeyGeneratorWithRand creates a KeyGenerator drawing random keys and KIDs
+// from rand, e.g. a hardware RNG. rand must be cryptographically secure.
+func NewKeyGeneratorWithRand(seed []byte, rand io.Reader) *KeyGenerator {
 	return &KeyGenerator{
 		seed: seed,
+		rand: rand,
 	}
 }
 
+// SetSeedMode sets the derivation of DeriveKey.
+func (this *KeyGenerator) SetSeedMode(mode SeedMode) {
+	this.mode = mode
+}
+
+// DeriveKey derives the content key of kid from the seed. In PlayReady mode kid
+// must be a GUID.
+func (this *KeyGenerator) DeriveKey(kid string) ([]byte, error) {
+	if len(this.seed) < seedLen {
+		return nil, errSeedLen
+	}
+	if this.mode != SeedModePlayReady {
+		return generateKeyAndKidBySeed(kid, this.seed), nil
+	}
+
+	guid, err := ParseGUID(kid)
+	if err != nil {
+		return nil, err
+	}
+	return generatePlayReadyKey(guid, this.seed), nil
+}
+
+// GenKeyBySeed derives the content key of kid in legacy mode.
 func (this *KeyGenerator) GenKeyBySeed(kid string) []byte {
 	return generateKeyAndKidBySeed(kid, this.seed)
 }
 
+// GenKeyByDefaultSeed derives the content key of kid in legacy mode.
 func (this *KeyGenerator) GenKeyByDefaultSeed(uuid string) []byte {
 	return generateKeyAndKidBySeed(uuid, defaultKeySeed)
 }
 
-func (this *KeyGenerator) GenRandKey() ([]byte, string) {
-	return generateRandKeyAndKid()
+// GenRandKey returns a random content key and a random (version 4) UUID as
+// its KID.
+func (this *KeyGenerator) GenRandKey() ([]byte, string, error) {
+	return generateRandKeyAndKid(this.rand)
+}
+
+// GenUUID returns a random (version 4) UUID.
+func (this *KeyGenerator) GenUUID() (string, error) {
+	return NewUUIDv4(this.rand)
+}
+
+// GenUUIDv7 returns a time-ordered (version 7) UUID.
+func (this *KeyGenerator) GenUUIDv7() (string, error) {
+	return NewUUIDv7(this.rand, time.Now())
 }
 
 // Based on https://docs.microsoft.com/en-us/playready/specifications/playready-key-seed
 // Ck(KID) = f(KID, KeySeed)
+// This is the legacy mode, it differs from the spec as KID is taken as text and
+// outputC is computed from shaB. Keep it as is, or issued keys are lost.
 func generateKeyAndKidBySeed(uuid string, seed []byte) []byte {
 	drm_aes_keysize_128 := 16
 	contentKey := make([]byte, drm_aes_keysize_128)
@@ -102,23 +169,55 @@ func generateKeyAndKidBySeed(uuid string, seed []byte) []byte {
 	return contentKey
 }
 
-func GenerateUUID() string {
-	kidBytes, err := exec.Command("uuidgen").Output()
-	if err != nil {
-		log.Fatal(err)
-		return ""
-	} else {
-		return strings.TrimSuffix(string(kidBytes), "\n")
+// generatePlayReadyKey derives the content key of guid, as in the PlayReady key
+// seed spec. guid is in the byte order of a GUID, see ParseGUID.
+func generatePlayReadyKey(guid, seed []byte) []byte {
+	const keySize = 16
+	truncKeySeed := seed[:seedLen]
+
+	shaA := sha256.New()
+	shaA.Write(truncKeySeed)
+	shaA.Write(guid)
+	outputA := shaA.Sum(nil)
+
+	shaB := sha256.New()
+	shaB.Write(truncKeySeed)
+	shaB.Write(guid)
+	shaB.Write(truncKeySeed)
+	outputB := shaB.Sum(nil)
+
+	shaC := sha256.New()
+	shaC.Write(truncKeySeed)
+	shaC.Write(guid)
+	shaC.Write(truncKeySeed)
+	shaC.Write(guid)
+	outputC := shaC.Sum(nil)
+
+	contentKey := make([]byte, keySize)
+	for i := 0; i < keySize; i++ {
+		contentKey[i] = outputA[i] ^ outputA[i+keySize] ^
+			outputB[i] ^ outputB[i+keySize] ^
+			outputC[i] ^ outputC[i+keySize]
 	}
+
+	return contentKey
 }
 
-// If error happens, kid is empty string.
-func generateRandKeyAndKid() ([]byte, string) {
-	rnd := rand.New(rand.NewSource(time.Now().Unix()))
+// GenerateUUID returns a random (version 4) UUID drawn from crypto/rand.
+func GenerateUUID() (string, error) {
+	return NewUUIDv4(rand.Reader)
+}
+
+func generateRandKeyAndKid(rand io.Reader) ([]byte, string, error) {
 	key := make([]byte, 16)
-	rnd.Read(key)
+	if _, err := io.ReadFull(rand, key); err != nil {
+		return nil, "", err
+	}
 
-	kid := GenerateUUID()
+	kid, err := NewUUIDv4(rand)
+	if err != nil {
+		return nil, "", err
+	}
 
-	return key, kid
+	return key, kid, nil
 }
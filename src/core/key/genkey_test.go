@@ -19,12 +19,88 @@
 
 package key
 
-import "testing"
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"regexp"
+	"testing"
+	"testing/iotest"
+	"time"
+)
+
+var uuidPattern = regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-([0-9a-f])[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
 
 func TestGenerateKeyAndKid(t *testing.T) {
 	keyGen := NewKeyGenerator(nil)
-	key, kid := keyGen.GenRandKey()
+	key, kid, err := keyGen.GenRandKey()
+	if err != nil {
+		t.Fatalf("GenRandKey failed. err=%s", err)
+	}
 	t.Logf("key:%x, kid:%s", key, kid)
+
+	// Keys generated in the same second must differ.
+	key2, kid2, err := keyGen.GenRandKey()
+	if err != nil {
+		t.Fatalf("GenRandKey failed. err=%s", err)
+	}
+	if len(key) != 16 || bytes.Equal(key, key2) || kid == kid2 {
+		t.Fatalf("random keys repeat. key:%x, key2:%x", key, key2)
+	}
+
+	// The entropy source is pluggable, and its errors are returned.
+	fixed := NewKeyGeneratorWithRand(nil, bytes.NewReader(bytes.Repeat([]byte{0xAB}, 32)))
+	key, kid, err = fixed.GenRandKey()
+	if err != nil || !bytes.Equal(key, bytes.Repeat([]byte{0xAB}, 16)) || kid != "abababab-abab-4bab-abab-abababababab" {
+		t.Fatalf("fixed entropy mismatch. key:%x, kid:%s, err=%v", key, kid, err)
+	}
+	failure := errors.New("no entropy")
+	broken := NewKeyGeneratorWithRand(nil, iotest.ErrReader(failure))
+	if _, _, err := broken.GenRandKey(); err != failure {
+		t.Fatalf("broken entropy: err=%v", err)
+	}
+	if _, err := broken.GenUUID(); err != failure {
+		t.Fatalf("broken entropy: err=%v", err)
+	}
+}
+
+func TestUUID(t *testing.T) {
+	v4, err := GenerateUUID()
+	if err != nil {
+		t.Fatalf("GenerateUUID failed. err=%s", err)
+	}
+	if m := uuidPattern.FindStringSubmatch(v4); m == nil || m[1] != "4" {
+		t.Fatalf("not a version 4 UUID: %s", v4)
+	}
+
+	// Version 7 starts with the Unix time in milliseconds.
+	now := time.Unix(1700000000, 123456789)
+	v7, err := NewUUIDv7(bytes.NewReader(make([]byte, 10)), now)
+	if err != nil {
+		t.Fatalf("NewUUIDv7 failed. err=%s", err)
+	}
+	if v7 != "018bcfe5-687b-7000-8000-000000000000" {
+		t.Fatalf("version 7 UUID mismatch. got %s", v7)
+	}
+
+	keyGen := NewKeyGenerator(nil)
+	prev := ""
+	for i := 0; i < 3; i++ {
+		v7, err := keyGen.GenUUIDv7()
+		if err != nil {
+			t.Fatalf("GenUUIDv7 failed. err=%s", err)
+		}
+		if m := uuidPattern.FindStringSubmatch(v7); m == nil || m[1] != "7" {
+			t.Fatalf("not a version 7 UUID: %s", v7)
+		}
+		// Ids of later milliseconds sort after.
+		if v7[:13] < prev {
+			t.Fatalf("version 7 UUIDs out of order: %s < %s", v7, prev)
+		}
+		prev = v7[:13]
+		time.Sleep(2 * time.Millisecond)
+	}
 }
 
 func TestGenerateKeyAndKidBySeed(t *testing.T) {
@@ -32,4 +108,51 @@ func TestGenerateKeyAndKidBySeed(t *testing.T) {
 	keyGen := NewKeyGenerator(defaultKeySeed)
 	ck := keyGen.GenKeyBySeed(kid)
 	t.Logf("key:%x", ck)
+
+	// Keys issued in legacy mode must never change.
+	legacy := "d5d1be726da7c6f5f1f2e461e2d041c2"
+	if hex.EncodeToString(ck) != legacy {
+		t.Fatalf("legacy key mismatch. got %x", ck)
+	}
+	ck, err := keyGen.DeriveKey(kid)
+	if err != nil || hex.EncodeToString(ck) != legacy {
+		t.Fatalf("DeriveKey in legacy mode mismatch. got %x, err=%v", ck, err)
+	}
+	if _, err := NewKeyGenerator([]byte("short")).DeriveKey(kid); err != errSeedLen {
+		t.Fatalf("short seed: err=%v", err)
+	}
+}
+
+func TestPlayReadyKeySeed(t *testing.T) {
+	// The key seed of the Microsoft PlayReady test server, and a content key
+	// published for it.
+	seed, _ := base64.StdEncoding.DecodeString("XVBovsmzhP9gRIZxWfFta3VVRPzVEWmJsazEJ46I")
+	vectors := []struct {
+		kid string
+		key string
+	}{
+		{"10000000-1000-1000-1000-100000000001", "3a2a1b68dd2bd9b2eeb25e84c4776668"},
+		{"{10000000-1000-1000-1000-100000000001}", "3a2a1b68dd2bd9b2eeb25e84c4776668"},
+	}
+
+	keyGen := NewKeyGenerator(seed)
+	keyGen.SetSeedMode(SeedModePlayReady)
+	for _, v := range vectors {
+		ck, err := keyGen.DeriveKey(v.kid)
+		if err != nil {
+			t.Fatalf("DeriveKey failed. err=%s", err)
+		}
+		if hex.EncodeToString(ck) != v.key {
+			t.Fatalf("key of %s mismatch. got %x, want %s", v.kid, ck, v.key)
+		}
+	}
+
+	if _, err := keyGen.DeriveKey("kid-1"); err != errInvalidUUID {
+		t.Fatalf("KID not a GUID: err=%v", err)
+	}
+
+	guid, err := ParseGUID("01020304-0506-0708-090a-0b0c0d0e0f10")
+	if err != nil || hex.EncodeToString(guid) != "0403020106050807090a0b0c0d0e0f10" {
+		t.Fatalf("GUID bytes mismatch. got %x, err=%v", guid, err)
+	}
 }
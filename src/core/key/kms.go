@@ -0,0 +1,489 @@
+/*
+	Opendrm, an open source implementation of industry-grade DRM
+	(Digital Rights Management) or Key System.
+	Copyright (C) 2018  wilkk
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+/*
+	Content keys and seeds are encrypted at rest under a key encryption key
+	(KEK) held by a KMS. Wrapped keys carry the id of their KEK, so that a KMS
+	keeps unwrapping them after it rotates to a new KEK, until they are wrapped
+	again by Rewrap and the old KEK is removed.
+
+	LocalKMS keeps its KEKs in a file, encrypted by a key derived from a
+	passphrase with PBKDF2.
+*/
+
+package key
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+var (
+	errWrapped      = errors.New("key: malformed wrapped key")
+	errUnknownKEK   = errors.New("key: unknown key encryption key")
+	errKEKCurrent   = errors.New("key: key encryption key is current")
+	errPassphrase   = errors.New("key: wrong passphrase or corrupted KMS file")
+	errKMSFilePerm  = errors.New("key: KMS file is readable by other users")
+	errKMSFileExist = errors.New("key: KMS file already exists")
+)
+
+type KMS interface {
+	// KeyId returns the id of the KEK that Wrap uses.
+	KeyId() string
+	// Wrap encrypts key, bound to aad, e.g. the KID of a content key.
+	Wrap(key, aad []byte) ([]byte, error)
+	// Unwrap decrypts a key wrapped with the same aad, by any KEK known.
+	Unwrap(wrapped, aad []byte) ([]byte, error)
+}
+
+const wrapVersion = 1
+
+// Wrapped keys are laid out as:
+//
+//	version(1) | KEK id length(1) | KEK id | nonce(12) | ciphertext and tag
+func sealKey(aead cipher.AEAD, kekId string, key, aad []byte) ([]byte, error) {
+	if len(kekId) > 255 {
+		return nil, fmt.Errorf("%w: KEK id too long", errWrapped)
+	}
+	out := append([]byte{wrapVersion, byte(len(kekId))}, kekId...)
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	out = append(out, nonce...)
+	// The header is authenticated along with aad.
+	return aead.Seal(out, nonce, key, append(append([]byte{}, out...), aad...)), nil
+}
+
+// WrappedKeyId returns the id of the KEK that wrapped is encrypted by.
+func WrappedKeyId(wrapped []byte) (string, error) {
+	if len(wrapped) < 2 || wrapped[0] != wrapVersion || len(wrapped) < 2+int(wrapped[1]) {
+		return "", errWrapped
+	}
+	return string(wrapped[2 : 2+int(wrapped[1])]), nil
+}
+
+// isWrapped reports whether key is laid out as a wrapped key, as opposed to
+// a content key stored in the clear. It doesn't tell whether key unwraps.
+func isWrapped(key []byte) bool {
+	id, err := WrappedKeyId(key)
+	// The nonce and tag of the AES-GCM KEKs follow the header.
+	return err == nil && len(key) >= 2+len(id)+12+16
+}
+
+func openKey(aead cipher.AEAD, wrapped, aad []byte) ([]byte, error) {
+	hdrLen := 2 + int(wrapped[1]) + aead.NonceSize()
+	if len(wrapped) < hdrLen+aead.Overhead() {
+		return nil, errWrapped
+	}
+	hdr := wrapped[:hdrLen]
+	nonce := hdr[hdrLen-aead.NonceSize():]
+	return aead.Open(nil, nonce, wrapped[hdrLen:], append(append([]byte{}, hdr...), aad...))
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Rewrap wraps a key again by the current KEK of kms.
+func Rewrap(kms KMS, wrapped, aad []byte) ([]byte, error) {
+	key, err := kms.Unwrap(wrapped, aad)
+	if err != nil {
+		return nil, err
+	}
+	return kms.Wrap(key, aad)
+}
+
+// kmsIterations is the PBKDF2 iteration count of new KMS files.
+var kmsIterations = 600000
+
+type kek struct {
+	Id      string    `json:"id"`
+	Created time.Time `json:"created"`
+	// KEK encrypted by the passphrase key
+	Key []byte `json:"key"`
+}
+
+// kmsFile is the content of a LocalKMS file.
+type kmsFile struct {
+	Salt       []byte `json:"salt"`
+	Iterations int    `json:"iterations"`
+	Current    string `json:"current"`
+	Keys       []kek  `json:"keys"`
+}
+
+// LocalKMS is a KMS whose KEKs are kept in a file protected by a passphrase.
+// It's safe for concurrent use.
+type LocalKMS struct {
+	lock   sync.RWMutex
+	path   string
+	file   kmsFile
+	master cipher.AEAD
+	keks   map[string]cipher.AEAD
+}
+
+// CreateLocalKMS creates the KMS file at path with a new KEK.
+func CreateLocalKMS(path, passphrase string) (*LocalKMS, error) {
+	if _, err := os.Stat(path); err == nil {
+		return nil, fmt.Errorf("%w: %s", errKMSFileExist, path)
+	}
+	salt := make([]byte, 16)
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		return nil, err
+	}
+
+	lk := &LocalKMS{
+		path: path,
+		file: kmsFile{
+			Salt:       salt,
+			Iterations: kmsIterations,
+			Keys:       []kek{},
+		},
+		keks: map[string]cipher.AEAD{},
+	}
+	if err := lk.deriveMaster(passphrase); err != nil {
+		return nil, err
+	}
+	if _, err := lk.Rotate(); err != nil {
+		return nil, err
+	}
+	return lk, nil
+}
+
+// OpenLocalKMS opens the KMS file at path, which only its owner can read.
+func OpenLocalKMS(path, passphrase string) (*LocalKMS, error) {
+	data, err := readSecretFile(path, errKMSFilePerm)
+	if err != nil {
+		return nil, err
+	}
+
+	lk := &LocalKMS{
+		path: path,
+		keks: map[string]cipher.AEAD{},
+	}
+	if err := json.Unmarshal(data, &lk.file); err != nil {
+		return nil, err
+	}
+	if err := lk.deriveMaster(passphrase); err != nil {
+		return nil, err
+	}
+	for _, k := range lk.file.Keys {
+		if err := lk.openKEK(k); err != nil {
+			return nil, err
+		}
+	}
+	if lk.keks[lk.file.Current] == nil {
+		return nil, fmt.Errorf("%w: current %s", errUnknownKEK, lk.file.Current)
+	}
+	return lk, nil
+}
+
+// pbkdf2Key derives a key of keyLen bytes from passphrase by PBKDF2 with
+// HMAC-SHA256 (RFC 8018). It's here rather than in crypto/pbkdf2, which needs
+// Go 1.24.
+func pbkdf2Key(passphrase, salt []byte, iter, keyLen int) []byte {
+	prf := hmac.New(sha256.New, passphrase)
+	dk := make([]byte, 0, keyLen+prf.Size())
+	var block [4]byte
+	for i := uint32(1); len(dk) < keyLen; i++ {
+		binary.BigEndian.PutUint32(block[:], i)
+		prf.Reset()
+		prf.Write(salt)
+		prf.Write(block[:])
+		u := prf.Sum(nil)
+		t := append([]byte{}, u...)
+		for n := 1; n < iter; n++ {
+			prf.Reset()
+			prf.Write(u)
+			u = prf.Sum(u[:0])
+			for j := range t {
+				t[j] ^= u[j]
+			}
+		}
+		dk = append(dk, t...)
+	}
+	return dk[:keyLen]
+}
+
+func (lk *LocalKMS) deriveMaster(passphrase string) error {
+	mk := pbkdf2Key([]byte(passphrase), lk.file.Salt, lk.file.Iterations, 32)
+	var err error
+	lk.master, err = newGCM(mk)
+	return err
+}
+
+func (lk *LocalKMS) openKEK(k kek) error {
+	ns := lk.master.NonceSize()
+	if len(k.Key) < ns+lk.master.Overhead() {
+		return errPassphrase
+	}
+	key, err := lk.master.Open(nil, k.Key[:ns], k.Key[ns:], []byte(k.Id))
+	if err != nil {
+		return errPassphrase
+	}
+	aead, err := newGCM(key)
+	if err != nil {
+		return err
+	}
+	lk.keks[k.Id] = aead
+	return nil
+}
+
+// save replaces the KMS file atomically.
+func (lk *LocalKMS) save() error {
+	data, err := json.MarshalIndent(lk.file, "", "\t")
+	if err != nil {
+		return err
+	}
+	return writeSecretFile(lk.path, data)
+}
+
+// Rotate adds a new KEK and makes it current. Keys wrapped by older KEKs are
+// still unwrapped, use Rewrap to move them to the new one.
+func (lk *LocalKMS) Rotate() (string, error) {
+	key := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return "", err
+	}
+	id, err := NewUUIDv7(rand.Reader, time.Now())
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, lk.master.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+	k := kek{
+		Id:      id,
+		Created: time.Now().UTC().Truncate(time.Second),
+		Key:     lk.master.Seal(nonce, nonce, key, []byte(id)),
+	}
+
+	lk.lock.Lock()
+	defer lk.lock.Unlock()
+
+	lk.file.Keys = append(lk.file.Keys, k)
+	lk.file.Current = id
+	if err := lk.save(); err != nil {
+		lk.file.Keys = lk.file.Keys[:len(lk.file.Keys)-1]
+		return "", err
+	}
+	aead, err := newGCM(key)
+	if err != nil {
+		return "", err
+	}
+	lk.keks[id] = aead
+	return id, nil
+}
+
+// Remove removes KEK id, once no key is wrapped by it.
+func (lk *LocalKMS) Remove(id string) error {
+	lk.lock.Lock()
+	defer lk.lock.Unlock()
+
+	if id == lk.file.Current {
+		return fmt.Errorf("%w: %s", errKEKCurrent, id)
+	}
+	keys := []kek{}
+	for _, k := range lk.file.Keys {
+		if k.Id != id {
+			keys = append(keys, k)
+		}
+	}
+	if len(keys) == len(lk.file.Keys) {
+		return fmt.Errorf("%w: %s", errUnknownKEK, id)
+	}
+
+	old := lk.file.Keys
+	lk.file.Keys = keys
+	if err := lk.save(); err != nil {
+		lk.file.Keys = old
+		return err
+	}
+	delete(lk.keks, id)
+	return nil
+}
+
+// KeyIds returns the ids of all KEKs, the current one last.
+func (lk *LocalKMS) KeyIds() []string {
+	lk.lock.RLock()
+	defer lk.lock.RUnlock()
+
+	ids := []string{}
+	for _, k := range lk.file.Keys {
+		if k.Id != lk.file.Current {
+			ids = append(ids, k.Id)
+		}
+	}
+	return append(ids, lk.file.Current)
+}
+
+func (lk *LocalKMS) KeyId() string {
+	lk.lock.RLock()
+	defer lk.lock.RUnlock()
+
+	return lk.file.Current
+}
+
+func (lk *LocalKMS) Wrap(key, aad []byte) ([]byte, error) {
+	lk.lock.RLock()
+	defer lk.lock.RUnlock()
+
+	return sealKey(lk.keks[lk.file.Current], lk.file.Current, key, aad)
+}
+
+func (lk *LocalKMS) Unwrap(wrapped, aad []byte) ([]byte, error) {
+	id, err := WrappedKeyId(wrapped)
+	if err != nil {
+		return nil, err
+	}
+
+	lk.lock.RLock()
+	aead := lk.keks[id]
+	lk.lock.RUnlock()
+	if aead == nil {
+		return nil, fmt.Errorf("%w: %s", errUnknownKEK, id)
+	}
+	return openKey(aead, wrapped, aad)
+}
+
+// EncryptedStore is a Store whose content keys are wrapped by a KMS before
+// they reach the underlying store. The KID of each key is bound to it, so
+// that wrapped keys can't be swapped between KIDs.
+type EncryptedStore struct {
+	store Store
+	kms   KMS
+}
+
+func NewEncryptedStore(s Store, kms KMS) *EncryptedStore {
+	return &EncryptedStore{
+		store: s,
+		kms:   kms,
+	}
+}
+
+func (es *EncryptedStore) Put(e Entry) error {
+	e, err := prepare(e)
+	if err != nil {
+		return err
+	}
+	if e.Key, err = es.kms.Wrap(e.Key, []byte(e.Kid)); err != nil {
+		return err
+	}
+	return es.store.Put(e)
+}
+
+func (es *EncryptedStore) unwrap(e Entry) (Entry, error) {
+	if !isWrapped(e.Key) {
+		return Entry{}, fmt.Errorf("%w: key of %s is in the clear, rewrap with migrate", errWrapped, e.Kid)
+	}
+	key, err := es.kms.Unwrap(e.Key, []byte(e.Kid))
+	if err != nil {
+		return Entry{}, fmt.Errorf("key: unwrap key of %s: %w", e.Kid, err)
+	}
+	e.Key = key
+	return e, nil
+}
+
+func (es *EncryptedStore) Get(kid string) (Entry, error) {
+	e, err := es.store.Get(kid)
+	if err != nil {
+		return Entry{}, err
+	}
+	return es.unwrap(e)
+}
+
+func (es *EncryptedStore) List() ([]Entry, error) {
+	entries, err := es.store.List()
+	if err != nil {
+		return nil, err
+	}
+	for i := range entries {
+		if entries[i], err = es.unwrap(entries[i]); err != nil {
+			return nil, err
+		}
+	}
+	return entries, nil
+}
+
+func (es *EncryptedStore) Delete(kid string) error {
+	return es.store.Delete(kid)
+}
+
+func (es *EncryptedStore) Close() error {
+	return es.store.Close()
+}
+
+// Rewrap wraps the keys not wrapped by the current KEK again, and returns how
+// many there were. With migrate, keys in the clear, as stored before the store
+// was encrypted, are wrapped as well; otherwise they are an error. A store that
+// is a Compacter is compacted then, so that it keeps no previous form of keys.
+func (es *EncryptedStore) Rewrap(migrate bool) (int, error) {
+	entries, err := es.store.List()
+	if err != nil {
+		return 0, err
+	}
+
+	n := 0
+	for _, e := range entries {
+		if migrate && !isWrapped(e.Key) {
+			e.Key, err = es.kms.Wrap(e.Key, []byte(e.Kid))
+		} else {
+			var id string
+			if id, err = WrappedKeyId(e.Key); err != nil {
+				return n, fmt.Errorf("key: rewrap key of %s: %w", e.Kid, err)
+			}
+			if id == es.kms.KeyId() {
+				continue
+			}
+			e.Key, err = Rewrap(es.kms, e.Key, []byte(e.Kid))
+		}
+		if err != nil {
+			return n, err
+		}
+		if err := es.store.Put(e); err != nil {
+			return n, err
+		}
+		n++
+	}
+
+	// Compacted even if no key is rewrapped now, as a previous Rewrap may
+	// have stopped before.
+	if c, ok := es.store.(Compacter); ok {
+		if err := c.Compact(); err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
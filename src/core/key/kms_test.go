@@ -0,0 +1,313 @@
+/*
+	Opendrm, an open source implementation of industry-grade DRM
+	(Digital Rights Management) or Key System.
+	Copyright (C) 2018  wilkk
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package key
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func init() {
+	// Keep the tests fast, the count is stored in the file.
+	kmsIterations = 1000
+}
+
+func TestPbkdf2Key(t *testing.T) {
+	// Test vectors of RFC 7914, section 11.
+	cases := []struct {
+		passphrase, salt string
+		iter             int
+		want             string
+	}{
+		{"passwd", "salt", 1, "55ac046e56e3089fec1691c22544b605f94185216dde0465e68b9d57c20dacbc49ca9cccf179b645991664b39d77ef317c71b845b1e30bd509112041d3a19783"},
+		{"Password", "NaCl", 80000, "4ddcd8f60b98be21830cee5ef22701f9641a4418d04c0414aeff08876b34ab56a1d425a1225833549adb841b51c9b3176a272bdebba1d078478f62b397f33c8d"},
+	}
+	for _, c := range cases {
+		dk := pbkdf2Key([]byte(c.passphrase), []byte(c.salt), c.iter, 64)
+		if got := hex.EncodeToString(dk); got != c.want {
+			t.Fatalf("pbkdf2Key(%s, %s, %d) mismatch. got %s", c.passphrase, c.salt, c.iter, got)
+		}
+	}
+}
+
+func TestLocalKMS(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "kms.json")
+	lk, err := CreateLocalKMS(path, "secret")
+	if err != nil {
+		t.Fatalf("CreateLocalKMS failed. err=%s", err)
+	}
+	if _, err := CreateLocalKMS(path, "secret"); !errors.Is(err, errKMSFileExist) {
+		t.Fatalf("CreateLocalKMS over a file: err=%v", err)
+	}
+
+	key := bytes.Repeat([]byte{7}, 16)
+	wrapped, err := lk.Wrap(key, []byte("kid-1"))
+	if err != nil {
+		t.Fatalf("Wrap failed. err=%s", err)
+	}
+	if bytes.Contains(wrapped, key) {
+		t.Fatalf("wrapped key contains the key.")
+	}
+	if id, err := WrappedKeyId(wrapped); err != nil || id != lk.KeyId() {
+		t.Fatalf("WrappedKeyId mismatch. got %s, err=%v", id, err)
+	}
+	if _, err := lk.Unwrap(wrapped, []byte("kid-2")); err == nil {
+		t.Fatalf("Unwrap with another aad succeeded.")
+	}
+	if _, err := lk.Unwrap(wrapped[:10], []byte("kid-1")); err == nil {
+		t.Fatalf("Unwrap of truncated key succeeded.")
+	}
+
+	if _, err := OpenLocalKMS(path, "wrong"); !errors.Is(err, errPassphrase) {
+		t.Fatalf("OpenLocalKMS with wrong passphrase: err=%v", err)
+	}
+	os.Chmod(path, 0644)
+	if _, err := OpenLocalKMS(path, "secret"); !errors.Is(err, errKMSFilePerm) {
+		t.Fatalf("OpenLocalKMS of readable file: err=%v", err)
+	}
+	os.Chmod(path, 0600)
+
+	// A truncated KEK is refused, as a corrupted file.
+	f := kmsFile{}
+	data, _ := os.ReadFile(path)
+	json.Unmarshal(data, &f)
+	f.Keys[0].Key = f.Keys[0].Key[:4]
+	data, _ = json.Marshal(f)
+	corrupted := filepath.Join(filepath.Dir(path), "corrupted.json")
+	os.WriteFile(corrupted, data, 0600)
+	if _, err := OpenLocalKMS(corrupted, "secret"); !errors.Is(err, errPassphrase) {
+		t.Fatalf("OpenLocalKMS of truncated KEK: err=%v", err)
+	}
+
+	// Keys wrapped by an old KEK still unwrap after a rotation.
+	old := lk.KeyId()
+	if _, err := lk.Rotate(); err != nil {
+		t.Fatalf("Rotate failed. err=%s", err)
+	}
+	lk, err = OpenLocalKMS(path, "secret")
+	if err != nil {
+		t.Fatalf("OpenLocalKMS failed. err=%s", err)
+	}
+	if ids := lk.KeyIds(); len(ids) != 2 || ids[0] != old || ids[1] == old {
+		t.Fatalf("KeyIds mismatch. got %v", ids)
+	}
+	if got, err := lk.Unwrap(wrapped, []byte("kid-1")); err != nil || !bytes.Equal(got, key) {
+		t.Fatalf("Unwrap mismatch. got %x, err=%v", got, err)
+	}
+
+	rewrapped, err := Rewrap(lk, wrapped, []byte("kid-1"))
+	if err != nil {
+		t.Fatalf("Rewrap failed. err=%s", err)
+	}
+	if err := lk.Remove(lk.KeyId()); !errors.Is(err, errKEKCurrent) {
+		t.Fatalf("Remove of current KEK: err=%v", err)
+	}
+	if err := lk.Remove(old); err != nil {
+		t.Fatalf("Remove failed. err=%s", err)
+	}
+	if _, err := lk.Unwrap(wrapped, []byte("kid-1")); !errors.Is(err, errUnknownKEK) {
+		t.Fatalf("Unwrap by removed KEK: err=%v", err)
+	}
+	if got, err := lk.Unwrap(rewrapped, []byte("kid-1")); err != nil || !bytes.Equal(got, key) {
+		t.Fatalf("Unwrap of rewrapped key mismatch. got %x, err=%v", got, err)
+	}
+}
+
+func TestEncryptedStore(t *testing.T) {
+	lk, err := CreateLocalKMS(filepath.Join(t.TempDir(), "kms.json"), "secret")
+	if err != nil {
+		t.Fatalf("CreateLocalKMS failed. err=%s", err)
+	}
+	testStore(t, NewEncryptedStore(NewMemoryStore(), lk))
+
+	raw := NewMemoryStore()
+	es := NewEncryptedStore(raw, lk)
+	key := bytes.Repeat([]byte{3}, 16)
+	if err := es.Put(Entry{Kid: "kid-1", Key: key}); err != nil {
+		t.Fatalf("Put failed. err=%s", err)
+	}
+	e, _ := raw.Get("kid-1")
+	if bytes.Contains(e.Key, key) {
+		t.Fatalf("underlying store holds the key.")
+	}
+
+	// A wrapped key moved to another KID doesn't unwrap.
+	raw.Put(Entry{Kid: "kid-2", Key: e.Key})
+	if _, err := es.Get("kid-2"); err == nil {
+		t.Fatalf("Get of swapped key succeeded.")
+	}
+	raw.Delete("kid-2")
+
+	old := lk.KeyId()
+	lk.Rotate()
+	if n, err := es.Rewrap(false); err != nil || n != 1 {
+		t.Fatalf("Rewrap mismatch. got %d, err=%v", n, err)
+	}
+	if n, err := es.Rewrap(false); err != nil || n != 0 {
+		t.Fatalf("Rewrap again mismatch. got %d, err=%v", n, err)
+	}
+	if err := lk.Remove(old); err != nil {
+		t.Fatalf("Remove failed. err=%s", err)
+	}
+	if e, err := es.Get("kid-1"); err != nil || !bytes.Equal(e.Key, key) {
+		t.Fatalf("Get mismatch. got %x, err=%v", e.Key, err)
+	}
+
+	// Keys stored in the clear before the store was encrypted are only
+	// wrapped by a migration.
+	plain := bytes.Repeat([]byte{4}, 16)
+	raw.Put(Entry{Kid: "kid-3", Key: plain})
+	if _, err := es.Get("kid-3"); !errors.Is(err, errWrapped) {
+		t.Fatalf("Get of key in the clear: err=%v", err)
+	}
+	if _, err := es.Rewrap(false); !errors.Is(err, errWrapped) {
+		t.Fatalf("Rewrap of key in the clear: err=%v", err)
+	}
+	if n, err := es.Rewrap(true); err != nil || n != 1 {
+		t.Fatalf("Rewrap with migrate mismatch. got %d, err=%v", n, err)
+	}
+	if e, err := es.Get("kid-3"); err != nil || !bytes.Equal(e.Key, plain) {
+		t.Fatalf("Get of migrated key mismatch. got %x, err=%v", e.Key, err)
+	}
+	if e, _ := raw.Get("kid-3"); bytes.Contains(e.Key, plain) {
+		t.Fatalf("underlying store holds the migrated key.")
+	}
+}
+
+func TestRewrapFileStore(t *testing.T) {
+	dir := t.TempDir()
+	lk, err := CreateLocalKMS(filepath.Join(dir, "kms.json"), "secret")
+	if err != nil {
+		t.Fatalf("CreateLocalKMS failed. err=%s", err)
+	}
+	path := filepath.Join(dir, "keys.jsonl")
+	fs, err := OpenFileStore(path)
+	if err != nil {
+		t.Fatalf("OpenFileStore failed. err=%s", err)
+	}
+
+	// A key stored in the clear, and one wrapped by a KEK then rotated.
+	plain := bytes.Repeat([]byte{4}, 16)
+	fs.Put(Entry{Kid: "kid-1", Key: plain})
+	es := NewEncryptedStore(fs, lk)
+	if err := es.Put(Entry{Kid: "kid-2", Key: bytes.Repeat([]byte{5}, 16)}); err != nil {
+		t.Fatalf("Put failed. err=%s", err)
+	}
+	e, _ := fs.Get("kid-2")
+	oldWrapped := e.Key
+	lk.Rotate()
+
+	if n, err := es.Rewrap(true); err != nil || n != 2 {
+		t.Fatalf("Rewrap mismatch. got %d, err=%v", n, err)
+	}
+	// Writes after the compaction go to the new journal.
+	if err := es.Put(Entry{Kid: "kid-3", Key: bytes.Repeat([]byte{6}, 16)}); err != nil {
+		t.Fatalf("Put after Rewrap failed. err=%s", err)
+	}
+	fs.Close()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("ReadFile failed. err=%s", err)
+	}
+	for _, old := range [][]byte{plain, oldWrapped} {
+		b64, _ := json.Marshal(old)
+		if bytes.Contains(data, b64) {
+			t.Fatalf("journal still holds %s.", b64)
+		}
+	}
+	if n := bytes.Count(data, []byte("\n")); n != 3 {
+		t.Fatalf("journal has %d lines, want 3.", n)
+	}
+
+	fs, err = OpenFileStore(path)
+	if err != nil {
+		t.Fatalf("OpenFileStore failed. err=%s", err)
+	}
+	defer fs.Close()
+	es = NewEncryptedStore(fs, lk)
+	for _, kid := range []string{"kid-1", "kid-2", "kid-3"} {
+		if _, err := es.Get(kid); err != nil {
+			t.Fatalf("Get of %s after reopen failed. err=%s", kid, err)
+		}
+	}
+	if fi, err := os.Stat(path); err != nil || fi.Mode().Perm() != 0600 {
+		t.Fatalf("journal mode mismatch. err=%v", err)
+	}
+}
+
+func TestWrapSeeds(t *testing.T) {
+	dir := t.TempDir()
+	lk, err := CreateLocalKMS(filepath.Join(dir, "kms.json"), "secret")
+	if err != nil {
+		t.Fatalf("CreateLocalKMS failed. err=%s", err)
+	}
+	ss := DefaultSeeds()
+	s, _ := NewSeed(rand.Reader, SeedModePlayReady)
+	ss.Rotate(s)
+
+	if err := ss.Wrap(lk); err != nil {
+		t.Fatalf("Wrap failed. err=%s", err)
+	}
+	path := filepath.Join(dir, "seeds.json")
+	if err := WriteSeeds(path, ss); err != nil {
+		t.Fatalf("WriteSeeds failed. err=%s", err)
+	}
+	data, _ := os.ReadFile(path)
+	if bytes.Contains(data, []byte(`"value"`)) {
+		t.Fatalf("seed file holds seed values.")
+	}
+
+	ss, err = ReadSeeds(path)
+	if err != nil {
+		t.Fatalf("ReadSeeds failed. err=%s", err)
+	}
+	if _, err := NewSeedRegistry(ss); !errors.Is(err, errSeedWrapped) {
+		t.Fatalf("NewSeedRegistry of wrapped seeds: err=%v", err)
+	}
+	if _, err := ss.Generator(); !errors.Is(err, errSeedWrapped) {
+		t.Fatalf("Generator of wrapped seeds: err=%v", err)
+	}
+	if err := ss.Unwrap(lk); err != nil {
+		t.Fatalf("Unwrap failed. err=%s", err)
+	}
+	if !bytes.Equal(ss.Seeds[0].Value, defaultKeySeed) || !bytes.Equal(ss.Seeds[1].Value, s.Value) {
+		t.Fatalf("unwrapped seeds mismatch.")
+	}
+	if _, err := NewSeedRegistry(ss); err != nil {
+		t.Fatalf("NewSeedRegistry failed. err=%s", err)
+	}
+
+	kg, err := ss.Generator()
+	if err != nil {
+		t.Fatalf("Generator failed. err=%s", err)
+	}
+	kid := "10000000-1000-1000-1000-100000000001"
+	want, _ := s.generator().DeriveKey(kid)
+	if got, err := kg.DeriveKey(kid); err != nil || !bytes.Equal(got, want) {
+		t.Fatalf("derived key mismatch. got %x, err=%v", got, err)
+	}
+}
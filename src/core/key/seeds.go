@@ -0,0 +1,470 @@
+/*
+	Opendrm, an open source implementation of industry-grade DRM
+	(Digital Rights Management) or Key System.
+	Copyright (C) 2018  wilkk
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+/*
+	Key seeds are versioned: a seed file holds several seeds by id, one of
+	which is current. When content is packaged, its KID is assigned to the
+	current seed (see Assign), and the seed id is recorded in an index, so that
+	KIDs of older seeds keep resolving after a rotation. Licenses are only
+	issued for KIDs that were assigned.
+
+	If a seed leaks, rotate to a new one and retire the leaked one: it derives
+	no new KIDs, while its KIDs still resolve until their content is packaged
+	again under new KIDs (see KidsOf). Then remove it from the seed file.
+
+	The seed file holds secrets, it's refused if other users can read it. Seed
+	values can further be wrapped by a KMS (see SeedSet.Wrap), then the file is
+	of no use without the KEK.
+*/
+
+package key
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+var (
+	errNoSeed         = errors.New("key: no current seed")
+	errUnknownSeed    = errors.New("key: unknown seed")
+	errDuplicatedSeed = errors.New("key: seed id already exists")
+	errSeedRetired    = errors.New("key: seed is retired")
+	errSeedFilePerm   = errors.New("key: seed file is readable by other users")
+	errSeedMode       = errors.New("key: unknown seed mode")
+	errSeedWrapped    = errors.New("key: seed is wrapped")
+	errUnassignedKid  = errors.New("key: kid is not assigned to a seed")
+	errKidAssigned    = errors.New("key: kid is already assigned to a seed")
+)
+
+func (m SeedMode) MarshalText() ([]byte, error) {
+	switch m {
+	case SeedModeLegacy:
+		return []byte("legacy"), nil
+	case SeedModePlayReady:
+		return []byte("playready"), nil
+	}
+	return nil, errSeedMode
+}
+
+func (m *SeedMode) UnmarshalText(text []byte) error {
+	switch string(text) {
+	case "legacy":
+		*m = SeedModeLegacy
+	case "playready":
+		*m = SeedModePlayReady
+	default:
+		return fmt.Errorf("%w: %q", errSeedMode, text)
+	}
+	return nil
+}
+
+type Seed struct {
+	Id      string    `json:"id"`
+	Value   []byte    `json:"value,omitempty"`
+	Wrapped []byte    `json:"wrapped,omitempty"` // Value wrapped by a KMS, instead of Value
+	Mode    SeedMode  `json:"mode"`
+	Created time.Time `json:"created"`
+	// A retired seed derives no new KIDs.
+	Retired bool `json:"retired,omitempty"`
+}
+
+// NewSeed creates a seed of 30 bytes read from rand, identified by a version
+// 7 UUID.
+func NewSeed(rand io.Reader, mode SeedMode) (Seed, error) {
+	value := make([]byte, seedLen)
+	if _, err := io.ReadFull(rand, value); err != nil {
+		return Seed{}, err
+	}
+	now := time.Now()
+	id, err := NewUUIDv7(rand, now)
+	if err != nil {
+		return Seed{}, err
+	}
+
+	return Seed{
+		Id:      id,
+		Value:   value,
+		Mode:    mode,
+		Created: now.UTC().Truncate(time.Second),
+	}, nil
+}
+
+// generator returns a KeyGenerator deriving keys from s.
+func (s *Seed) generator() *KeyGenerator {
+	kg := NewKeyGenerator(s.Value)
+	kg.SetSeedMode(s.Mode)
+	return kg
+}
+
+// SeedSet is the content of a seed file.
+type SeedSet struct {
+	Current string `json:"current"`
+	Seeds   []Seed `json:"seeds"`
+}
+
+// DefaultSeeds is the seed set of releases before seeds were versioned, the
+// built-in seed in legacy mode.
+func DefaultSeeds() SeedSet {
+	return SeedSet{
+		Current: "default",
+		Seeds: []Seed{{
+			Id:    "default",
+			Value: defaultKeySeed,
+			Mode:  SeedModeLegacy,
+		}},
+	}
+}
+
+func (ss *SeedSet) get(id string) *Seed {
+	for i := range ss.Seeds {
+		if ss.Seeds[i].Id == id {
+			return &ss.Seeds[i]
+		}
+	}
+	return nil
+}
+
+// Rotate adds s and makes it the current seed.
+func (ss *SeedSet) Rotate(s Seed) error {
+	if ss.get(s.Id) != nil {
+		return fmt.Errorf("%w: %s", errDuplicatedSeed, s.Id)
+	}
+	ss.Seeds = append(ss.Seeds, s)
+	ss.Current = s.Id
+	return nil
+}
+
+// Retire retires seed id. The current seed can't be retired, rotate first.
+func (ss *SeedSet) Retire(id string) error {
+	s := ss.get(id)
+	if s == nil {
+		return fmt.Errorf("%w: %s", errUnknownSeed, id)
+	}
+	if id == ss.Current {
+		return fmt.Errorf("%w: %s is current", errSeedRetired, id)
+	}
+	s.Retired = true
+	return nil
+}
+
+// Wrap wraps the seed values by kms, each bound to its seed id. Seeds already
+// wrapped are left as they are.
+func (ss *SeedSet) Wrap(kms KMS) error {
+	for i := range ss.Seeds {
+		s := &ss.Seeds[i]
+		if s.Value == nil {
+			continue
+		}
+		wrapped, err := kms.Wrap(s.Value, []byte(s.Id))
+		if err != nil {
+			return err
+		}
+		s.Wrapped, s.Value = wrapped, nil
+	}
+	return nil
+}
+
+// Unwrap unwraps the seed values wrapped by kms. To wrap the seeds again by
+// the current KEK, Unwrap then Wrap.
+func (ss *SeedSet) Unwrap(kms KMS) error {
+	for i := range ss.Seeds {
+		s := &ss.Seeds[i]
+		if s.Wrapped == nil {
+			continue
+		}
+		value, err := kms.Unwrap(s.Wrapped, []byte(s.Id))
+		if err != nil {
+			return fmt.Errorf("key: unwrap seed %s: %w", s.Id, err)
+		}
+		s.Value, s.Wrapped = value, nil
+	}
+	return nil
+}
+
+// Generator returns a KeyGenerator deriving keys from the current seed, e.g.
+// the device keys of a device seed file. The seeds must be unwrapped.
+func (ss *SeedSet) Generator() (*KeyGenerator, error) {
+	s := ss.get(ss.Current)
+	if s == nil {
+		return nil, errNoSeed
+	}
+	if s.Wrapped != nil {
+		return nil, fmt.Errorf("%w: %s", errSeedWrapped, s.Id)
+	}
+	return s.generator(), nil
+}
+
+func (ss *SeedSet) validate() error {
+	ids := map[string]bool{}
+	for _, s := range ss.Seeds {
+		if ids[s.Id] {
+			return fmt.Errorf("%w: %s", errDuplicatedSeed, s.Id)
+		}
+		ids[s.Id] = true
+		if len(s.Value) < seedLen && s.Wrapped == nil {
+			return fmt.Errorf("%w: seed %s", errSeedLen, s.Id)
+		}
+	}
+
+	current := ss.get(ss.Current)
+	if current == nil {
+		return errNoSeed
+	}
+	if current.Retired {
+		return fmt.Errorf("%w: %s is current", errSeedRetired, current.Id)
+	}
+	return nil
+}
+
+// ReadSeeds reads a seed file, which is a JSON SeedSet only its owner can read.
+func ReadSeeds(path string) (SeedSet, error) {
+	ss := SeedSet{}
+	data, err := readSecretFile(path, errSeedFilePerm)
+	if err != nil {
+		return ss, err
+	}
+	if err := json.Unmarshal(data, &ss); err != nil {
+		return ss, err
+	}
+	return ss, ss.validate()
+}
+
+// WriteSeeds replaces the seed file atomically.
+func WriteSeeds(path string, ss SeedSet) error {
+	if err := ss.validate(); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(ss, "", "\t")
+	if err != nil {
+		return err
+	}
+	return writeSecretFile(path, data)
+}
+
+// kidSeed is a line of the KID index.
+type kidSeed struct {
+	Kid  string `json:"kid"`
+	Seed string `json:"seed"`
+}
+
+// SeedRegistry derives content keys from versioned seeds. It's safe for
+// concurrent use.
+type SeedRegistry struct {
+	lock    sync.Mutex
+	seeds   map[string]Seed
+	current string
+	// seed id of each KID
+	kids  map[string]string
+	index *os.File
+}
+
+// NewSeedRegistry creates a registry of ss, which records KIDs in memory only
+// until OpenIndex is called.
+func NewSeedRegistry(ss SeedSet) (*SeedRegistry, error) {
+	sr := &SeedRegistry{
+		kids: map[string]string{},
+	}
+	if err := sr.Reload(ss); err != nil {
+		return nil, err
+	}
+	return sr, nil
+}
+
+// Reload replaces the seeds of sr with ss, e.g. after a rotation. KIDs of
+// seeds removed from ss no longer resolve. Seeds of ss must be unwrapped.
+func (sr *SeedRegistry) Reload(ss SeedSet) error {
+	if err := ss.validate(); err != nil {
+		return err
+	}
+	seeds := map[string]Seed{}
+	for _, s := range ss.Seeds {
+		if s.Wrapped != nil {
+			return fmt.Errorf("%w: %s", errSeedWrapped, s.Id)
+		}
+		seeds[s.Id] = s
+	}
+
+	sr.lock.Lock()
+	defer sr.lock.Unlock()
+
+	sr.seeds = seeds
+	sr.current = ss.Current
+	return nil
+}
+
+// OpenIndex replays the KID index at path, which is a file of JSON lines, and
+// appends KIDs recorded later to it.
+func (sr *SeedRegistry) OpenIndex(path string) error {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+
+	kids := map[string]string{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		ks := kidSeed{}
+		if err := json.Unmarshal(scanner.Bytes(), &ks); err != nil {
+			file.Close()
+			return err
+		}
+		kids[ks.Kid] = ks.Seed
+	}
+	if err := scanner.Err(); err != nil {
+		file.Close()
+		return err
+	}
+
+	sr.lock.Lock()
+	defer sr.lock.Unlock()
+
+	for kid, seed := range sr.kids {
+		kids[kid] = seed
+	}
+	sr.kids = kids
+	sr.index = file
+	return nil
+}
+
+func (sr *SeedRegistry) Close() error {
+	sr.lock.Lock()
+	defer sr.lock.Unlock()
+
+	if sr.index == nil {
+		return nil
+	}
+	return sr.index.Close()
+}
+
+// Current returns the id of the seed new KIDs derive from.
+func (sr *SeedRegistry) Current() string {
+	sr.lock.Lock()
+	defer sr.lock.Unlock()
+
+	return sr.current
+}
+
+// SeedOf returns the id of the seed kid is recorded with.
+func (sr *SeedRegistry) SeedOf(kid string) (string, bool) {
+	sr.lock.Lock()
+	defer sr.lock.Unlock()
+
+	id, ok := sr.kids[kid]
+	return id, ok
+}
+
+// KidsOf returns the KIDs derived from seed id, e.g. the content to package
+// again before a retired seed is removed.
+func (sr *SeedRegistry) KidsOf(id string) []string {
+	sr.lock.Lock()
+	defer sr.lock.Unlock()
+
+	kids := []string{}
+	for kid, seed := range sr.kids {
+		if seed == id {
+			kids = append(kids, kid)
+		}
+	}
+	return kids
+}
+
+// Assign records kid with the current seed when its content is packaged, and
+// returns its content key. A KID is assigned once: its key is handed out at
+// packaging only, later it's given by ContentKey with a license.
+func (sr *SeedRegistry) Assign(kid string) ([]byte, error) {
+	sr.lock.Lock()
+	defer sr.lock.Unlock()
+
+	if id, ok := sr.kids[kid]; ok {
+		return nil, fmt.Errorf("%w: %s to %s", errKidAssigned, kid, id)
+	}
+	key, err := sr.derive(kid, sr.current)
+	if err != nil {
+		return nil, err
+	}
+	if err := sr.record(kid, sr.current); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// Import records kid, packaged before KIDs were indexed, with seed id its key
+// was derived from, mostly the built-in one. Importing a KID again with the
+// same seed does nothing.
+func (sr *SeedRegistry) Import(kid, id string) error {
+	sr.lock.Lock()
+	defer sr.lock.Unlock()
+
+	if _, ok := sr.seeds[id]; !ok {
+		return fmt.Errorf("%w: %s", errUnknownSeed, id)
+	}
+	if recorded, ok := sr.kids[kid]; ok {
+		if recorded == id {
+			return nil
+		}
+		return fmt.Errorf("%w: %s to %s", errKidAssigned, kid, recorded)
+	}
+	return sr.record(kid, id)
+}
+
+// ContentKey derives the content key of kid from the seed it's recorded with.
+// A KID that was not assigned is refused, rather than bound to whatever seed
+// is current when its license is requested.
+func (sr *SeedRegistry) ContentKey(kid string) ([]byte, error) {
+	sr.lock.Lock()
+	defer sr.lock.Unlock()
+
+	id, ok := sr.kids[kid]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", errUnassignedKid, kid)
+	}
+	return sr.derive(kid, id)
+}
+
+// derive derives the key of kid from seed id, the caller holds the lock.
+func (sr *SeedRegistry) derive(kid, id string) ([]byte, error) {
+	seed, ok := sr.seeds[id]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s of kid %s", errUnknownSeed, id, kid)
+	}
+	return seed.generator().DeriveKey(kid)
+}
+
+func (sr *SeedRegistry) record(kid, id string) error {
+	if sr.index != nil {
+		data, err := json.Marshal(kidSeed{Kid: kid, Seed: id})
+		if err != nil {
+			return err
+		}
+		if _, err := sr.index.Write(append(data, '\n')); err != nil {
+			return err
+		}
+		if err := sr.index.Sync(); err != nil {
+			return err
+		}
+	}
+	sr.kids[kid] = id
+	return nil
+}
@@ -0,0 +1,158 @@
+/*
+	Opendrm, an open source implementation of industry-grade DRM
+	(Digital Rights Management) or Key System.
+	Copyright (C) 2018  wilkk
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package key
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSeedRegistry(t *testing.T) {
+	dir, err := ioutil.TempDir("", "seeds")
+	if err != nil {
+		t.Fatalf("TempDir failed. err=%s", err)
+	}
+	defer os.RemoveAll(dir)
+	seedsFile := filepath.Join(dir, "seeds.json")
+	indexFile := filepath.Join(dir, "kids.jsonl")
+
+	// Without a seed file, keys are derived as before seeds were versioned.
+	ss := DefaultSeeds()
+	sr, err := NewSeedRegistry(ss)
+	if err != nil {
+		t.Fatalf("NewSeedRegistry failed. err=%s", err)
+	}
+	if err := sr.OpenIndex(indexFile); err != nil {
+		t.Fatalf("OpenIndex failed. err=%s", err)
+	}
+	oldKid := "kid-1"
+	if _, err := sr.ContentKey(oldKid); !errors.Is(err, errUnassignedKid) {
+		t.Fatalf("kid not assigned: err=%v", err)
+	}
+	oldKey, err := sr.Assign(oldKid)
+	if err != nil || !bytes.Equal(oldKey, NewKeyGenerator(nil).GenKeyByDefaultSeed(oldKid)) {
+		t.Fatalf("key of default seed mismatch. got %x, err=%v", oldKey, err)
+	}
+
+	// Rotate to a new seed, kept in a file only the owner can read.
+	s, err := NewSeed(rand.Reader, SeedModePlayReady)
+	if err != nil {
+		t.Fatalf("NewSeed failed. err=%s", err)
+	}
+	if err := ss.Rotate(s); err != nil {
+		t.Fatalf("Rotate failed. err=%s", err)
+	}
+	if err := ss.Retire(s.Id); !errors.Is(err, errSeedRetired) {
+		t.Fatalf("retire current seed: err=%v", err)
+	}
+	if err := ss.Retire("default"); err != nil {
+		t.Fatalf("Retire failed. err=%s", err)
+	}
+	if err := WriteSeeds(seedsFile, ss); err != nil {
+		t.Fatalf("WriteSeeds failed. err=%s", err)
+	}
+	if ss, err = ReadSeeds(seedsFile); err != nil {
+		t.Fatalf("ReadSeeds failed. err=%s", err)
+	}
+	if err := sr.Reload(ss); err != nil {
+		t.Fatalf("Reload failed. err=%s", err)
+	}
+
+	// A KID keeps the seed it was packaged with after rotation.
+	if k, err := sr.ContentKey(oldKid); err != nil || !bytes.Equal(k, oldKey) {
+		t.Fatalf("kid of previous seed mismatch. err=%v", err)
+	}
+	// Its key is not given again without a license.
+	if k, err := sr.Assign(oldKid); !errors.Is(err, errKidAssigned) || k != nil {
+		t.Fatalf("kid assigned twice: err=%v", err)
+	}
+	newKid := "6f651ae1-dbe4-4434-bcb4-690d1564c41c"
+	newKey, err := sr.Assign(newKid)
+	if err != nil {
+		t.Fatalf("Assign failed. err=%s", err)
+	}
+	if k, err := sr.ContentKey(newKid); err != nil || !bytes.Equal(k, newKey) {
+		t.Fatalf("ContentKey mismatch. err=%v", err)
+	}
+	kg := NewKeyGenerator(s.Value)
+	kg.SetSeedMode(SeedModePlayReady)
+	if want, _ := kg.DeriveKey(newKid); !bytes.Equal(newKey, want) {
+		t.Fatalf("key of current seed mismatch. got %x", newKey)
+	}
+	sr.Close()
+
+	// KIDs keep their seed after restart, the retired one included.
+	sr, err = NewSeedRegistry(ss)
+	if err != nil {
+		t.Fatalf("NewSeedRegistry failed. err=%s", err)
+	}
+	if err := sr.OpenIndex(indexFile); err != nil {
+		t.Fatalf("OpenIndex failed. err=%s", err)
+	}
+	defer sr.Close()
+	if id, ok := sr.SeedOf(newKid); !ok || id != s.Id {
+		t.Fatalf("seed of new kid mismatch. got %s", id)
+	}
+	if k, err := sr.ContentKey(oldKid); err != nil || !bytes.Equal(k, oldKey) {
+		t.Fatalf("kid of retired seed does not resolve. err=%v", err)
+	}
+	if kids := sr.KidsOf("default"); len(kids) != 1 || kids[0] != oldKid {
+		t.Fatalf("kids of retired seed mismatch. got %v", kids)
+	}
+
+	// KIDs packaged before the index are imported with their seed.
+	legacyKid := "kid-2"
+	if err := sr.Import(legacyKid, "default"); err != nil {
+		t.Fatalf("Import failed. err=%s", err)
+	}
+	if err := sr.Import(legacyKid, "default"); err != nil {
+		t.Fatalf("Import again failed. err=%s", err)
+	}
+	if k, err := sr.ContentKey(legacyKid); err != nil || !bytes.Equal(k, NewKeyGenerator(nil).GenKeyByDefaultSeed(legacyKid)) {
+		t.Fatalf("key of imported kid mismatch. err=%v", err)
+	}
+	if err := sr.Import(newKid, "default"); !errors.Is(err, errKidAssigned) {
+		t.Fatalf("kid imported to another seed: err=%v", err)
+	}
+	if err := sr.Import("kid-3", "unknown"); !errors.Is(err, errUnknownSeed) {
+		t.Fatalf("kid imported to unknown seed: err=%v", err)
+	}
+
+	// Once its content is packaged again, the retired seed is removed.
+	ss.Seeds = ss.Seeds[1:]
+	if err := sr.Reload(ss); err != nil {
+		t.Fatalf("Reload failed. err=%s", err)
+	}
+	if _, err := sr.ContentKey(oldKid); !errors.Is(err, errUnknownSeed) {
+		t.Fatalf("kid of removed seed: err=%v", err)
+	}
+
+	if err := os.Chmod(seedsFile, 0644); err != nil {
+		t.Fatalf("Chmod failed. err=%s", err)
+	}
+	if _, err := ReadSeeds(seedsFile); !errors.Is(err, errSeedFilePerm) {
+		t.Fatalf("seed file readable by others: err=%v", err)
+	}
+}
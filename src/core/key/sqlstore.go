@@ -0,0 +1,154 @@
+/*
+	Opendrm, an open source implementation of industry-grade DRM
+	(Digital Rights Management) or Key System.
+	Copyright (C) 2018  wilkk
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package key
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"regexp"
+	"time"
+)
+
+var errTableName = errors.New("key: invalid table name")
+
+var tableName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// SQLStore is a Store in a table of a SQL database, e.g. SQLite. Statements use
+// '?' placeholders, as SQLite and MySQL do. The driver is registered by the
+// program, so that this package doesn't depend on any.
+type SQLStore struct {
+	db    *sql.DB
+	table string
+}
+
+// NewSQLStore creates table in db if it doesn't exist. Metadata is stored as
+// JSON, and Created as Unix time in nanoseconds.
+func NewSQLStore(db *sql.DB, table string) (*SQLStore, error) {
+	if !tableName.MatchString(table) {
+		return nil, errTableName
+	}
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS ` + table + ` (
+		kid VARCHAR(255) PRIMARY KEY,
+		content_key BLOB NOT NULL,
+		created BIGINT NOT NULL,
+		meta TEXT NOT NULL
+	)`)
+	if err != nil {
+		return nil, err
+	}
+
+	return &SQLStore{
+		db:    db,
+		table: table,
+	}, nil
+}
+
+// Put replaces the row of e.Kid in a transaction, as upsert is not portable.
+func (ss *SQLStore) Put(e Entry) error {
+	e, err := prepare(e)
+	if err != nil {
+		return err
+	}
+	meta, err := json.Marshal(e.Meta)
+	if err != nil {
+		return err
+	}
+
+	tx, err := ss.db.Begin()
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`DELETE FROM `+ss.table+` WHERE kid = ?`, e.Kid); err != nil {
+		tx.Rollback()
+		return err
+	}
+	_, err = tx.Exec(`INSERT INTO `+ss.table+` (kid, content_key, created, meta) VALUES (?, ?, ?, ?)`,
+		e.Kid, e.Key, e.Created.UnixNano(), string(meta))
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanEntry(row scanner) (Entry, error) {
+	e := Entry{}
+	var created int64
+	var meta string
+	if err := row.Scan(&e.Kid, &e.Key, &created, &meta); err != nil {
+		return Entry{}, err
+	}
+	e.Created = time.Unix(0, created).UTC()
+	if err := json.Unmarshal([]byte(meta), &e.Meta); err != nil {
+		return Entry{}, err
+	}
+	return e, nil
+}
+
+func (ss *SQLStore) Get(kid string) (Entry, error) {
+	row := ss.db.QueryRow(`SELECT kid, content_key, created, meta FROM `+ss.table+` WHERE kid = ?`, kid)
+	e, err := scanEntry(row)
+	if err == sql.ErrNoRows {
+		return Entry{}, ErrNotFound
+	}
+	return e, err
+}
+
+func (ss *SQLStore) List() ([]Entry, error) {
+	rows, err := ss.db.Query(`SELECT kid, content_key, created, meta FROM ` + ss.table + ` ORDER BY kid`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := []Entry{}
+	for rows.Next() {
+		e, err := scanEntry(rows)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+func (ss *SQLStore) Delete(kid string) error {
+	res, err := ss.db.Exec(`DELETE FROM `+ss.table+` WHERE kid = ?`, kid)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (ss *SQLStore) Close() error {
+	return ss.db.Close()
+}
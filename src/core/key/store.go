@@ -0,0 +1,171 @@
+/*
+	Opendrm, an open source implementation of industry-grade DRM
+	(Digital Rights Management) or Key System.
+	Copyright (C) 2018  wilkk
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+/*
+	A Store keeps content keys that can't be derived again, such as random keys
+	generated at packaging time, so that they are served at license time. Keys
+	are stored with metadata, e.g. the content they protect.
+
+	Backends are MemoryStore, FileStore, a journal of JSON lines, SQLStore
+	over database/sql, and BoltStore, an embedded key value file, in builds
+	with tag bolt.
+*/
+
+package key
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"time"
+)
+
+var (
+	ErrNotFound   = errors.New("key: kid not found")
+	errEmptyEntry = errors.New("key: entry has no kid or key")
+)
+
+// Entry is a content key and its metadata.
+type Entry struct {
+	Kid     string            `json:"kid"`
+	Key     []byte            `json:"key"`
+	Created time.Time         `json:"created"`
+	Meta    map[string]string `json:"meta,omitempty"`
+}
+
+type Store interface {
+	// Put stores e, replacing the entry of the same KID. Created is set to
+	// the current time if it's zero.
+	Put(e Entry) error
+	// Get returns the entry of kid, or ErrNotFound.
+	Get(kid string) (Entry, error)
+	// List returns all entries, ordered by KID.
+	List() ([]Entry, error)
+	// Delete removes the entry of kid, or returns ErrNotFound.
+	Delete(kid string) error
+	Close() error
+}
+
+// Compacter is a Store that keeps replaced and deleted keys until it's
+// compacted, as the journal of FileStore does.
+type Compacter interface {
+	Compact() error
+}
+
+// prepare checks e before it's stored and sets Created.
+func prepare(e Entry) (Entry, error) {
+	if e.Kid == "" || len(e.Key) == 0 {
+		return e, errEmptyEntry
+	}
+	if e.Created.IsZero() {
+		e.Created = time.Now().UTC()
+	}
+	return e, nil
+}
+
+// StoreKeys gives the content keys of a Store, as license.KeySource does.
+type StoreKeys struct {
+	Store
+}
+
+func (sk StoreKeys) ContentKey(kid string) ([]byte, error) {
+	e, err := sk.Get(kid)
+	if err != nil {
+		return nil, err
+	}
+	return e.Key, nil
+}
+
+// MemoryStore is a Store that lives as long as the process.
+type MemoryStore struct {
+	lock    sync.Mutex
+	entries map[string]Entry
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		entries: map[string]Entry{},
+	}
+}
+
+// clone copies e, so that the caller can't change a stored entry.
+func clone(e Entry) Entry {
+	e.Key = append([]byte{}, e.Key...)
+	if e.Meta != nil {
+		meta := map[string]string{}
+		for k, v := range e.Meta {
+			meta[k] = v
+		}
+		e.Meta = meta
+	}
+	return e
+}
+
+func (ms *MemoryStore) Put(e Entry) error {
+	e, err := prepare(e)
+	if err != nil {
+		return err
+	}
+
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+
+	ms.entries[e.Kid] = clone(e)
+	return nil
+}
+
+func (ms *MemoryStore) Get(kid string) (Entry, error) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+
+	e, ok := ms.entries[kid]
+	if !ok {
+		return Entry{}, ErrNotFound
+	}
+	return clone(e), nil
+}
+
+func (ms *MemoryStore) List() ([]Entry, error) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+
+	entries := []Entry{}
+	for _, e := range ms.entries {
+		entries = append(entries, clone(e))
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Kid < entries[j].Kid
+	})
+	return entries, nil
+}
+
+func (ms *MemoryStore) Delete(kid string) error {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+
+	if _, ok := ms.entries[kid]; !ok {
+		return ErrNotFound
+	}
+	delete(ms.entries, kid)
+	return nil
+}
+
+func (ms *MemoryStore) Close() error {
+	return nil
+}
@@ -0,0 +1,56 @@
+//go:build bolt
+// +build bolt
+
+/*
+	Opendrm, an open source implementation of industry-grade DRM
+	(Digital Rights Management) or Key System.
+	Copyright (C) 2018  wilkk
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package key
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestBoltStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "boltstore")
+	if err != nil {
+		t.Fatalf("TempDir failed. err=%s", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "keys.db")
+
+	s, err := OpenBoltStore(path)
+	if err != nil {
+		t.Fatalf("OpenBoltStore failed. err=%s", err)
+	}
+	testStore(t, s)
+	s.Close()
+
+	// Entries survive restart.
+	s, err = OpenBoltStore(path)
+	if err != nil {
+		t.Fatalf("OpenBoltStore failed. err=%s", err)
+	}
+	defer s.Close()
+	if _, err := s.Get("kid-2"); err != nil {
+		t.Fatalf("Get after reopen failed. err=%s", err)
+	}
+}
@@ -0,0 +1,70 @@
+//go:build sqlite
+// +build sqlite
+
+/*
+	Opendrm, an open source implementation of industry-grade DRM
+	(Digital Rights Management) or Key System.
+	Copyright (C) 2018  wilkk
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package key
+
+import (
+	"database/sql"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func TestSQLStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sqlstore")
+	if err != nil {
+		t.Fatalf("TempDir failed. err=%s", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "keys.db")
+
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatalf("Open failed. err=%s", err)
+	}
+	if _, err := NewSQLStore(db, "keys; DROP TABLE x"); err != errTableName {
+		t.Fatalf("invalid table name: err=%v", err)
+	}
+	s, err := NewSQLStore(db, "content_keys")
+	if err != nil {
+		t.Fatalf("NewSQLStore failed. err=%s", err)
+	}
+	testStore(t, s)
+	s.Close()
+
+	// Entries survive restart, and the table is not created twice.
+	db, err = sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatalf("Open failed. err=%s", err)
+	}
+	s, err = NewSQLStore(db, "content_keys")
+	if err != nil {
+		t.Fatalf("NewSQLStore failed. err=%s", err)
+	}
+	defer s.Close()
+	if _, err := s.Get("kid-2"); err != nil {
+		t.Fatalf("Get after reopen failed. err=%s", err)
+	}
+}
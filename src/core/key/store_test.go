@@ -0,0 +1,133 @@
+/*
+	Opendrm, an open source implementation of industry-grade DRM
+	(Digital Rights Management) or Key System.
+	Copyright (C) 2018  wilkk
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package key
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testStore checks the behaviour every Store backend shares.
+func testStore(t *testing.T, s Store) {
+	if _, err := s.Get("kid-1"); err != ErrNotFound {
+		t.Fatalf("Get of empty store: err=%v", err)
+	}
+	if err := s.Put(Entry{Kid: "kid-1"}); err != errEmptyEntry {
+		t.Fatalf("Put without key: err=%v", err)
+	}
+
+	created := time.Unix(1500000000, 0).UTC()
+	entries := []Entry{
+		{Kid: "kid-2", Key: bytes.Repeat([]byte{2}, 16), Meta: map[string]string{"content_id": "1002"}},
+		{Kid: "kid-1", Key: bytes.Repeat([]byte{1}, 16), Created: created},
+	}
+	for _, e := range entries {
+		if err := s.Put(e); err != nil {
+			t.Fatalf("Put failed. err=%s", err)
+		}
+	}
+
+	e, err := s.Get("kid-2")
+	if err != nil {
+		t.Fatalf("Get failed. err=%s", err)
+	}
+	if !bytes.Equal(e.Key, entries[0].Key) || e.Meta["content_id"] != "1002" || e.Created.IsZero() {
+		t.Fatalf("entry mismatch. got %+v", e)
+	}
+	if key, err := (StoreKeys{s}).ContentKey("kid-1"); err != nil || !bytes.Equal(key, entries[1].Key) {
+		t.Fatalf("ContentKey mismatch. got %x, err=%v", key, err)
+	}
+
+	// Put replaces the entry of the same KID.
+	entries[1].Meta = map[string]string{"packager": "p-1"}
+	if err := s.Put(entries[1]); err != nil {
+		t.Fatalf("Put failed. err=%s", err)
+	}
+	list, err := s.List()
+	if err != nil {
+		t.Fatalf("List failed. err=%s", err)
+	}
+	if len(list) != 2 || list[0].Kid != "kid-1" || list[1].Kid != "kid-2" {
+		t.Fatalf("list mismatch. got %+v", list)
+	}
+	if !list[0].Created.Equal(created) || list[0].Meta["packager"] != "p-1" {
+		t.Fatalf("replaced entry mismatch. got %+v", list[0])
+	}
+
+	if err := s.Delete("kid-1"); err != nil {
+		t.Fatalf("Delete failed. err=%s", err)
+	}
+	if err := s.Delete("kid-1"); err != ErrNotFound {
+		t.Fatalf("Delete twice: err=%v", err)
+	}
+	if _, err := s.Get("kid-1"); err != ErrNotFound {
+		t.Fatalf("Get of deleted kid: err=%v", err)
+	}
+}
+
+func TestMemoryStore(t *testing.T) {
+	s := NewMemoryStore()
+	testStore(t, s)
+
+	// Stored entries can't be changed through the caller's copy.
+	e := Entry{Kid: "kid", Key: []byte{1, 2, 3}}
+	s.Put(e)
+	e.Key[0] = 9
+	if got, _ := s.Get("kid"); got.Key[0] != 1 {
+		t.Fatalf("stored key changed.")
+	}
+}
+
+func TestFileStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "filestore")
+	if err != nil {
+		t.Fatalf("TempDir failed. err=%s", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "keys.jsonl")
+
+	s, err := OpenFileStore(path)
+	if err != nil {
+		t.Fatalf("OpenFileStore failed. err=%s", err)
+	}
+	testStore(t, s)
+	s.Close()
+
+	// Entries survive restart, deleted ones stay deleted.
+	s, err = OpenFileStore(path)
+	if err != nil {
+		t.Fatalf("OpenFileStore failed. err=%s", err)
+	}
+	defer s.Close()
+	e, err := s.Get("kid-2")
+	if err != nil {
+		t.Fatalf("Get after reopen failed. err=%s", err)
+	}
+	if !bytes.Equal(e.Key, bytes.Repeat([]byte{2}, 16)) || e.Meta["content_id"] != "1002" {
+		t.Fatalf("entry mismatch after reopen. got %+v", e)
+	}
+	if _, err := s.Get("kid-1"); err != ErrNotFound {
+		t.Fatalf("Get of deleted kid after reopen: err=%v", err)
+	}
+}
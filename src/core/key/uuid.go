@@ -0,0 +1,112 @@
+/*
+	Opendrm, an open source implementation of industry-grade DRM
+	(Digital Rights Management) or Key System.
+	Copyright (C) 2018  wilkk
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+/*
+	Native generation of UUIDs as defined in RFC 9562 (formerly RFC 4122):
+	version 4 is random, version 7 starts with the Unix time in milliseconds so
+	that ids sort by creation time.
+
+	PlayReady takes KIDs as Microsoft GUIDs, whose first three fields are little
+	endian, see ParseGUID.
+*/
+
+package key
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io"
+	"strings"
+	"time"
+)
+
+var errInvalidUUID = errors.New("key: invalid UUID")
+
+// newUUID returns the canonical form of a UUID whose bits but version and
+// variant are b.
+func newUUID(b []byte, version byte) string {
+	b[6] = b[6]&0x0f | version<<4
+	// Variant 10xx, as defined by RFC 9562.
+	b[8] = b[8]&0x3f | 0x80
+
+	buf := make([]byte, 36)
+	hex.Encode(buf[0:8], b[0:4])
+	buf[8] = '-'
+	hex.Encode(buf[9:13], b[4:6])
+	buf[13] = '-'
+	hex.Encode(buf[14:18], b[6:8])
+	buf[18] = '-'
+	hex.Encode(buf[19:23], b[8:10])
+	buf[23] = '-'
+	hex.Encode(buf[24:], b[10:])
+	return string(buf)
+}
+
+// NewUUIDv4 returns a version 4 UUID, 122 bits of which are read from rand.
+func NewUUIDv4(rand io.Reader) (string, error) {
+	b := make([]byte, 16)
+	if _, err := io.ReadFull(rand, b); err != nil {
+		return "", err
+	}
+	return newUUID(b, 4), nil
+}
+
+// NewUUIDv7 returns a version 7 UUID of time t, the remaining 74 bits are read
+// from rand.
+func NewUUIDv7(rand io.Reader, t time.Time) (string, error) {
+	b := make([]byte, 16)
+	if _, err := io.ReadFull(rand, b[6:]); err != nil {
+		return "", err
+	}
+
+	var ms [8]byte
+	binary.BigEndian.PutUint64(ms[:], uint64(t.UnixNano()/int64(time.Millisecond)))
+	copy(b[0:6], ms[2:])
+	return newUUID(b, 7), nil
+}
+
+// ParseUUID parses the canonical form of a UUID, with or without braces, into
+// its 16 bytes in network byte order.
+func ParseUUID(s string) ([]byte, error) {
+	s = strings.TrimSuffix(strings.TrimPrefix(s, "{"), "}")
+	if len(s) != 36 || s[8] != '-' || s[13] != '-' || s[18] != '-' || s[23] != '-' {
+		return nil, errInvalidUUID
+	}
+
+	b, err := hex.DecodeString(s[0:8] + s[9:13] + s[14:18] + s[19:23] + s[24:])
+	if err != nil {
+		return nil, errInvalidUUID
+	}
+	return b, nil
+}
+
+// ParseGUID parses a UUID into the bytes of a GUID, as Guid.ToByteArray of
+// .NET returns: Data1, Data2 and Data3 are little endian.
+func ParseGUID(s string) ([]byte, error) {
+	b, err := ParseUUID(s)
+	if err != nil {
+		return nil, err
+	}
+
+	b[0], b[1], b[2], b[3] = b[3], b[2], b[1], b[0]
+	b[4], b[5] = b[5], b[4]
+	b[6], b[7] = b[7], b[6]
+	return b, nil
+}
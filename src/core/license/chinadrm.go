@@ -55,15 +55,14 @@ type Content struct {
 func (c *Content) Bytes() []byte {
 	buff := &bytes.Buffer{}
 
-	binary.Write(buff, binary.BigEndian, c.Type)
-	binary.Write(buff, binary.BigEndian, c.Index)
-	binary.Write(buff, binary.BigEndian, c.Length)
+	c.UnitHeader.write(buff)
 	binary.Write(buff, binary.BigEndian, c.ContentId)
 	binary.Write(buff, binary.BigEndian, c.Keys.Bytes())
 
 	return buff.Bytes()
 }
 
+// NewContent creates the Content unit of content cid, whose keys are kids.
 func NewContent(cid uint64, kids []string) *Content {
 	keys := ContentKeys{}
 	for _, kid := range kids {
@@ -74,53 +73,88 @@ func NewContent(cid uint64, kids []string) *Content {
 	}
 	return &Content{
 		UnitHeader: UnitHeader{
-			Type:  0x01,
-			Index: 0x01,
+			Type:   unitTypeContent,
+			Index:  0x01,
+			Length: uint32(8 + len(keys.Bytes())),
 		},
 		ContentId: cid,
 		Keys:      keys,
 	}
 }
 
+type Contents []Content
+
+func (cs Contents) Bytes() []byte {
+	buff := &bytes.Buffer{}
+
+	for _, c := range cs {
+		binary.Write(buff, binary.BigEndian, c.Bytes())
+	}
+
+	return buff.Bytes()
+}
+
+// A ChinaDRM license is a common license with one Content unit for each
+// content it authorizes, several of them for a bundle. The Content units come
+// right after the license header, and the license is signed in the same
+// layout as it's serialized.
 type ChinaDrmLicense struct {
 	CommonLicense
-	Content Content
+	Contents Contents
 }
 
 func NewChinaDrmLicense(cid uint64, kids []string, objIds []string, certId string) ChinaDrmLicense {
 	return ChinaDrmLicense{
 		CommonLicense: *NewCommonLicense(kids, objIds, certId),
-		Content:       *NewContent(cid, kids),
+		Contents:      Contents{*NewContent(cid, kids)},
 	}
 }
 
-func (cdl *ChinaDrmLicense) Serialize(withCnt, withSig bool) []byte {
-	comnBytes := cdl.CommonLicense.Serialize(false, false)
+// AddContent adds the Content unit of another content of a bundle. The keys of
+// the content should also be added to the license.
+func (cdl *ChinaDrmLicense) AddContent(cid uint64, kids []string) {
+	c := NewContent(cid, kids)
+	c.Index = uint8(len(cdl.Contents) + 1)
+	cdl.Contents = append(cdl.Contents, *c)
+}
 
-	buff := &bytes.Buffer{}
-	binary.Write(buff, binary.BigEndian, comnBytes)
-	binary.Write(buff, binary.BigEndian, cdl.Content.Bytes())
+func (cdl *ChinaDrmLicense) unitsNum(withCnt bool) int {
+	return cdl.CommonLicense.unitsNum(withCnt) + len(cdl.Contents)
+}
 
-	if withSig {
-		binary.Write(buff, binary.BigEndian, cdl.Signature.Bytes())
-	}
+func (cdl *ChinaDrmLicense) Serialize(withCnt, withSig bool) []byte {
+	cdl.Header.UnitsNum = uint8(cdl.unitsNum(withCnt))
+	return cdl.serialize(cdl.bodyUnits(withCnt), withSig)
+}
 
-	return buff.Bytes()
+// bodyUnits puts the Content units before the basic units of a common license.
+func (cdl *ChinaDrmLicense) bodyUnits(withCnt bool) [][]byte {
+	units := [][]byte{}
+	for i := range cdl.Contents {
+		units = append(units, cdl.Contents[i].Bytes())
+	}
+	units = append(units, cdl.basicUnits(withCnt)...)
+	return cdl.withExtensions(units)
 }
 
-func (cdl *ChinaDrmLicense) Sign(withCnt bool) error {
-	bytes := cdl.Serialize(withCnt, false)
-	sig, err := Sign(bytes)
+func (cdl *ChinaDrmLicense) Sign(signer Signer, withCnt bool) error {
+	bytes, err := cdl.Marshal(withCnt, false)
 	if err != nil {
 		return err
 	}
+	if err := cdl.Signature.sign(signer, cdl.sigAlgId, bytes); err != nil {
+		return err
+	}
 
-	cdl.Signature.SignatureData = sig
-	cdl.Signature.SignatureLen = uint16(len(sig))
-
+	cdl.omitCnt = !withCnt
 	return nil
 }
 
-func (cdl *ChinaDrmLicense) Base64String() string {
-	return base64.StdEncoding.EncodeToString(cdl.Serialize(false, true))
+// Base64String is CommonLicense.Base64String of the ChinaDRM license.
+func (cdl *ChinaDrmLicense) Base64String() (string, error) {
+	data, err := cdl.Marshal(!cdl.omitCnt, true)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(data), nil
 }
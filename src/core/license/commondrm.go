@@ -27,9 +27,16 @@ import (
 	"core/key"
 	"encoding/base64"
 	"encoding/binary"
+	"errors"
+	"math"
 	"time"
 )
 
+var (
+	errTooManyUnits = errors.New("license: too many basic units")
+	errCertIdLen    = errors.New("license: certificate id longer than 255 bytes")
+)
+
 /*
 	CommonLicense contains the basic information that a license functions upon.
 	A common license struct is as below:
@@ -65,6 +72,7 @@ import (
 	|-----------------------------------------------------------------|
 	| type(8 bits) | index(8 bits) |    len          |  data 		  |
 	+-----------------------------------------------------------------+
+	Length is 32 bits since license version 2, see version.go.
 
 	The following is the whole values of Unit Type:
 	+-----------------------------------------------------------+
@@ -100,6 +108,9 @@ const (
 	algorithmSignature_RSA_SHA1_1024 = 0x40
 	algorithmSignature_RSA_SHA1_2048 = 0x41
 	algorithmSignature_SM2_256       = 0x42
+	// Not in GY/T 277, RSA 2048 with SHA-256 in place of SHA-1. It's only
+	// used for clients that negotiate it, see Capabilities.
+	algorithmSignature_RSA_SHA256_2048 = 0x43
 
 	keyRuleTypeStartTime    = 0x01 // uint32, the seconds since 1970-01-01 00:00:00
 	keyRuleTypeEndTime      = 0x02 // uint32, the seconds since 1970-01-01 00:00:00
@@ -108,25 +119,72 @@ const (
 	keyRuleTypeAccuTimeSpan = 0x05 // uint32, all seconds that license is allowed to be used
 )
 
+// Unit Type values, see the table above.
+const (
+	unitTypeHeader      = 0x00
+	unitTypeContent     = 0x01
+	unitTypeAuthObject  = 0x02
+	unitTypeKey         = 0x03
+	unitTypePolicy      = 0x04
+	unitTypeRightsMin   = 0x10
+	unitTypeRightsMax   = 0x9F
+	unitTypeCounterMin  = 0xA0
+	unitTypeCounterMax  = 0xAF
+	unitTypeSignature   = 0xFF
+	unitHeaderLen       = 4
+	licenseHeaderLength = 10
+)
+
 type CommonLicense struct {
-	Header    LicenseHeader
-	Keys      Keys
-	Objects   AuthObjects
-	Rights    Rights
-	Policys   Policys // Usage rules of Rights
-	Counter   Counter
-	Signature Signature
+	Header     LicenseHeader
+	Keys       Keys
+	Objects    AuthObjects
+	Rights     Rights
+	Policys    Policys        // Usage rules of Rights
+	Counters   Counters       // Relationships of Rights, optional
+	Extensions ExtensionUnits // Units of reserved types, optional
+	Signature  Signature
+
+	// omitCnt is set if the license is signed without Counter units, so
+	// that it's serialized the same way.
+	omitCnt bool
+	// sigAlgId is the signature algorithm negotiated with the client, used
+	// instead of the signer's own if the key can sign under it.
+	sigAlgId uint8
+}
+
+// KeySource gives the content key of a KID, e.g. a key.SeedRegistry.
+type KeySource interface {
+	ContentKey(kid string) ([]byte, error)
+}
+
+// defaultKeySource derives content keys from the built-in key seed.
+type defaultKeySource struct{}
+
+func (defaultKeySource) ContentKey(kid string) ([]byte, error) {
+	return key.NewKeyGenerator(nil).GenKeyByDefaultSeed(kid), nil
 }
 
-// Currently we don't use Counter Unit.
+// Counter units are not added by default, use AddCounter if needed.
+// The license id is drawn from the allocator set by SetIdAllocator.
+// Content keys are derived from the built-in key seed.
 func NewCommonLicense(kids []string, objIds []string, certId string) *CommonLicense {
-	units := len(kids)*2 + len(objIds) + 1
+	cl, _ := NewCommonLicenseFrom(defaultKeySource{}, kids, objIds, certId)
+	return cl
+}
 
+// NewCommonLicenseFrom is NewCommonLicense with content keys taken from ks.
+func NewCommonLicenseFrom(ks KeySource, kids []string, objIds []string, certId string) (*CommonLicense, error) {
 	keys := Keys{}
-	keygen := key.NewKeyGenerator(nil)
-	for _, kid := range kids {
-		key := keygen.GenKeyByDefaultSeed(kid)
-		keys = append(keys, NewKey(kid, key))
+	for i, kid := range kids {
+		ck, err := ks.ContentKey(kid)
+		if err != nil {
+			return nil, err
+		}
+		k := NewKey(kid, ck)
+		// Each Key unit is distinguished by its index.
+		k.Index = uint8(i + 1)
+		keys = append(keys, k)
 	}
 
 	objs := AuthObjects{}
@@ -135,81 +193,190 @@ func NewCommonLicense(kids []string, objIds []string, certId string) *CommonLice
 	}
 
 	plcs := Policys{}
-	for _, kid := range kids {
-		plcs = append(plcs, NewPolicy(kid))
+	for i, kid := range kids {
+		plc := NewPolicy(kid)
+		plc.Index = uint8(i + 1)
+		plcs = append(plcs, plc)
 	}
 
-	rs := Rights{}
-	rs = append(rs, NewRight(rightsTypePlay, nil))
+	rs := NewRights(NewPlayRight())
 
 	return &CommonLicense{
-		Header:    newLicenseHeader(1, 1234567890, uint8(units)),
+		Header:    newLicenseHeader(1, nextLicenseId(), 0),
 		Rights:    rs,
 		Objects:   objs,
 		Policys:   plcs,
 		Keys:      keys,
-		Counter:   NewCounter(ctrTypeAnd),
 		Signature: newSignature(certId),
+	}, nil
+}
+
+// EncryptKeys encrypts the content keys of all Key units by upper, so that
+// only the holder of upper key can get the content keys.
+func (cl *CommonLicense) EncryptKeys(upper UpperKey) error {
+	for i := range cl.Keys {
+		if err := cl.Keys[i].Encrypt(upper); err != nil {
+			return err
+		}
 	}
+
+	return nil
 }
 
-func (cl *CommonLicense) Serialize(withCnt, withSig bool) []byte {
-	buff := &bytes.Buffer{}
-	binary.Write(buff, binary.BigEndian, cl.Header)
-	binary.Write(buff, binary.BigEndian, cl.Keys.Bytes())
-	binary.Write(buff, binary.BigEndian, cl.Objects.Bytes())
-	binary.Write(buff, binary.BigEndian, cl.Rights.Bytes())
-	binary.Write(buff, binary.BigEndian, cl.Policys.Bytes())
+// SetPolicy replaces the Policy unit of the same KeyId with p, or appends p if
+// there is none.
+func (cl *CommonLicense) SetPolicy(p Policy) {
+	for i := range cl.Policys {
+		if bytes.Equal(cl.Policys[i].KeyId, p.KeyId) {
+			p.Index = cl.Policys[i].Index
+			cl.Policys[i] = p
+			return
+		}
+	}
+
+	p.Index = uint8(len(cl.Policys) + 1)
+	cl.Policys = append(cl.Policys, p)
+}
+
+// SetRights replaces the Right units of cl with rs.
+func (cl *CommonLicense) SetRights(rs ...Right) {
+	cl.Rights = NewRights(rs...)
+}
+
+// AddCounter appends c to the Counter units of cl. Counter units are only
+// serialized if withCnt is true.
+func (cl *CommonLicense) AddCounter(c Counter) {
+	c.Index = uint8(len(cl.Counters) + 1)
+	cl.Counters = append(cl.Counters, c)
+}
+
+// unitsNum counts the basic units following license header. The signature
+// unit is always counted, so that the signed body and the signed license
+// carry the same header.
+func (cl *CommonLicense) unitsNum(withCnt bool) int {
+	n := len(cl.Keys) + len(cl.Objects) + len(cl.Rights) + len(cl.Policys) + len(cl.Extensions) + 1
 	if withCnt {
-		binary.Write(buff, binary.BigEndian, cl.Counter.Bytes())
+		n += len(cl.Counters)
 	}
+	return n
+}
+
+// bodyUnits returns the units between license header and signature unit, each
+// in the layout of license version 1.
+func (cl *CommonLicense) bodyUnits(withCnt bool) [][]byte {
+	return cl.withExtensions(cl.basicUnits(withCnt))
+}
 
+// basicUnits returns the basic units of the body, without extension units.
+func (cl *CommonLicense) basicUnits(withCnt bool) [][]byte {
+	units := [][]byte{}
+	for i := range cl.Keys {
+		units = append(units, cl.Keys[i].Bytes())
+	}
+	for i := range cl.Objects {
+		units = append(units, cl.Objects[i].Bytes())
+	}
+	for i := range cl.Rights {
+		units = append(units, cl.Rights[i].Bytes())
+	}
+	for i := range cl.Policys {
+		units = append(units, cl.Policys[i].Bytes())
+	}
+	if withCnt {
+		for i := range cl.Counters {
+			units = append(units, cl.Counters[i].Bytes())
+		}
+	}
+	return units
+}
+
+// serialize writes the license header, units and, if withSig, the signature
+// unit in the layout of the license version.
+func (cl *CommonLicense) serialize(units [][]byte, withSig bool) []byte {
+	buff := &bytes.Buffer{}
+	writeUnit(buff, cl.Header.Version, cl.Header.Bytes())
+	for _, u := range units {
+		writeUnit(buff, cl.Header.Version, u)
+	}
 	if withSig {
-		binary.Write(buff, binary.BigEndian, cl.Signature.Bytes())
+		writeUnit(buff, cl.Header.Version, cl.Signature.Bytes())
 	}
 
 	return buff.Bytes()
 }
 
-func (cl *CommonLicense) Sign(withCnt bool) ([]byte, error) {
-	bytes := cl.Serialize(withCnt, false)
+// Serialize returns the binary form of cl. UnitsNum of license header is set
+// by the units serialized.
+func (cl *CommonLicense) Serialize(withCnt, withSig bool) []byte {
+	cl.Header.UnitsNum = uint8(cl.unitsNum(withCnt))
+	return cl.serialize(cl.bodyUnits(withCnt), withSig)
+}
 
-	sig, err := Sign(bytes)
+func (cl *CommonLicense) Sign(signer Signer, withCnt bool) ([]byte, error) {
+	bytes, err := cl.Marshal(withCnt, false)
 	if err != nil {
 		return nil, err
 	}
 
-	cl.Signature.SignatureData = sig
-	cl.Signature.SignatureLen = uint16(len(sig))
+	if err := cl.Signature.sign(signer, cl.sigAlgId, bytes); err != nil {
+		return nil, err
+	}
+	cl.omitCnt = !withCnt
 
-	return sig, nil
+	return cl.Signature.SignatureData, nil
 }
 
-func (cl *CommonLicense) Base64String() string {
-	return base64.StdEncoding.EncodeToString(cl.Serialize(false, true))
+// Base64String returns the signed license in base64, as it's sent to
+// clients. Like Marshal, it fails instead of encoding a corrupt license.
+func (cl *CommonLicense) Base64String() (string, error) {
+	data, err := cl.Marshal(!cl.omitCnt, true)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(data), nil
 }
 
+// Length is 16 bits in license version 1 and 32 bits since version 2, see
+// version.go. It's kept in 32 bits whatever the version is.
 type UnitHeader struct {
 	Type   uint8
 	Index  uint8
-	Length uint16 // length of data, in bytes
+	Length uint32 // length of data, in bytes
+}
+
+// write writes uh in the layout of license version 1.
+func (uh *UnitHeader) write(buff *bytes.Buffer) {
+	binary.Write(buff, binary.BigEndian, uh.Type)
+	binary.Write(buff, binary.BigEndian, uh.Index)
+	binary.Write(buff, binary.BigEndian, uint16(uh.Length))
 }
 
 // type 0x00
 type LicenseHeader struct {
 	UnitHeader
 
-	Version  uint8  // license version, currently is 1.
+	Version  uint8  // license version, 1 or 2
 	Id       uint64 // license id
 	UnitsNum uint8  // number of basic units
 }
 
+func (lh *LicenseHeader) Bytes() []byte {
+	buff := &bytes.Buffer{}
+
+	lh.UnitHeader.write(buff)
+	binary.Write(buff, binary.BigEndian, lh.Version)
+	binary.Write(buff, binary.BigEndian, lh.Id)
+	binary.Write(buff, binary.BigEndian, lh.UnitsNum)
+
+	return buff.Bytes()
+}
+
 func newLicenseHeader(ver uint8, id uint64, units uint8) LicenseHeader {
 	return LicenseHeader{
 		UnitHeader: UnitHeader{
-			Type:   0x00,
+			Type:   unitTypeHeader,
 			Index:  0x00,
-			Length: 10,
+			Length: licenseHeaderLength,
 		},
 		Version:  ver,
 		Id:       id,
@@ -235,7 +402,7 @@ func NewAuthObject(objType uint8, objId string) AuthObject {
 		UnitHeader: UnitHeader{
 			Type:   0x02,
 			Index:  0x01,
-			Length: uint16(1 + len(objId)),
+			Length: uint32(1 + len(objId)),
 		},
 		ObjectType: objType,
 		ObjectId:   []byte(objId),
@@ -245,9 +412,7 @@ func NewAuthObject(objType uint8, objId string) AuthObject {
 func (ao *AuthObject) Bytes() []byte {
 	buff := &bytes.Buffer{}
 
-	binary.Write(buff, binary.BigEndian, ao.Type)
-	binary.Write(buff, binary.BigEndian, ao.Index)
-	binary.Write(buff, binary.BigEndian, ao.Length)
+	ao.UnitHeader.write(buff)
 	binary.Write(buff, binary.BigEndian, ao.ObjectType)
 	binary.Write(buff, binary.BigEndian, ao.ObjectId)
 
@@ -273,18 +438,16 @@ type Key struct {
 	KeyData     []byte // encrypted key data with length of KeyDataLen bytes
 
 	// Auxiliary info of key. This is judged by Length field of UnitHeader.
-	KeyType  uint8  // key type
-	KeyIdLen uint8  // length of KeyId
-	KeyId    []byte // KeyId data
-	/*
-		UpperKeyType  uint8  // type of the key that is used to encrypt key
-		UpperKeyIdLen uint8  // length of UpperKeyId
-		UpperKeyId    []byte // id of the key that is used to encrypt key
-	*/
+	KeyType       uint8  // key type
+	KeyIdLen      uint8  // length of KeyId
+	KeyId         []byte // KeyId data
+	UpperKeyType  uint8  // type of the key that is used to encrypt key
+	UpperKeyIdLen uint8  // length of UpperKeyId
+	UpperKeyId    []byte // id of the key that is used to encrypt key
 }
 
 func NewKey(kid string, key []byte) Key {
-	return Key{
+	k := Key{
 		UnitHeader: UnitHeader{
 			Type:  0x03,
 			Index: 0x01,
@@ -296,23 +459,98 @@ func NewKey(kid string, key []byte) Key {
 		KeyIdLen:    uint8(len(kid)),
 		KeyId:       []byte(kid),
 	}
+	k.Length = uint32(len(k.Bytes()) - unitHeaderLen)
+
+	return k
+}
+
+// NewEncryptedKey creates a Key unit whose key data is key encrypted by upper.
+func NewEncryptedKey(kid string, key []byte, upper UpperKey) (Key, error) {
+	k := NewKey(kid, key)
+	if err := k.Encrypt(upper); err != nil {
+		return Key{}, err
+	}
+
+	return k, nil
+}
+
+// Encrypt encrypts the clear key data of k by upper, and records upper key
+// info in the auxiliary fields of k.
+func (k *Key) Encrypt(upper UpperKey) error {
+	if k.UpperKeyType != 0 {
+		return errKeyEncrypted
+	}
+	if upper.Type != keyTypeDevice && upper.Type != keyTypeBusiness {
+		return errUpperKeyType
+	}
+
+	data, err := wrapKey(upper.AlgorithmId, upper.Key, k.KeyData)
+	if err != nil {
+		return err
+	}
+
+	enc := *k
+	enc.AlgorithmId = upper.AlgorithmId
+	enc.KeyData = data
+	enc.KeyDataLen = uint16(len(data))
+	enc.UpperKeyType = upper.Type
+	enc.UpperKeyIdLen = uint8(len(upper.Id))
+	enc.UpperKeyId = []byte(upper.Id)
+	enc.Length = uint32(len(enc.Bytes()) - unitHeaderLen)
+	// Ids too long for their length fields are reported here, k is kept.
+	if err := enc.validate(); err != nil {
+		return err
+	}
+
+	*k = enc
+	return nil
+}
+
+// Decrypt returns the clear key data of k. upperKey is the device or business
+// key identified by UpperKeyType and UpperKeyId.
+func (k *Key) Decrypt(upperKey []byte) ([]byte, error) {
+	if k.UpperKeyType == 0 {
+		return append([]byte{}, k.KeyData...), nil
+	}
+
+	return unwrapKey(k.AlgorithmId, upperKey, k.KeyData)
 }
 
 func (k *Key) Bytes() []byte {
 	buff := &bytes.Buffer{}
 
-	binary.Write(buff, binary.BigEndian, k.Type)
-	binary.Write(buff, binary.BigEndian, k.Index)
-	binary.Write(buff, binary.BigEndian, k.Length)
+	k.UnitHeader.write(buff)
 	binary.Write(buff, binary.BigEndian, k.AlgorithmId)
 	binary.Write(buff, binary.BigEndian, k.KeyDataLen)
 	binary.Write(buff, binary.BigEndian, k.KeyData)
+	// Auxiliary info is optional, it's absent if key type is not set.
+	if k.KeyType != 0 {
+		binary.Write(buff, binary.BigEndian, k.KeyType)
+		binary.Write(buff, binary.BigEndian, k.KeyIdLen)
+		binary.Write(buff, binary.BigEndian, k.KeyId)
+	}
+	// Upper key info is only present if key data is encrypted.
+	if k.UpperKeyType != 0 {
+		binary.Write(buff, binary.BigEndian, k.UpperKeyType)
+		binary.Write(buff, binary.BigEndian, k.UpperKeyIdLen)
+		binary.Write(buff, binary.BigEndian, k.UpperKeyId)
+	}
 
 	return buff.Bytes()
 }
 
 type Keys []Key
 
+// Get returns the Key unit of kid, or nil if kid is not in ks.
+func (ks Keys) Get(kid string) *Key {
+	for i := range ks {
+		if string(ks[i].KeyId) == kid {
+			return &ks[i]
+		}
+	}
+	return nil
+}
+
 func (ks *Keys) Bytes() []byte {
 	buff := &bytes.Buffer{}
 	for _, k := range *ks {
@@ -352,40 +590,14 @@ type Policy struct {
 	KeyRules    KeyRules // key rules data
 }
 
+// NewPolicy creates a Policy unit which allows kid to be used from now on for
+// one year and one day. Use PolicyBuilder for other rules.
 func NewPolicy(kid string) Policy {
 	now := time.Now()
-	startTime := now.Unix()
-	endTime := now.AddDate(1, 0, 1).Unix()
-	buff := &bytes.Buffer{}
-	binary.Write(buff, binary.BigEndian, startTime)
-	startTimeData := buff.Bytes()
-	buff.Reset()
-	binary.Write(buff, binary.BigEndian, endTime)
-	endTimeData := buff.Bytes()
-
-	plc := Policy{
-		UnitHeader: UnitHeader{
-			Type:  0x04,
-			Index: 0x01,
-		},
-		KeyType:     keyTypeContent,
-		KeyIdLen:    uint8(len(kid)),
-		KeyId:       []byte(kid),
-		KeyRulesNum: 1,
-		KeyRules: KeyRules{
-			KeyRule{
-				KeyRuleType: keyRuleTypeStartTime,
-				KeyRuleLen:  uint8(len(startTimeData)),
-				KeyRuleData: startTimeData,
-			},
-			KeyRule{
-				KeyRuleType: keyRuleTypeEndTime,
-				KeyRuleLen:  uint8(len(endTimeData)),
-				KeyRuleData: endTimeData,
-			},
-		},
-	}
-	plc.Length = uint16(len(plc.Bytes()) - 2)
+	plc, _ := NewPolicyBuilder(kid).
+		StartTime(now).
+		EndTime(now.AddDate(1, 0, 1)).
+		Build()
 
 	return plc
 }
@@ -393,9 +605,7 @@ func NewPolicy(kid string) Policy {
 func (p *Policy) Bytes() []byte {
 	buff := &bytes.Buffer{}
 
-	binary.Write(buff, binary.BigEndian, p.Type)
-	binary.Write(buff, binary.BigEndian, p.Index)
-	binary.Write(buff, binary.BigEndian, p.Length)
+	p.UnitHeader.write(buff)
 	binary.Write(buff, binary.BigEndian, p.KeyType)
 	binary.Write(buff, binary.BigEndian, p.KeyIdLen)
 	binary.Write(buff, binary.BigEndian, p.KeyId)
@@ -407,6 +617,16 @@ func (p *Policy) Bytes() []byte {
 
 type Policys []Policy
 
+// Get returns the Policy unit of kid, or nil if kid is not in ps.
+func (ps Policys) Get(kid string) *Policy {
+	for i := range ps {
+		if string(ps[i].KeyId) == kid {
+			return &ps[i]
+		}
+	}
+	return nil
+}
+
 func (ps *Policys) Bytes() []byte {
 	buff := &bytes.Buffer{}
 	for _, p := range *ps {
@@ -416,13 +636,24 @@ func (ps *Policys) Bytes() []byte {
 }
 
 const (
-	rightsTypePlay       = 0x10
-	rightsTypeRecord     = 0x20
-	rightsTypeCopy       = 0x30
-	rightsTypeStore      = 0x40
-	rightsTypeForward    = 0x50
-	rightsTypeExecute    = 0x60
-	rightsTypeSuperRight = 0x80
+	rightsTypePlay           = 0x10
+	rightsTypePlayTimes      = 0x11
+	rightsTypePlayTime       = 0x12
+	rightsTypePlayInterval   = 0x13
+	rightsTypePlayProtected  = 0x14
+	rightsTypePlayQuality    = 0x15
+	rightsTypeRecord         = 0x20
+	rightsTypeRecordInterval = 0x21
+	rightsTypeRecordTime     = 0x22
+	rightsTypeCopy           = 0x30
+	rightsTypeStore          = 0x40
+	rightsTypeForward        = 0x50
+	rightsTypeExecute        = 0x60
+	rightsTypeSuperRight     = 0x80
+	rightsTypeTimes          = 0x91
+	rightsTypeTime           = 0x92
+	rightsTypeInterval       = 0x93
+	rightsTypeProtection     = 0x94
 )
 
 /*
@@ -435,6 +666,8 @@ const (
 	|   play by times			|   0x11	|   	uint32								|
 	|   play by time			|   0x12	|   	uint32(in seconds)					|
 	|   play by time interval	|   0x13	|   	uint32(start time)|uint32(end time)	|
+	|   play with protection	|   0x14	|   	uint8(protection level)				|
+	|   play by quality			|   0x15	|   	uint8(quality)						|
 	|-----------------------------------------------------------------------------------|
 	|	record					|   0x20	|   	nil									|
 	|   record by time interval	|   0x21	|   	uint32(start time)|uint32(end time)	|
@@ -449,7 +682,15 @@ const (
 	|	execute					|   0x60	|		nil									|
 	|-----------------------------------------------------------------------------------|
 	|	super right				|   0x80	|		nil									|
+	|-----------------------------------------------------------------------------------|
+	|   by times				|   0x91	|   	uint32								|
+	|   by time					|   0x92	|   	uint32(in seconds)					|
+	|   by time interval		|   0x93	|   	uint32(start time)|uint32(end time)	|
+	|   with protection			|   0x94	|   	uint8(protection level)				|
 	+-----------------------------------------------------------------------------------+
+	Protection level is 0 (no HDMI), 1 (HDMI) or 2 (HDMI with link protection),
+	quality is 0 (any), 1 (SD), 2 (HD) or 3 (UHD). Rights 0x91 to 0x94 grant
+	nothing by themselves, they further limit the other rights.
 */
 type Right struct {
 	UnitHeader
@@ -462,7 +703,7 @@ func NewRight(rType uint8, data []byte) Right {
 		UnitHeader: UnitHeader{
 			Type:   rType,
 			Index:  0x01,
-			Length: uint16(len(data)),
+			Length: uint32(len(data)),
 		},
 		RightData: data,
 	}
@@ -471,9 +712,7 @@ func NewRight(rType uint8, data []byte) Right {
 func (r *Right) Bytes() []byte {
 	buff := &bytes.Buffer{}
 
-	binary.Write(buff, binary.BigEndian, r.Type)
-	binary.Write(buff, binary.BigEndian, r.Index)
-	binary.Write(buff, binary.BigEndian, r.Length)
+	r.UnitHeader.write(buff)
 	binary.Write(buff, binary.BigEndian, r.RightData)
 
 	return buff.Bytes()
@@ -481,6 +720,17 @@ func (r *Right) Bytes() []byte {
 
 type Rights []Right
 
+// NewRights collects rs into Rights, numbering each Right unit by its index
+// from 1, so that Counter units can refer to them.
+func NewRights(rs ...Right) Rights {
+	rights := Rights{}
+	for i, r := range rs {
+		r.Index = uint8(i + 1)
+		rights = append(rights, r)
+	}
+	return rights
+}
+
 func (rs *Rights) Bytes() []byte {
 	buff := &bytes.Buffer{}
 	for _, r := range *rs {
@@ -505,29 +755,40 @@ type Counter struct {
 	RightsIndex    []uint8
 }
 
-func NewCounter(uType uint8) Counter {
+// NewCounter creates a Counter unit of uType over the Right units of
+// rightsIndex.
+func NewCounter(uType uint8, rightsIndex ...uint8) Counter {
 	return Counter{
 		UnitHeader: UnitHeader{
 			Type:   uType,
 			Index:  0x01,
-			Length: 4,
+			Length: uint32(2 + len(rightsIndex)),
 		},
-		RightsIndexNum: 0,
+		RightsIndexNum: uint16(len(rightsIndex)),
+		RightsIndex:    append([]uint8{}, rightsIndex...),
 	}
 }
 
 func (c *Counter) Bytes() []byte {
 	buff := &bytes.Buffer{}
 
-	binary.Write(buff, binary.BigEndian, c.Type)
-	binary.Write(buff, binary.BigEndian, c.Index)
-	binary.Write(buff, binary.BigEndian, c.Length)
+	c.UnitHeader.write(buff)
 	binary.Write(buff, binary.BigEndian, c.RightsIndexNum)
 	binary.Write(buff, binary.BigEndian, c.RightsIndex)
 
 	return buff.Bytes()
 }
 
+type Counters []Counter
+
+func (cs *Counters) Bytes() []byte {
+	buff := &bytes.Buffer{}
+	for _, c := range *cs {
+		buff.Write(c.Bytes())
+	}
+	return buff.Bytes()
+}
+
 type Signature struct {
 	UnitHeader
 
@@ -541,9 +802,7 @@ type Signature struct {
 func (s *Signature) Bytes() []byte {
 	buff := &bytes.Buffer{}
 
-	binary.Write(buff, binary.BigEndian, s.Type)
-	binary.Write(buff, binary.BigEndian, s.Index)
-	binary.Write(buff, binary.BigEndian, s.Length)
+	s.UnitHeader.write(buff)
 	binary.Write(buff, binary.BigEndian, s.AlgorithmId)
 	binary.Write(buff, binary.BigEndian, s.CertificatIdLen)
 	binary.Write(buff, binary.BigEndian, s.CertificatId)
@@ -553,8 +812,45 @@ func (s *Signature) Bytes() []byte {
 	return buff.Bytes()
 }
 
+// Length of the data part of signature unit.
+func (s *Signature) dataLen() uint32 {
+	return uint32(1 + 1 + len(s.CertificatId) + 2 + len(s.SignatureData))
+}
+
+// sign fills s with the signature of data by signer, under algId if it's set
+// and the key of signer can sign under it. The certificate id of signer, if
+// any, replaces the one s was created with.
+func (s *Signature) sign(signer Signer, algId uint8, data []byte) error {
+	var sig []byte
+	var err error
+	as, ok := signer.(AlgorithmSigner)
+	if ok && algId != 0 && algId != signer.AlgorithmId() && checkKey(algId, signer.Public()) == nil {
+		sig, err = as.SignWith(algId, data)
+	} else {
+		algId = signer.AlgorithmId()
+		sig, err = signer.Sign(data)
+	}
+	if err != nil {
+		return err
+	}
+
+	if certId := signer.CertificateId(); certId != "" {
+		if len(certId) > math.MaxUint8 {
+			return errCertIdLen
+		}
+		s.CertificatId = []byte(certId)
+		s.CertificatIdLen = uint8(len(certId))
+	}
+	s.AlgorithmId = algId
+	s.SignatureData = sig
+	s.SignatureLen = uint16(len(sig))
+	s.Length = s.dataLen()
+
+	return nil
+}
+
 func newSignature(certId string) Signature {
-	return Signature{
+	sig := Signature{
 		UnitHeader: UnitHeader{
 			Type:  0xFF,
 			Index: 0x01,
@@ -563,4 +859,7 @@ func newSignature(certId string) Signature {
 		CertificatId:    []byte(certId),
 		CertificatIdLen: uint8(len([]byte(certId))),
 	}
+	sig.Length = sig.dataLen()
+
+	return sig
 }
@@ -0,0 +1,449 @@
+/*
+	Opendrm, an open source implementation of industry-grade DRM
+	(Digital Rights Management) or Key System.
+	Copyright (C) 2018  wilkk
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+/*
+	Conformance vectors of GY/T 277-2014. Each unit below is assembled by hand
+	from the tables of clause 7.2 and the algorithm ids of appendix B, field by
+	field, not by this encoder. Together they make the license of
+	specLicense, in the unit order that the encoder writes. The signature
+	unit holds an RSA-SHA1-1024 signature of the preceding units, made once
+	with openssl and test/rsa_private_key.pem.
+
+	The units after the license header are numbered 1, 2, 3... by position,
+	as 7.2.1 specifies, and counters refer to rights by that number. The
+	encoder numbers units per type instead, which the parser and counters
+	accept as well.
+*/
+
+package license
+
+import (
+	"bytes"
+	"encoding/hex"
+	"strings"
+	"testing"
+	"time"
+)
+
+// specUnit is a unit in hex, spaces are ignored.
+type specUnit struct {
+	name  string
+	hex   string
+	check func(t *testing.T, u interface{})
+}
+
+func specBytes(t *testing.T, s string) []byte {
+	b, err := hex.DecodeString(strings.Replace(s, " ", "", -1))
+	if err != nil {
+		t.Fatalf("DecodeString failed. err=%s", err)
+	}
+	return b
+}
+
+func specRight(rType, index uint8, data string) specUnit {
+	return specUnit{
+		name: "rights",
+		hex:  data,
+		check: func(t *testing.T, u interface{}) {
+			r := u.(*Right)
+			if r.Type != rType || r.Index != index {
+				t.Errorf("right 0x%02X at %d decoded as 0x%02X at %d", rType, index, r.Type, r.Index)
+			}
+		},
+	}
+}
+
+func checkTimes(t *testing.T, r *Right, want uint32) {
+	n, err := r.Times()
+	if err != nil || n != want {
+		t.Errorf("right 0x%02X: times %d, err=%v, want %d", r.Type, n, err, want)
+	}
+}
+
+func checkDuration(t *testing.T, r *Right, want time.Duration) {
+	d, err := r.Duration()
+	if err != nil || d != want {
+		t.Errorf("right 0x%02X: duration %s, err=%v, want %s", r.Type, d, err, want)
+	}
+}
+
+func checkInterval(t *testing.T, r *Right, start, end int64) {
+	s, e, err := r.Interval()
+	if err != nil || s.Unix() != start || e.Unix() != end {
+		t.Errorf("right 0x%02X: interval %s-%s, err=%v", r.Type, s, e, err)
+	}
+}
+
+func checkLevel(t *testing.T, r *Right, want uint8) {
+	l, err := r.Level()
+	if err != nil || l != want {
+		t.Errorf("right 0x%02X: level %d, err=%v, want %d", r.Type, l, err, want)
+	}
+}
+
+var (
+	specStart = time.Date(2018, 6, 1, 0, 0, 0, 0, time.UTC).Unix() // 0x5B108C80
+	specMonth = time.Date(2018, 7, 1, 0, 0, 0, 0, time.UTC).Unix() // 0x5B381980
+	specWeek  = time.Date(2018, 6, 8, 0, 0, 0, 0, time.UTC).Unix() // 0x5B19C700
+	specYear  = time.Date(2019, 6, 1, 0, 0, 0, 0, time.UTC).Unix() // 0x5CF1C000
+)
+
+var specLicense = []specUnit{
+	{
+		name: "license header, table 6",
+		hex: "00 00 000a" + // Type 0x00, Index 0, Length 10
+			"01" + // Version
+			"0102030405060708" + // LicenseID
+			"1a", // UnitsNumber, 26 units after the header
+		check: func(t *testing.T, u interface{}) {
+			lh := u.(*LicenseHeader)
+			if lh.Version != 1 || lh.Id != 0x0102030405060708 || lh.UnitsNum != 26 {
+				t.Errorf("license header decoded as %+v", *lh)
+			}
+		},
+	},
+	{
+		name: "content, table 7",
+		hex: "01 01 0014" + // Type 0x01, Index 1, Length 20
+			"00000002dfdc1c34" + // ContentID 12345678900
+			"05 6b69642d31" + // KeyIdentifierLen, KeyIdentifier "kid-1"
+			"05 6b69642d32", // KeyIdentifierLen, KeyIdentifier "kid-2"
+		check: func(t *testing.T, u interface{}) {
+			c := u.(*Content)
+			if c.ContentId != 12345678900 || len(c.Keys) != 2 ||
+				string(c.Keys[0].KeyId) != "kid-1" || string(c.Keys[1].KeyId) != "kid-2" {
+				t.Errorf("content decoded as %+v", *c)
+			}
+		},
+	},
+	{
+		name: "key encrypted by a device key, table 9",
+		hex: "03 02 0024" + // Type 0x03, Index 2, Length 36
+			"22" + // KeyAlgorithm SM4-128, appendix B
+			"0010" + // KeyDataLen
+			"000102030405060708090a0b0c0d0e0f" + // KeyData
+			"01" + // KeyType content key, table 10
+			"05 6b69642d31" + // KeyIdLen, KeyId "kid-1"
+			"03" + // UpperKeyType device key
+			"08 6465766963652d31", // UpperKeyIdLen, UpperKeyId "device-1"
+		check: func(t *testing.T, u interface{}) {
+			k := u.(*Key)
+			if k.AlgorithmId != algorithmBlockCipher_SM4_128 || k.KeyDataLen != 16 ||
+				k.KeyType != keyTypeContent || string(k.KeyId) != "kid-1" ||
+				k.UpperKeyType != keyTypeDevice || string(k.UpperKeyId) != "device-1" {
+				t.Errorf("key decoded as %+v", *k)
+			}
+		},
+	},
+	{
+		name: "key encrypted by a business key, table 9",
+		hex: "03 03 0026" + // Type 0x03, Index 3, Length 38
+			"21" + // KeyAlgorithm 3DES, appendix B
+			"0010" + // KeyDataLen
+			"101112131415161718191a1b1c1d1e1f" + // KeyData
+			"01" + // KeyType content key
+			"05 6b69642d32" + // KeyIdLen, KeyId "kid-2"
+			"02" + // UpperKeyType business key
+			"0a 6f70657261746f722d31", // UpperKeyIdLen, UpperKeyId "operator-1"
+		check: func(t *testing.T, u interface{}) {
+			k := u.(*Key)
+			if k.AlgorithmId != algorithmBlockCipher_3DES_64_112 || string(k.KeyId) != "kid-2" ||
+				k.UpperKeyType != keyTypeBusiness || string(k.UpperKeyId) != "operator-1" {
+				t.Errorf("key decoded as %+v", *k)
+			}
+		},
+	},
+	{
+		// ObjectType is left to implementers, 0x02 is a device here.
+		name: "authorized object, table 8",
+		hex: "02 04 0009" + // Type 0x02, Index 4, Length 9
+			"02" + // ObjectType
+			"6465766963652d31", // ObjectID "device-1"
+		check: func(t *testing.T, u interface{}) {
+			ao := u.(*AuthObject)
+			if ao.ObjectType != authObjTypeDevice || string(ao.ObjectId) != "device-1" {
+				t.Errorf("authorized object decoded as %+v", *ao)
+			}
+		},
+	},
+	// Rights of table 14: Type, Index, Length and the data.
+	specRight(0x10, 5, "10 05 0000"), // play
+	{
+		name: "play by times, table 14",
+		hex:  "11 06 0004 00000003",
+		check: func(t *testing.T, u interface{}) {
+			checkTimes(t, u.(*Right), 3)
+		},
+	},
+	{
+		name: "play by duration, table 14",
+		hex:  "12 07 0004 00001c20",
+		check: func(t *testing.T, u interface{}) {
+			checkDuration(t, u.(*Right), 2*time.Hour)
+		},
+	},
+	{
+		name: "play by interval, table 14",
+		hex:  "13 08 0008 5b108c80 5b381980",
+		check: func(t *testing.T, u interface{}) {
+			checkInterval(t, u.(*Right), specStart, specMonth)
+		},
+	},
+	{
+		name: "play with connection protection, table 14",
+		hex:  "14 09 0001 02",
+		check: func(t *testing.T, u interface{}) {
+			checkLevel(t, u.(*Right), 2)
+		},
+	},
+	{
+		name: "play by quality, table 14",
+		hex:  "15 0a 0001 02",
+		check: func(t *testing.T, u interface{}) {
+			checkLevel(t, u.(*Right), 2)
+		},
+	},
+	specRight(0x20, 11, "20 0b 0000"), // record
+	{
+		name: "record by interval, table 14",
+		hex:  "21 0c 0008 5b108c80 5b19c700",
+		check: func(t *testing.T, u interface{}) {
+			checkInterval(t, u.(*Right), specStart, specWeek)
+		},
+	},
+	{
+		name: "record by duration, table 14",
+		hex:  "22 0d 0004 00000e10",
+		check: func(t *testing.T, u interface{}) {
+			checkDuration(t, u.(*Right), time.Hour)
+		},
+	},
+	specRight(0x30, 14, "30 0e 0000"), // copy
+	specRight(0x40, 15, "40 0f 0000"), // store
+	specRight(0x50, 16, "50 10 0000"), // forward
+	specRight(0x60, 17, "60 11 0000"), // execute
+	specRight(0x80, 18, "80 12 0000"), // super right
+	{
+		name: "operation by times, table 14",
+		hex:  "91 13 0004 00000005",
+		check: func(t *testing.T, u interface{}) {
+			checkTimes(t, u.(*Right), 5)
+		},
+	},
+	{
+		name: "operation by duration, table 14",
+		hex:  "92 14 0004 00000708",
+		check: func(t *testing.T, u interface{}) {
+			checkDuration(t, u.(*Right), 30*time.Minute)
+		},
+	},
+	{
+		name: "operation by interval, table 14",
+		hex:  "93 15 0008 5b108c80 5cf1c000",
+		check: func(t *testing.T, u interface{}) {
+			checkInterval(t, u.(*Right), specStart, specYear)
+		},
+	},
+	{
+		name: "operation with protection, table 14",
+		hex:  "94 16 0001 01",
+		check: func(t *testing.T, u interface{}) {
+			checkLevel(t, u.(*Right), 1)
+		},
+	},
+	{
+		name: "key usage rules, tables 11 and 12",
+		hex: "04 17 0026" + // Type 0x04, Index 23, Length 38
+			"01" + // KeyType content key
+			"05 6b69642d31" + // KeyIdLen, KeyId "kid-1"
+			"05" + // KeyRulesNum
+			"01 04 5b108c80" + // start time
+			"02 04 5cf1c000" + // end time
+			"03 04 0000000a" + // play times
+			"04 04 0002a300" + // time span, 48 hours
+			"05 04 00008ca0", // accumulated time span, 10 hours
+		check: func(t *testing.T, u interface{}) {
+			p := u.(*Policy)
+			if p.KeyType != keyTypeContent || string(p.KeyId) != "kid-1" {
+				t.Errorf("key usage rules decoded as %+v", *p)
+			}
+			prs, err := p.Rules()
+			if err != nil {
+				t.Fatalf("Rules failed. err=%s", err)
+			}
+			if prs.StartTime.Unix() != specStart || prs.EndTime.Unix() != specYear ||
+				*prs.PlayTimes != 10 || *prs.TimeSpan != 48*time.Hour || *prs.AccuTimeSpan != 10*time.Hour {
+				t.Errorf("key rules decoded as %+v", prs)
+			}
+		},
+	},
+	{
+		name: "OR counter, tables 15 and 16",
+		hex: "a1 18 0004" + // Type 0xA1, Index 24, Length 4
+			"0002" + // RightsIndexNumber
+			"05 0b", // RightsIndex of play and record
+		check: func(t *testing.T, u interface{}) {
+			c := u.(*Counter)
+			if c.RightsIndexNum != 2 || !bytes.Equal(c.RightsIndex, []byte{5, 11}) {
+				t.Errorf("counter decoded as %+v", *c)
+			}
+		},
+	},
+	{
+		name: "NOT counter, tables 15 and 16",
+		hex: "a2 19 0003" + // Type 0xA2, Index 25, Length 3
+			"0001" + // RightsIndexNumber
+			"0e", // RightsIndex of copy
+		check: func(t *testing.T, u interface{}) {
+			c := u.(*Counter)
+			if c.RightsIndexNum != 1 || !bytes.Equal(c.RightsIndex, []byte{14}) {
+				t.Errorf("counter decoded as %+v", *c)
+			}
+		},
+	},
+	{
+		name: "signature, table 17",
+		hex: "ff 1a 00a8" + // Type 0xFF, Index 26, Length 168
+			"40" + // Algorithm RSA-SHA1-1024, appendix B
+			"24" + // CertificateIDLength
+			"62386333353836382d346239342d346164392d613062632d633835653961303362316465" + // CertificationID
+			"0080" + // SignatureLength
+			"4058e21c1122e458baa12da7d0be6ff4ac15a1dcc9caef5fe9ea87367b124013" + // Signature, PKCS #1 v1.5
+			"ecc6ebed1b5471cfb34ee5672ab992b4c53aadbd223f4a2276154f4fc7058f77" +
+			"310b4cc17d408f5ef2ad2ff7961cc105a7ac547d6ef9580bd77633ed535a580f" +
+			"5ca5d712303ebe3e42fc4dd2cdb94af437563a2327005589b26c33f8be5c9c22",
+		check: func(t *testing.T, u interface{}) {
+			s := u.(*Signature)
+			if s.AlgorithmId != algorithmSignature_RSA_SHA1_1024 ||
+				string(s.CertificatId) != fixtureCertId || s.SignatureLen != 128 {
+				t.Errorf("signature decoded as %+v", *s)
+			}
+		},
+	},
+}
+
+// specUnits are units of the other cases.
+var specUnits = []specUnit{
+	{
+		name: "key without additional information, table 9",
+		hex: "03 01 0013" + // Type 0x03, Index 1, Length 19
+			"20" + // KeyAlgorithm AES-128, appendix B
+			"0010" + // KeyDataLen
+			"202122232425262728292a2b2c2d2e2f", // KeyData
+		check: func(t *testing.T, u interface{}) {
+			k := u.(*Key)
+			if k.AlgorithmId != algorithmBlockCipher_AES_128_128 || k.KeyIdLen != 0 || k.UpperKeyIdLen != 0 {
+				t.Errorf("key decoded as %+v", *k)
+			}
+		},
+	},
+	{
+		name: "AND counter, tables 15 and 16",
+		hex:  "a0 01 0004 0002 01 02",
+		check: func(t *testing.T, u interface{}) {
+			if c := u.(*Counter); c.Type != ctrTypeAnd || !bytes.Equal(c.RightsIndex, []byte{1, 2}) {
+				t.Errorf("counter decoded as %+v", *c)
+			}
+		},
+	},
+	{
+		name: "XOR counter, tables 15 and 16",
+		hex:  "a3 01 0003 0001 01",
+		check: func(t *testing.T, u interface{}) {
+			if c := u.(*Counter); c.Type != ctrTypeXor || !bytes.Equal(c.RightsIndex, []byte{1}) {
+				t.Errorf("counter decoded as %+v", *c)
+			}
+		},
+	},
+}
+
+// parseSpecUnit decodes data, which must be a single unit of license version 1.
+func parseSpecUnit(data []byte) (interface{ Bytes() []byte }, error) {
+	d := &decoder{data: data}
+	hdr, ud := d.unit()
+	if err := d.done(); err != nil {
+		return nil, err
+	}
+
+	switch {
+	case hdr.Type == unitTypeHeader:
+		lh, err := parseLicenseHeader(hdr, ud)
+		return &lh, err
+	case hdr.Type == unitTypeContent:
+		c, err := parseContent(hdr, ud)
+		return &c, err
+	case hdr.Type == unitTypeAuthObject:
+		ao, err := parseAuthObject(hdr, ud)
+		return &ao, err
+	case hdr.Type == unitTypeKey:
+		k, err := parseKey(hdr, ud)
+		return &k, err
+	case hdr.Type == unitTypePolicy:
+		p, err := parsePolicy(hdr, ud)
+		return &p, err
+	case hdr.Type >= unitTypeRightsMin && hdr.Type <= unitTypeRightsMax:
+		r, err := parseRight(hdr, ud)
+		return &r, err
+	case hdr.Type >= unitTypeCounterMin && hdr.Type <= unitTypeCounterMax:
+		c, err := parseCounter(hdr, ud)
+		return &c, err
+	case hdr.Type == unitTypeSignature:
+		s, err := parseSignature(hdr, ud)
+		return &s, err
+	}
+	return nil, errUnexpectedUnit
+}
+
+func TestSpecUnits(t *testing.T) {
+	for _, su := range append(append([]specUnit{}, specLicense...), specUnits...) {
+		data := specBytes(t, su.hex)
+		u, err := parseSpecUnit(data)
+		if err != nil {
+			t.Fatalf("%s: parse failed. err=%s", su.name, err)
+		}
+		su.check(t, u)
+		if got := u.Bytes(); !bytes.Equal(got, data) {
+			t.Errorf("%s: encoding differs from vector.\ngot  %x\nwant %x", su.name, got, data)
+		}
+	}
+}
+
+func TestSpecLicense(t *testing.T) {
+	var data []byte
+	for _, su := range specLicense {
+		data = append(data, specBytes(t, su.hex)...)
+	}
+
+	cdl, err := VerifyChinaDrmLicense(data, loadPublicKeys(t, fixtureCertId))
+	if err != nil {
+		t.Fatalf("VerifyChinaDrmLicense failed. err=%s", err)
+	}
+	if got := cdl.Serialize(true, true); !bytes.Equal(got, data) {
+		t.Fatalf("serialize(parse(license)) differs from vector.\ngot  %x\nwant %x", got, data)
+	}
+
+	// The OR counter needs play or record, the NOT counter refuses copy,
+	// which the super right would grant otherwise.
+	for action, want := range map[Action]bool{ActionPlay: true, ActionRecord: true, ActionCopy: false} {
+		ok, err := cdl.Allowed(action)
+		if err != nil || ok != want {
+			t.Errorf("Allowed(0x%02X) = %v, err=%v, want %v", action, ok, err, want)
+		}
+	}
+}
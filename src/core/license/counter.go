@@ -0,0 +1,146 @@
+/*
+	Opendrm, an open source implementation of industry-grade DRM
+	(Digital Rights Management) or Key System.
+	Copyright (C) 2018  wilkk
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+/*
+	Counter units combine Right units into expressions. Given an action, every
+	Right unit is true if it grants the action, and each Counter unit is
+	evaluated over the Right units it refers to by index:
+
+		and: all of them are true
+		or:  at least one of them is true
+		not: none of them is true
+		xor: exactly one of them is true
+
+	An action is allowed if any Right unit grants it and all Counter units are
+	true. Without Counter units, all Right units are granted together ('and' is
+	the default relationship), so an action is allowed if any of them grants it.
+
+	For example, "play or record, but not copy" is expressed by rights
+	[1]play, [2]record, [3]copy with counters or(1, 2) and not(3).
+*/
+
+package license
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	errUnknownCounter = errors.New("license: unknown counter type")
+	errRightsIndex    = errors.New("license: counter refers to unknown right")
+)
+
+// Action is what a license holder asks to do with the content. Its value is
+// the code of the basic rights type.
+type Action uint8
+
+const (
+	ActionPlay    Action = rightsTypePlay
+	ActionRecord  Action = rightsTypeRecord
+	ActionCopy    Action = rightsTypeCopy
+	ActionStore   Action = rightsTypeStore
+	ActionForward Action = rightsTypeForward
+	ActionExecute Action = rightsTypeExecute
+)
+
+func NewAndCounter(rightsIndex ...uint8) Counter {
+	return NewCounter(ctrTypeAnd, rightsIndex...)
+}
+
+func NewOrCounter(rightsIndex ...uint8) Counter {
+	return NewCounter(ctrTypeOr, rightsIndex...)
+}
+
+func NewNotCounter(rightsIndex ...uint8) Counter {
+	return NewCounter(ctrTypeNot, rightsIndex...)
+}
+
+func NewXorCounter(rightsIndex ...uint8) Counter {
+	return NewCounter(ctrTypeXor, rightsIndex...)
+}
+
+// Grants reports whether r grants action. Super right grants all actions, and
+// variants like play by times grant the action of their basic type.
+func (r *Right) Grants(action Action) bool {
+	if r.Type == rightsTypeSuperRight {
+		return true
+	}
+	return Action(r.Type&0xF0) == action
+}
+
+// Get returns the Right unit of index, or nil if there is none.
+func (rs Rights) Get(index uint8) *Right {
+	for i := range rs {
+		if rs[i].Index == index {
+			return &rs[i]
+		}
+	}
+	return nil
+}
+
+// Eval evaluates c for action over rs.
+func (c *Counter) Eval(rs Rights, action Action) (bool, error) {
+	n := 0
+	for _, index := range c.RightsIndex {
+		r := rs.Get(index)
+		if r == nil {
+			return false, fmt.Errorf("%w: index %d", errRightsIndex, index)
+		}
+		if r.Grants(action) {
+			n++
+		}
+	}
+
+	switch c.Type {
+	case ctrTypeAnd:
+		return n == len(c.RightsIndex), nil
+	case ctrTypeOr:
+		return n > 0, nil
+	case ctrTypeNot:
+		return n == 0, nil
+	case ctrTypeXor:
+		return n == 1, nil
+	default:
+		return false, fmt.Errorf("%w: 0x%02X", errUnknownCounter, c.Type)
+	}
+}
+
+// Allowed reports whether the rights and counters of cl allow action.
+func (cl *CommonLicense) Allowed(action Action) (bool, error) {
+	granted := false
+	for i := range cl.Rights {
+		if cl.Rights[i].Grants(action) {
+			granted = true
+			break
+		}
+	}
+
+	for i := range cl.Counters {
+		ok, err := cl.Counters[i].Eval(cl.Rights, action)
+		if err != nil {
+			return false, err
+		}
+		if !ok {
+			return false, nil
+		}
+	}
+
+	return granted, nil
+}
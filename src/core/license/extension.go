@@ -0,0 +1,220 @@
+/*
+	Opendrm, an open source implementation of industry-grade DRM
+	(Digital Rights Management) or Key System.
+	Copyright (C) 2018  wilkk
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+/*
+	Unit types 0x05~0x0F and 0xD0~0xEF are reserved for extensions. A package
+	that defines an extension unit registers an ExtensionCodec for its type,
+	then adds units with NewExtensionUnit and AddExtension, without touching
+	the basic units.
+
+	Extension units of types that are not registered are still accepted by the
+	parser and kept as they are, so that a license passing through a server
+	which doesn't know them is serialized with the same bytes. Parsed
+	extension units keep their position among the other units for the same
+	reason; added ones come after all units but the signature.
+*/
+
+package license
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+var (
+	errExtensionType       = errors.New("license: unit type is not reserved for extensions")
+	errDuplicatedExtension = errors.New("license: extension unit type already registered")
+	errUnknownExtension    = errors.New("license: extension unit type not registered")
+)
+
+// ExtensionCodec encodes and decodes the data part of an extension unit.
+type ExtensionCodec interface {
+	Encode(v interface{}) ([]byte, error)
+	Decode(data []byte) (interface{}, error)
+}
+
+var (
+	extLock   sync.RWMutex
+	extCodecs = map[uint8]ExtensionCodec{}
+)
+
+// IsExtensionType reports whether uType is reserved for extension units.
+func IsExtensionType(uType uint8) bool {
+	return (uType >= 0x05 && uType <= 0x0F) || (uType >= 0xD0 && uType <= 0xEF)
+}
+
+// RegisterExtension registers codec for extension units of uType. It's meant
+// to be called from the init function of the package defining the unit.
+func RegisterExtension(uType uint8, codec ExtensionCodec) error {
+	if !IsExtensionType(uType) {
+		return fmt.Errorf("%w: type 0x%02X", errExtensionType, uType)
+	}
+
+	extLock.Lock()
+	defer extLock.Unlock()
+
+	if _, ok := extCodecs[uType]; ok {
+		return fmt.Errorf("%w: type 0x%02X", errDuplicatedExtension, uType)
+	}
+	extCodecs[uType] = codec
+	return nil
+}
+
+func extensionCodec(uType uint8) (ExtensionCodec, bool) {
+	extLock.RLock()
+	defer extLock.RUnlock()
+
+	codec, ok := extCodecs[uType]
+	return codec, ok
+}
+
+// ExtensionUnit is a unit of a reserved type. Data is the data part of the
+// unit as it's serialized.
+type ExtensionUnit struct {
+	UnitHeader
+
+	Data []byte
+
+	// after is 1 plus the number of other units that came before the unit
+	// when it was parsed, 0 if it was not parsed.
+	after int
+}
+
+// NewExtensionUnit encodes v by the codec registered for uType.
+func NewExtensionUnit(uType uint8, v interface{}) (ExtensionUnit, error) {
+	codec, ok := extensionCodec(uType)
+	if !ok {
+		return ExtensionUnit{}, fmt.Errorf("%w: type 0x%02X", errUnknownExtension, uType)
+	}
+	data, err := codec.Encode(v)
+	if err != nil {
+		return ExtensionUnit{}, err
+	}
+
+	return ExtensionUnit{
+		UnitHeader: UnitHeader{
+			Type:   uType,
+			Index:  0x01,
+			Length: uint32(len(data)),
+		},
+		Data: data,
+	}, nil
+}
+
+// Value decodes the data of eu by the codec registered for its type.
+func (eu *ExtensionUnit) Value() (interface{}, error) {
+	codec, ok := extensionCodec(eu.Type)
+	if !ok {
+		return nil, fmt.Errorf("%w: type 0x%02X", errUnknownExtension, eu.Type)
+	}
+	return codec.Decode(eu.Data)
+}
+
+func (eu *ExtensionUnit) Bytes() []byte {
+	buff := &bytes.Buffer{}
+
+	eu.UnitHeader.write(buff)
+	binary.Write(buff, binary.BigEndian, eu.Data)
+
+	return buff.Bytes()
+}
+
+func (eu *ExtensionUnit) validate() error {
+	if !IsExtensionType(eu.Type) {
+		return fmt.Errorf("%w: type 0x%02X", errExtensionType, eu.Type)
+	}
+	return checkUnit(eu.UnitHeader, eu.Bytes())
+}
+
+type ExtensionUnits []ExtensionUnit
+
+// Get returns the first extension unit of uType, or nil if there is none.
+func (eus ExtensionUnits) Get(uType uint8) *ExtensionUnit {
+	for i := range eus {
+		if eus[i].Type == uType {
+			return &eus[i]
+		}
+	}
+	return nil
+}
+
+func (eus *ExtensionUnits) Bytes() []byte {
+	buff := &bytes.Buffer{}
+	for _, eu := range *eus {
+		buff.Write(eu.Bytes())
+	}
+	return buff.Bytes()
+}
+
+// AddExtension appends eu to the extension units of cl. Units of the same type
+// are numbered by their index from 1.
+func (cl *CommonLicense) AddExtension(eu ExtensionUnit) {
+	eu.Index = 1
+	eu.after = 0
+	for _, e := range cl.Extensions {
+		if e.Type == eu.Type {
+			eu.Index++
+		}
+	}
+	cl.Extensions = append(cl.Extensions, eu)
+}
+
+// withExtensions inserts the extension units of cl into units, the other
+// units in order of serialization. Parsed extension units go back where they
+// were parsed from, others are appended.
+func (cl *CommonLicense) withExtensions(units [][]byte) [][]byte {
+	all := make([][]byte, 0, len(units)+len(cl.Extensions))
+	for pos := 0; pos <= len(units); pos++ {
+		for i := range cl.Extensions {
+			if cl.Extensions[i].after == pos+1 {
+				all = append(all, cl.Extensions[i].Bytes())
+			}
+		}
+		if pos < len(units) {
+			all = append(all, units[pos])
+		}
+	}
+	for i := range cl.Extensions {
+		if after := cl.Extensions[i].after; after == 0 || after > len(units)+1 {
+			all = append(all, cl.Extensions[i].Bytes())
+		}
+	}
+	return all
+}
+
+func parseExtension(hdr UnitHeader, d *decoder) (ExtensionUnit, error) {
+	eu := ExtensionUnit{
+		UnitHeader: hdr,
+		Data:       d.bytes(d.remaining()),
+	}
+	if err := d.done(); err != nil {
+		return eu, err
+	}
+
+	// Units of registered types must decode, others are kept as they are.
+	if codec, ok := extensionCodec(hdr.Type); ok {
+		if _, err := codec.Decode(eu.Data); err != nil {
+			return eu, fmt.Errorf("license: extension unit 0x%02X: %w", hdr.Type, err)
+		}
+	}
+	return eu, nil
+}
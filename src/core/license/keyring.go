@@ -0,0 +1,326 @@
+/*
+	Opendrm, an open source implementation of industry-grade DRM
+	(Digital Rights Management) or Key System.
+	Copyright (C) 2018  wilkk
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+/*
+	A Keyring holds the signing keys of a license server, each valid in a
+	window of [NotBefore, NotAfter). New licenses are signed by the current
+	key, the valid one that was scheduled last. A rollover schedules a new key
+	and ends the windows of the older keys an overlap after it, so that
+	licenses signed by them keep verifying until then. The certificate id of
+	the Signature unit tells which key signed a license.
+*/
+
+package license
+
+import (
+	"crypto"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+var (
+	errNoSigningKey  = errors.New("license: no signing key valid now")
+	errKeyWindow     = errors.New("license: signing key expires before it's valid")
+	errDuplicatedKey = errors.New("license: signing key with the certificate id exists")
+	errRolloverTime  = errors.New("license: rollover must come after the latest key")
+	errNoToken       = errors.New("license: no token is open for the token key")
+)
+
+// SigningKey is a signing key and its window of validity. Zero NotBefore or
+// NotAfter leaves that end open.
+type SigningKey struct {
+	Signer
+	NotBefore time.Time
+	NotAfter  time.Time
+}
+
+// SignWith signs under algId if the Signer of k is an AlgorithmSigner.
+func (k SigningKey) SignWith(algId uint8, data []byte) ([]byte, error) {
+	as, ok := k.Signer.(AlgorithmSigner)
+	if !ok {
+		if algId == k.AlgorithmId() {
+			return k.Sign(data)
+		}
+		return nil, fmt.Errorf("%w: 0x%02X", errUnknownAlgorithm, algId)
+	}
+	return as.SignWith(algId, data)
+}
+
+// ValidAt reports whether k is valid at t.
+func (k SigningKey) ValidAt(t time.Time) bool {
+	if !k.NotBefore.IsZero() && t.Before(k.NotBefore) {
+		return false
+	}
+	if !k.NotAfter.IsZero() && !t.Before(k.NotAfter) {
+		return false
+	}
+	return true
+}
+
+// Keyring is a set of signing keys, it's safe for concurrent use. It
+// implements CertResolver with the keys that have not expired.
+type Keyring struct {
+	lock sync.RWMutex
+	keys []SigningKey // sorted by NotBefore
+	now  func() time.Time
+	// tokens opens the token keys of reloaded specs.
+	tokens TokenKeys
+}
+
+func NewKeyring(keys ...SigningKey) (*Keyring, error) {
+	kr := &Keyring{
+		now: time.Now,
+	}
+	if err := kr.Set(keys); err != nil {
+		return nil, err
+	}
+
+	return kr, nil
+}
+
+// Set replaces the keys of kr, as when the keyring is reloaded.
+func (kr *Keyring) Set(keys []SigningKey) error {
+	certIds := map[string]bool{}
+	for _, k := range keys {
+		if !k.NotBefore.IsZero() && !k.NotAfter.IsZero() && !k.NotBefore.Before(k.NotAfter) {
+			return fmt.Errorf("%w: %q", errKeyWindow, k.CertificateId())
+		}
+		if certIds[k.CertificateId()] {
+			return fmt.Errorf("%w: %q", errDuplicatedKey, k.CertificateId())
+		}
+		certIds[k.CertificateId()] = true
+	}
+
+	sorted := append([]SigningKey{}, keys...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].NotBefore.Before(sorted[j].NotBefore)
+	})
+
+	kr.lock.Lock()
+	defer kr.lock.Unlock()
+
+	kr.keys = sorted
+	return nil
+}
+
+// Current returns the key that signs licenses now.
+func (kr *Keyring) Current() (SigningKey, error) {
+	kr.lock.RLock()
+	defer kr.lock.RUnlock()
+
+	now := kr.now()
+	for i := len(kr.keys) - 1; i >= 0; i-- {
+		if kr.keys[i].ValidAt(now) {
+			return kr.keys[i], nil
+		}
+	}
+	return SigningKey{}, errNoSigningKey
+}
+
+// Published returns the keys that have not expired, including the scheduled
+// ones, for clients to verify licenses by.
+func (kr *Keyring) Published() []SigningKey {
+	kr.lock.RLock()
+	defer kr.lock.RUnlock()
+
+	return published(kr.keys, kr.now())
+}
+
+// published returns the keys that have not expired at now.
+func published(keys []SigningKey, now time.Time) []SigningKey {
+	pub := []SigningKey{}
+	for _, k := range keys {
+		if k.NotAfter.IsZero() || now.Before(k.NotAfter) {
+			pub = append(pub, k)
+		}
+	}
+	return pub
+}
+
+func (kr *Keyring) PublicKey(certId string) (crypto.PublicKey, error) {
+	for _, k := range kr.Published() {
+		if k.CertificateId() == certId {
+			return k.Public(), nil
+		}
+	}
+	return nil, fmt.Errorf("license: unknown certificate id %q", certId)
+}
+
+// KeySpec is the persisted form of a signing key in a keyring file. The
+// private key is either a pem file, or a key in a token named by its CKA_ID.
+type KeySpec struct {
+	CertId    string    `json:"cert_id"`
+	KeyFile   string    `json:"key_file,omitempty"`  // private key in pem
+	TokenKey  string    `json:"token_key,omitempty"` // CKA_ID in the token
+	NotBefore time.Time `json:"not_before"`
+	NotAfter  time.Time `json:"not_after"`
+}
+
+// TokenKeys opens Signers of the private keys kept in a token, such as a
+// PKCS11Token.
+type TokenKeys interface {
+	// TokenSigner opens the Signer of the key whose CKA_ID is keyId.
+	TokenSigner(keyId, certId string) (Signer, error)
+}
+
+// ReadKeySpecs reads a keyring file, which is a JSON array of KeySpec. A
+// missing file is an empty keyring.
+func ReadKeySpecs(path string) ([]KeySpec, error) {
+	specs := []KeySpec{}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return specs, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &specs); err != nil {
+		return nil, err
+	}
+
+	return specs, nil
+}
+
+// WriteKeySpecs replaces the keyring file atomically.
+func WriteKeySpecs(path string, specs []KeySpec) error {
+	data, err := json.MarshalIndent(specs, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
+
+// LoadKeyring loads the private keys of specs. Relative key files are
+// relative to dir, token keys are opened by tokens, which may be nil if
+// there are none.
+func LoadKeyring(dir string, specs []KeySpec, tokens TokenKeys) (*Keyring, error) {
+	keys, err := loadSigningKeys(dir, specs, tokens)
+	if err != nil {
+		return nil, err
+	}
+
+	kr, err := NewKeyring(keys...)
+	if err != nil {
+		return nil, err
+	}
+	kr.tokens = tokens
+	return kr, nil
+}
+
+// Reload replaces the keys of kr by the ones of specs. If check is not nil,
+// every key that has not expired must pass it, or kr is left as it is, e.g.
+// to check the certificates of new keys.
+func (kr *Keyring) Reload(dir string, specs []KeySpec, check func(SigningKey) error) error {
+	keys, err := loadSigningKeys(dir, specs, kr.tokens)
+	if err != nil {
+		return err
+	}
+	if check != nil {
+		for _, k := range published(keys, kr.now()) {
+			if err := check(k); err != nil {
+				return err
+			}
+		}
+	}
+
+	return kr.Set(keys)
+}
+
+func loadSigningKeys(dir string, specs []KeySpec, tokens TokenKeys) ([]SigningKey, error) {
+	keys := []SigningKey{}
+	for _, spec := range specs {
+		var signer Signer
+		var err error
+		if spec.TokenKey != "" {
+			if tokens == nil {
+				return nil, fmt.Errorf("%w: %q", errNoToken, spec.TokenKey)
+			}
+			signer, err = tokens.TokenSigner(spec.TokenKey, spec.CertId)
+		} else {
+			keyFile := spec.KeyFile
+			if !filepath.IsAbs(keyFile) {
+				keyFile = filepath.Join(dir, keyFile)
+			}
+			signer, err = LoadPemSigner(keyFile, spec.CertId)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		keys = append(keys, SigningKey{
+			Signer:    signer,
+			NotBefore: spec.NotBefore,
+			NotAfter:  spec.NotAfter,
+		})
+	}
+
+	return keys, nil
+}
+
+// ScheduleRollover adds next to specs. next becomes the current key at
+// next.NotBefore, and every older key expires overlap after it, unless it
+// expires earlier.
+func ScheduleRollover(specs []KeySpec, next KeySpec, overlap time.Duration) ([]KeySpec, error) {
+	if next.NotBefore.IsZero() {
+		return nil, errRolloverTime
+	}
+
+	end := next.NotBefore.Add(overlap)
+	rolled := []KeySpec{}
+	for _, spec := range specs {
+		if spec.CertId == next.CertId {
+			return nil, fmt.Errorf("%w: %q", errDuplicatedKey, next.CertId)
+		}
+		if !next.NotBefore.After(spec.NotBefore) {
+			return nil, errRolloverTime
+		}
+		if spec.NotAfter.IsZero() || spec.NotAfter.After(end) {
+			spec.NotAfter = end
+		}
+		rolled = append(rolled, spec)
+	}
+
+	return append(rolled, next), nil
+}
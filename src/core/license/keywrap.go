@@ -0,0 +1,136 @@
+/*
+	Opendrm, an open source implementation of industry-grade DRM
+	(Digital Rights Management) or Key System.
+	Copyright (C) 2018  wilkk
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+/*
+	Content keys in Key units are encrypted by an upper key, which is a device
+	key or a business key. Key data is encrypted block by block (ECB) with the
+	block cipher given by AlgorithmId of the Key unit: AES-128, SM4-128 or
+	two-key 3DES (EDE, K1 K2 K1) with a 16 bytes upper key.
+*/
+
+package license
+
+import (
+	"core/crypto/sm4"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/des"
+	"errors"
+	"fmt"
+)
+
+var (
+	errKeyEncrypted   = errors.New("license: key is already encrypted")
+	errUpperKeyType   = errors.New("license: invalid upper key type")
+	errUpperKeyLen    = errors.New("license: invalid upper key length")
+	errKeyDataLen     = errors.New("license: key data is not a multiple of block size")
+	errUnknownKeyAlgo = errors.New("license: unsupported key encryption algorithm")
+)
+
+// UpperKey is the key used to encrypt content keys in Key units.
+type UpperKey struct {
+	Type        uint8  // keyTypeDevice or keyTypeBusiness
+	Id          string // id of the key, recorded as UpperKeyId of Key unit
+	Key         []byte // the key itself, never serialized
+	AlgorithmId uint8  // block cipher used to encrypt content keys
+}
+
+// NewDeviceKey returns an UpperKey of the device identified by deviceId.
+func NewDeviceKey(deviceId string, key []byte) UpperKey {
+	return UpperKey{
+		Type:        keyTypeDevice,
+		Id:          deviceId,
+		Key:         key,
+		AlgorithmId: algorithmBlockCipher_AES_128_128,
+	}
+}
+
+// NewBusinessKey returns an UpperKey shared by a business, like a group of
+// devices or a service operator.
+func NewBusinessKey(id string, key []byte) UpperKey {
+	return UpperKey{
+		Type:        keyTypeBusiness,
+		Id:          id,
+		Key:         key,
+		AlgorithmId: algorithmBlockCipher_AES_128_128,
+	}
+}
+
+func newKeyCipher(algId uint8, kek []byte) (cipher.Block, error) {
+	switch algId {
+	case algorithmBlockCipher_AES_128_128:
+		if len(kek) != 16 {
+			return nil, errUpperKeyLen
+		}
+		return aes.NewCipher(kek)
+	case algorithmBlockCipher_SM4_128:
+		if len(kek) != 16 {
+			return nil, errUpperKeyLen
+		}
+		return sm4.NewCipher(kek)
+	case algorithmBlockCipher_3DES_64_112:
+		if len(kek) != 16 {
+			return nil, errUpperKeyLen
+		}
+		ede := make([]byte, 0, 24)
+		ede = append(ede, kek...)
+		ede = append(ede, kek[:8]...)
+		return des.NewTripleDESCipher(ede)
+	default:
+		return nil, fmt.Errorf("%w: 0x%02X", errUnknownKeyAlgo, algId)
+	}
+}
+
+func wrapKey(algId uint8, kek, key []byte) ([]byte, error) {
+	block, err := newKeyCipher(algId, kek)
+	if err != nil {
+		return nil, err
+	}
+
+	bs := block.BlockSize()
+	if len(key) == 0 || len(key)%bs != 0 {
+		return nil, errKeyDataLen
+	}
+
+	out := make([]byte, len(key))
+	for i := 0; i < len(key); i += bs {
+		block.Encrypt(out[i:i+bs], key[i:i+bs])
+	}
+
+	return out, nil
+}
+
+func unwrapKey(algId uint8, kek, data []byte) ([]byte, error) {
+	block, err := newKeyCipher(algId, kek)
+	if err != nil {
+		return nil, err
+	}
+
+	bs := block.BlockSize()
+	if len(data) == 0 || len(data)%bs != 0 {
+		return nil, errKeyDataLen
+	}
+
+	out := make([]byte, len(data))
+	for i := 0; i < len(data); i += bs {
+		block.Decrypt(out[i:i+bs], data[i:i+bs])
+	}
+
+	return out, nil
+}
@@ -21,14 +21,8 @@ package license
 
 import (
 	"crypto"
-	"crypto/rsa"
-	"crypto/sha1"
-	"crypto/x509"
-	"encoding/pem"
 	"errors"
-	"io/ioutil"
-	"log"
-	"os"
+	"fmt"
 )
 
 const (
@@ -39,80 +33,97 @@ const (
 )
 
 type License interface {
-	Base64String() string
+	Base64String() (string, error)
 }
 
-var pemFilePath string
-
-func SetPemFile(pemFile string) error {
-	pemFilePath = pemFile
-	_, err := os.Stat(pemFile)
-	if err != nil {
-		log.Fatalf("Stat pem file failed. err=%s", err)
-		return err
-	}
+var (
+	errNoSignature       = errors.New("license: no signature unit")
+	errUnknownAlgorithm  = errors.New("license: unsupported signature algorithm")
+	errPublicKeyMismatch = errors.New("license: public key does not match signature algorithm")
+	errUnknownKey        = errors.New("license: unsupported signing key")
+	errVerification      = errors.New("license: signature verification failed")
+)
 
-	return nil
+// CertResolver looks up the public key of the certificate identified by
+// Signature.CertificatId.
+type CertResolver interface {
+	PublicKey(certId string) (crypto.PublicKey, error)
 }
 
-// Generate private key by command 'openssl genrsa -out rsa_private_key.pem 1024'
-// Generate public key by command 'openssl rsa -in rsa_private_key.pem -pubout -out rsa_public_key.pem'
-func Sign(bytes []byte) ([]byte, error) {
-	pkey, err := ioutil.ReadFile(pemFilePath)
-	if err != nil {
-		return nil, err
+// PublicKeys is a CertResolver backed by a map from certificate id to key.
+type PublicKeys map[string]crypto.PublicKey
+
+func (pks PublicKeys) PublicKey(certId string) (crypto.PublicKey, error) {
+	pub, ok := pks[certId]
+	if !ok {
+		return nil, fmt.Errorf("license: unknown certificate id %q", certId)
 	}
+	return pub, nil
+}
 
-	// Read private key from pem file
-	block, _ := pem.Decode(pkey)
-	if block == nil {
-		log.Fatalf("Decode pem failed.")
-		return nil, errors.New("no pem block found")
+// verifyLicense checks the trailing signature unit of data, which has already
+// been parsed into cl.
+func verifyLicense(data []byte, cl *CommonLicense, keys CertResolver) error {
+	sig := &cl.Signature
+	if sig.Type != unitTypeSignature {
+		return errNoSignature
 	}
 
-	privateKey, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+	pub, err := keys.PublicKey(string(sig.CertificatId))
 	if err != nil {
-		log.Fatalf("Parse private key failed. Err=%s", err)
-		return nil, err
+		return err
 	}
 
-	// Calculate hash of original data
-	digest := sha1.Sum(bytes)
+	// The parser guarantees that the signature unit is the last one, so the
+	// signed body is everything before it.
+	body := data[:len(data)-unitHeaderSize(cl.Header.Version)-int(sig.Length)]
+
+	return verifySignature(sig.AlgorithmId, pub, body, sig.SignatureData)
+}
 
-	sig, err := rsa.SignPKCS1v15(nil, privateKey, crypto.SHA1, digest[:])
+// VerifyLicense parses the binary form of a common license and verifies its
+// signature unit against the public key that keys resolves for
+// Signature.CertificatId. The license is returned only if it verifies.
+func VerifyLicense(data []byte, keys CertResolver) (*CommonLicense, error) {
+	cl, err := ParseCommonLicense(data)
 	if err != nil {
-		log.Fatalf("Sign failed. Err=%s", err)
 		return nil, err
 	}
 
-	return sig, nil
+	if err := verifyLicense(data, cl, keys); err != nil {
+		return nil, err
+	}
+
+	return cl, nil
 }
 
-func Verify(hashed []byte, signature []byte) error {
-	pkey, err := ioutil.ReadFile(pemFilePath)
+// VerifyRegisteredLicense verifies data as VerifyLicense does, and checks
+// that the license is registered in reg and not revoked, e.g. before it's
+// renewed.
+func VerifyRegisteredLicense(data []byte, keys CertResolver, reg Registry) (*CommonLicense, Record, error) {
+	cl, err := VerifyLicense(data, keys)
 	if err != nil {
-		log.Fatalf("ReadFile failed. Err=%x", err)
-		return err
+		return nil, Record{}, err
 	}
 
-	// Decode public key from pem file
-	block, _ := pem.Decode(pkey)
-	if block == nil {
-		log.Fatalf("Decode pem failed.")
-		return errors.New("No pem block found.")
+	r, err := CheckRegistered(reg, cl)
+	if err != nil {
+		return nil, Record{}, err
 	}
 
-	pubKey, err := x509.ParsePKIXPublicKey(block.Bytes)
+	return cl, r, nil
+}
+
+// VerifyChinaDrmLicense is the ChinaDRM counterpart of VerifyLicense.
+func VerifyChinaDrmLicense(data []byte, keys CertResolver) (*ChinaDrmLicense, error) {
+	cdl, err := ParseChinaDrmLicense(data)
 	if err != nil {
-		log.Fatalf("Parse public key failed. Err=%s", err)
-		return err
+		return nil, err
 	}
 
-	err = rsa.VerifyPKCS1v15(pubKey.(*rsa.PublicKey), crypto.SHA1, hashed, signature)
-	if err != nil {
-		log.Fatalf("Verify signature failed. Err=%s", err)
-		return err
+	if err := verifyLicense(data, &cdl.CommonLicense, keys); err != nil {
+		return nil, err
 	}
 
-	return nil
+	return cdl, nil
 }
@@ -20,24 +20,54 @@
 package license
 
 import (
-	"crypto/sha1"
+	"bytes"
+	"core/crypto/sm2"
+	"core/key"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
+const (
+	privatePemFile = "../../../test/rsa_private_key.pem"
+	publicPemFile  = "../../../test/rsa_public_key.pem"
+)
+
+func loadSigner(t *testing.T) Signer {
+	signer, err := LoadPemSigner(privatePemFile, "")
+	if err != nil {
+		t.Fatalf("LoadPemSigner failed. err=%s", err)
+	}
+	return signer
+}
+
 var comnLicenseSig []byte
-var hashed []byte
+var comnLicenseBody []byte
 func TestNewCommonLicense(t *testing.T) {
 	kids := []string{"123456789", "987345678"}
 	objs := []string{"579de65b-67af-4041-9267-3db266102964", "7429c039-c614-489e-af15-1f109cc4f908"}
 	certId := "b8c35868-4b94-4ad9-a0bc-c85e9a03b1de"
 	cl := NewCommonLicense(kids, objs, certId)
 
-	sum := sha1.Sum(cl.Serialize(false, false))
-	hashed = sum[:]
-
-	SetPemFile("/media/sf_win_d/goprojects/opendrm/test/rsa_private_key.pem")
-	comnLicenseSig, _ = cl.Sign(false)
-	//t.Logf("common license: %s", cl.Base64String())
+	comnLicenseBody = cl.Serialize(false, false)
+	sig, err := cl.Sign(loadSigner(t), false)
+	if err != nil {
+		t.Fatalf("Sign failed. err=%s", err)
+	}
+	comnLicenseSig = sig
+	//t.Logf("common license: %x", cl.Serialize(true, true))
 }
 
 func TestNewChinaDrmLicense(t *testing.T) {
@@ -46,17 +76,1294 @@ func TestNewChinaDrmLicense(t *testing.T) {
 	certId := "b8c35868-4b94-4ad9-a0bc-c85e9a03b1de"
 	cdl := NewChinaDrmLicense(12345678900, kids, objs, certId)
 
-	SetPemFile("/media/sf_win_d/goprojects/opendrm/test/rsa_private_key.pem")
-	cdl.Sign(false)
-	//t.Logf("chinadrm license: %s", cdl.Base64String())
+	if err := cdl.Sign(loadSigner(t), false); err != nil {
+		t.Fatalf("Sign failed. err=%s", err)
+	}
+	//t.Logf("chinadrm license: %x", cdl.Serialize(true, true))
 }
 
 func TestVerify(t *testing.T) {
-	SetPemFile("/media/sf_win_d/goprojects/opendrm/test/rsa_public_key.pem")
-	err := Verify(hashed, comnLicenseSig)
+	data, err := ioutil.ReadFile(publicPemFile)
+	if err != nil {
+		t.Fatalf("ReadFile failed. err=%s", err)
+	}
+	pub, err := ParsePublicKeyPem(data)
+	if err != nil {
+		t.Fatalf("ParsePublicKeyPem failed. err=%s", err)
+	}
+
+	err = NewVerifier(pub).Verify(algorithmSignature_RSA_SHA1_1024, comnLicenseBody, comnLicenseSig)
 	if err != nil {
 		t.Fatalf("Verify failed.")
 	} else {
 		t.Logf("Verify ok.")
 	}
 }
+
+func TestParseCommonLicense(t *testing.T) {
+	kids := []string{"123456789", "987345678"}
+	objs := []string{"579de65b-67af-4041-9267-3db266102964"}
+	certId := "b8c35868-4b94-4ad9-a0bc-c85e9a03b1de"
+	cl := NewCommonLicense(kids, objs, certId)
+
+	if _, err := cl.Sign(loadSigner(t), false); err != nil {
+		t.Fatalf("Sign failed. err=%s", err)
+	}
+	data := cl.Serialize(false, true)
+
+	parsed, err := ParseCommonLicense(data)
+	if err != nil {
+		t.Fatalf("Parse failed. err=%s", err)
+	}
+	if parsed.Header != cl.Header {
+		t.Fatalf("header mismatch. got %+v, want %+v", parsed.Header, cl.Header)
+	}
+	if len(parsed.Keys) != len(kids) || len(parsed.Policys) != len(kids) ||
+		len(parsed.Objects) != len(objs) || len(parsed.Rights) != 1 {
+		t.Fatalf("units mismatch. got %+v", parsed)
+	}
+	if !bytes.Equal(parsed.Keys[1].KeyData, cl.Keys[1].KeyData) {
+		t.Fatalf("key data mismatch.")
+	}
+	if !bytes.Equal(parsed.Signature.SignatureData, cl.Signature.SignatureData) {
+		t.Fatalf("signature mismatch.")
+	}
+	if !bytes.Equal(parsed.Serialize(false, true), data) {
+		t.Fatalf("round trip mismatch.")
+	}
+}
+
+func TestParseChinaDrmLicense(t *testing.T) {
+	kids := []string{"12349857423", "34567847562"}
+	objs := []string{"579de65b-67af-4041-9267-3db266102964"}
+	certId := "b8c35868-4b94-4ad9-a0bc-c85e9a03b1de"
+	cdl := NewChinaDrmLicense(12345678900, kids, objs, certId)
+
+	if err := cdl.Sign(loadSigner(t), false); err != nil {
+		t.Fatalf("Sign failed. err=%s", err)
+	}
+	data := cdl.Serialize(false, true)
+
+	parsed, err := ParseChinaDrmLicense(data)
+	if err != nil {
+		t.Fatalf("Parse failed. err=%s", err)
+	}
+	if len(parsed.Contents) != 1 || parsed.Contents[0].ContentId != 12345678900 || len(parsed.Contents[0].Keys) != len(kids) {
+		t.Fatalf("content mismatch. got %+v", parsed.Contents)
+	}
+	if !bytes.Equal(parsed.Serialize(false, true), data) {
+		t.Fatalf("round trip mismatch.")
+	}
+
+	if _, err := ParseCommonLicense(data); err == nil {
+		t.Fatalf("content unit accepted in common license.")
+	}
+	if _, err := ParseChinaDrmLicense(data[:len(data)-1]); err == nil {
+		t.Fatalf("truncated license accepted.")
+	}
+}
+
+func loadPublicKeys(t *testing.T, certId string) PublicKeys {
+	data, err := ioutil.ReadFile(publicPemFile)
+	if err != nil {
+		t.Fatalf("ReadFile failed. err=%s", err)
+	}
+	block, _ := pem.Decode(data)
+	pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		t.Fatalf("Parse public key failed. err=%s", err)
+	}
+	return PublicKeys{certId: pub}
+}
+
+func TestVerifyLicense(t *testing.T) {
+	kids := []string{"123456789", "987345678"}
+	objs := []string{"579de65b-67af-4041-9267-3db266102964"}
+	certId := "b8c35868-4b94-4ad9-a0bc-c85e9a03b1de"
+	cl := NewCommonLicense(kids, objs, certId)
+
+	if _, err := cl.Sign(loadSigner(t), false); err != nil {
+		t.Fatalf("Sign failed. err=%s", err)
+	}
+	data := cl.Serialize(false, true)
+	keys := loadPublicKeys(t, certId)
+
+	verified, err := VerifyLicense(data, keys)
+	if err != nil {
+		t.Fatalf("VerifyLicense failed. err=%s", err)
+	}
+	if verified.Header.Id != cl.Header.Id {
+		t.Fatalf("license id mismatch.")
+	}
+
+	tampered := append([]byte{}, data...)
+	tampered[20] ^= 0x01
+	if _, err := VerifyLicense(tampered, keys); err == nil {
+		t.Fatalf("tampered license verified.")
+	}
+
+	if _, err := VerifyLicense(data, PublicKeys{}); err == nil {
+		t.Fatalf("license verified with unknown certificate.")
+	}
+
+	if _, err := VerifyLicense(cl.Serialize(false, false), keys); err != errNoSignature {
+		t.Fatalf("unsigned license: got err=%v, want %v", err, errNoSignature)
+	}
+
+	reg := NewMemoryRegistry()
+	if _, _, err := VerifyRegisteredLicense(data, keys, reg); err != errUnknownId {
+		t.Fatalf("unregistered license: err=%v", err)
+	}
+	reg.Register(NewRecord(cl, "device-1"))
+	if _, r, err := VerifyRegisteredLicense(data, keys, reg); err != nil || r.DeviceId != "device-1" {
+		t.Fatalf("VerifyRegisteredLicense failed. record %+v, err=%v", r, err)
+	}
+	reg.Revoke(cl.Header.Id)
+	if _, _, err := VerifyRegisteredLicense(data, keys, reg); !errors.Is(err, errRevoked) {
+		t.Fatalf("revoked license: err=%v", err)
+	}
+}
+
+func TestVerifyChinaDrmLicense(t *testing.T) {
+	kids := []string{"12349857423", "34567847562"}
+	objs := []string{"579de65b-67af-4041-9267-3db266102964"}
+	certId := "b8c35868-4b94-4ad9-a0bc-c85e9a03b1de"
+	cdl := NewChinaDrmLicense(12345678900, kids, objs, certId)
+
+	if err := cdl.Sign(loadSigner(t), false); err != nil {
+		t.Fatalf("Sign failed. err=%s", err)
+	}
+
+	if _, err := VerifyChinaDrmLicense(cdl.Serialize(false, true), loadPublicKeys(t, certId)); err != nil {
+		t.Fatalf("VerifyChinaDrmLicense failed. err=%s", err)
+	}
+}
+
+func TestEncryptKeys(t *testing.T) {
+	kids := []string{"123456789", "987345678"}
+	objs := []string{"579de65b-67af-4041-9267-3db266102964"}
+	certId := "b8c35868-4b94-4ad9-a0bc-c85e9a03b1de"
+	cl := NewCommonLicense(kids, objs, certId)
+	clearKey := append([]byte{}, cl.Keys[0].KeyData...)
+
+	deviceKey := []byte("0123456789abcdef")
+	if err := cl.EncryptKeys(NewDeviceKey("device-1", deviceKey)); err != nil {
+		t.Fatalf("EncryptKeys failed. err=%s", err)
+	}
+	if err := cl.Keys[0].Encrypt(NewDeviceKey("device-1", deviceKey)); err != errKeyEncrypted {
+		t.Fatalf("key encrypted twice. err=%v", err)
+	}
+
+	parsed, err := ParseCommonLicense(cl.Serialize(false, false))
+	if err != nil {
+		t.Fatalf("Parse failed. err=%s", err)
+	}
+	k := parsed.Keys[0]
+	if bytes.Equal(k.KeyData, clearKey) {
+		t.Fatalf("key data issued in clear.")
+	}
+	if k.UpperKeyType != keyTypeDevice || string(k.UpperKeyId) != "device-1" ||
+		k.AlgorithmId != algorithmBlockCipher_AES_128_128 {
+		t.Fatalf("upper key info mismatch. got %+v", k)
+	}
+
+	ck, err := k.Decrypt(deviceKey)
+	if err != nil {
+		t.Fatalf("Decrypt failed. err=%s", err)
+	}
+	if !bytes.Equal(ck, clearKey) {
+		t.Fatalf("decrypted key mismatch. got %x, want %x", ck, clearKey)
+	}
+
+	if _, err := NewEncryptedKey("kid", clearKey, NewBusinessKey("biz", []byte("short"))); err != errUpperKeyLen {
+		t.Fatalf("short upper key accepted. err=%v", err)
+	}
+}
+
+func TestKeyWrapAlgorithms(t *testing.T) {
+	kek, _ := hex.DecodeString("000102030405060708090a0b0c0d0e0f")
+	key, _ := hex.DecodeString("00112233445566778899aabbccddeeff")
+	// Checked with 'openssl enc -<cipher>-ecb -nopad'.
+	cases := []struct {
+		algId uint8
+		out   string
+	}{
+		{algorithmBlockCipher_AES_128_128, "69c4e0d86a7b0430d8cdb78070b4c55a"},
+		{algorithmBlockCipher_SM4_128, "74c046048161bbf3d4ceff33d3f429be"},
+		{algorithmBlockCipher_3DES_64_112, "d117bd6373549faa2ca972dffa10114d"},
+	}
+	for _, c := range cases {
+		upper := NewDeviceKey("device-1", kek)
+		upper.AlgorithmId = c.algId
+		k, err := NewEncryptedKey("kid", key, upper)
+		if err != nil {
+			t.Fatalf("NewEncryptedKey of 0x%02X failed. err=%s", c.algId, err)
+		}
+		if got := hex.EncodeToString(k.KeyData); got != c.out {
+			t.Fatalf("key wrapped by 0x%02X = %s, want %s", c.algId, got, c.out)
+		}
+
+		// The algorithm is taken from the Key unit.
+		cl := NewCommonLicense(nil, nil, "cert")
+		cl.Keys = Keys{k}
+		parsed, err := ParseCommonLicense(cl.Serialize(false, false))
+		if err != nil {
+			t.Fatalf("Parse failed. err=%s", err)
+		}
+		clear, err := parsed.Keys[0].Decrypt(kek)
+		if err != nil || !bytes.Equal(clear, key) {
+			t.Fatalf("unwrap by 0x%02X failed. got %x, err=%v", c.algId, clear, err)
+		}
+	}
+
+	upper := NewDeviceKey("device-1", kek)
+	upper.AlgorithmId = algorithmStreamCipher_RC4
+	if _, err := NewEncryptedKey("kid", key, upper); !errors.Is(err, errUnknownKeyAlgo) {
+		t.Fatalf("RC4 accepted. err=%v", err)
+	}
+}
+
+func TestKeysMapToKid(t *testing.T) {
+	kids := []string{"123456789", "987345678", "3bff1f0c-0b16-4641-84af-8832f1cd37b5"}
+	cl := NewCommonLicense(kids, nil, "b8c35868-4b94-4ad9-a0bc-c85e9a03b1de")
+
+	parsed, err := ParseCommonLicense(cl.Serialize(false, false))
+	if err != nil {
+		t.Fatalf("Parse failed. err=%s", err)
+	}
+
+	keygen := key.NewKeyGenerator(nil)
+	for i, kid := range kids {
+		k := parsed.Keys.Get(kid)
+		if k == nil {
+			t.Fatalf("key of kid %s not found.", kid)
+		}
+		if k.Index != uint8(i+1) || k.KeyType != keyTypeContent {
+			t.Fatalf("key unit mismatch. got %+v", k)
+		}
+		if int(k.Length) != len(k.Bytes())-unitHeaderLen {
+			t.Fatalf("key unit length %d mismatch.", k.Length)
+		}
+		if !bytes.Equal(k.KeyData, keygen.GenKeyByDefaultSeed(kid)) {
+			t.Fatalf("key data of kid %s mismatch.", kid)
+		}
+	}
+	if parsed.Keys.Get("unknown") != nil {
+		t.Fatalf("unknown kid found.")
+	}
+}
+
+func TestPolicyBuilder(t *testing.T) {
+	start := time.Unix(1500000000, 0)
+	end := start.AddDate(0, 0, 30)
+	plc, err := NewPolicyBuilder("123456789").
+		StartTime(start).
+		EndTime(end).
+		PlayTimes(3).
+		TimeSpan(48 * time.Hour).
+		AccuTimeSpan(2 * time.Hour).
+		PlayTimes(5).
+		Build()
+	if err != nil {
+		t.Fatalf("Build failed. err=%s", err)
+	}
+	if plc.KeyRulesNum != 5 || len(plc.KeyRules) != 5 {
+		t.Fatalf("rules num mismatch. got %d", plc.KeyRulesNum)
+	}
+
+	cl := NewCommonLicense([]string{"123456789", "987345678"}, nil, "cert")
+	cl.SetPolicy(plc)
+	parsed, err := ParseCommonLicense(cl.Serialize(false, false))
+	if err != nil {
+		t.Fatalf("Parse failed. err=%s", err)
+	}
+	if len(parsed.Policys) != 2 || parsed.Policys[0].Index != 1 {
+		t.Fatalf("policys mismatch. got %+v", parsed.Policys)
+	}
+
+	rules, err := parsed.Policys[0].Rules()
+	if err != nil {
+		t.Fatalf("Rules failed. err=%s", err)
+	}
+	if !rules.StartTime.Equal(start) || !rules.EndTime.Equal(end) ||
+		*rules.PlayTimes != 5 || *rules.TimeSpan != 48*time.Hour ||
+		*rules.AccuTimeSpan != 2*time.Hour {
+		t.Fatalf("rules mismatch. got %+v", rules)
+	}
+
+	rules, err = parsed.Policys[1].Rules()
+	if err != nil {
+		t.Fatalf("Rules failed. err=%s", err)
+	}
+	if rules.StartTime == nil || rules.EndTime == nil || rules.PlayTimes != nil {
+		t.Fatalf("default rules mismatch. got %+v", rules)
+	}
+
+	if _, err := NewPolicyBuilder("kid").StartTime(end).EndTime(start).Build(); err != errRuleWindow {
+		t.Fatalf("reversed window accepted. err=%v", err)
+	}
+	if _, err := NewPolicyBuilder("kid").StartTime(time.Unix(-1, 0)).Build(); err == nil {
+		t.Fatalf("time before 1970 accepted.")
+	}
+}
+
+func TestRights(t *testing.T) {
+	start := time.Unix(1500000000, 0)
+	end := start.Add(24 * time.Hour)
+
+	playTime, err := NewPlayTimeRight(2 * time.Hour)
+	if err != nil {
+		t.Fatalf("NewPlayTimeRight failed. err=%s", err)
+	}
+	playInterval, err := NewPlayIntervalRight(start, end)
+	if err != nil {
+		t.Fatalf("NewPlayIntervalRight failed. err=%s", err)
+	}
+	recordTime, err := (&RightSpec{Type: "record_time", Seconds: 600}).Right()
+	if err != nil {
+		t.Fatalf("RightSpec failed. err=%s", err)
+	}
+
+	cl := NewCommonLicense([]string{"123456789"}, nil, "cert")
+	cl.SetRights(NewPlayTimesRight(3), playTime, playInterval, recordTime, NewCopyRight())
+	parsed, err := ParseCommonLicense(cl.Serialize(false, false))
+	if err != nil {
+		t.Fatalf("Parse failed. err=%s", err)
+	}
+	rs := parsed.Rights
+	if len(rs) != 5 || rs[4].Index != 5 {
+		t.Fatalf("rights mismatch. got %+v", rs)
+	}
+
+	if n, err := rs[0].Times(); err != nil || n != 3 {
+		t.Fatalf("Times mismatch. got %d, err=%v", n, err)
+	}
+	if d, err := rs[1].Duration(); err != nil || d != 2*time.Hour {
+		t.Fatalf("Duration mismatch. got %s, err=%v", d, err)
+	}
+	if s, e, err := rs[2].Interval(); err != nil || !s.Equal(start) || !e.Equal(end) {
+		t.Fatalf("Interval mismatch. got %s-%s, err=%v", s, e, err)
+	}
+	if d, err := rs[3].Duration(); err != nil || d != 10*time.Minute {
+		t.Fatalf("record Duration mismatch. got %s, err=%v", d, err)
+	}
+	if _, err := rs[4].Times(); err != errRightNoTimes {
+		t.Fatalf("copy right has times. err=%v", err)
+	}
+
+	if _, err := NewRecordIntervalRight(end, start); err != errRightInterval {
+		t.Fatalf("reversed interval accepted. err=%v", err)
+	}
+	if _, err := (&RightSpec{Type: "super"}).Right(); err == nil {
+		t.Fatalf("super right asked for.")
+	}
+	bad := NewRight(rightsTypePlayTimes, []byte{0x01})
+	if err := bad.Validate(); err == nil {
+		t.Fatalf("short rights data accepted.")
+	}
+	unknown := NewRight(0x16, nil)
+	if err := unknown.Validate(); err == nil {
+		t.Fatalf("unknown rights type accepted.")
+	}
+
+	protected := NewRight(rightsTypePlayProtected, []byte{2})
+	if l, err := protected.Level(); err != nil || l != 2 {
+		t.Fatalf("Level mismatch. got %d, err=%v", l, err)
+	}
+	quality := NewRight(rightsTypePlayQuality, []byte{4})
+	if err := quality.Validate(); !errors.Is(err, errRightLevel) {
+		t.Fatalf("quality 4 accepted. err=%v", err)
+	}
+	times := NewRight(rightsTypeTimes, []byte{0, 0, 0, 7})
+	if n, err := times.Times(); err != nil || n != 7 {
+		t.Fatalf("by times mismatch. got %d, err=%v", n, err)
+	}
+	if times.Grants(ActionPlay) {
+		t.Fatalf("by times right grants play.")
+	}
+}
+
+func TestEntitlement(t *testing.T) {
+	e := Entitlement{
+		{Type: "play_times", Times: 3},
+		{Type: "record_interval", Start: 1000, End: 2000},
+		{Type: "record_time", Seconds: 600},
+		{Type: "store"},
+	}
+	allowed := []RightSpec{
+		{Type: "play_times", Times: 3},
+		{Type: "play_times", Times: 1},
+		{Type: "record_interval", Start: 1500, End: 2000},
+		{Type: "record_time", Seconds: 60},
+		{Type: "store"},
+	}
+	for _, rs := range allowed {
+		if err := e.Check(rs); err != nil {
+			t.Fatalf("Check of %+v failed. err=%s", rs, err)
+		}
+	}
+	denied := []RightSpec{
+		{Type: "play"},
+		{Type: "play_times", Times: 4},
+		{Type: "play_time", Seconds: 60},
+		{Type: "record"},
+		{Type: "record_interval", Start: 500, End: 1500},
+		{Type: "record_time", Seconds: 601},
+		{Type: "copy"},
+	}
+	for _, rs := range denied {
+		if err := e.Check(rs); !errors.Is(err, errNotEntitled) {
+			t.Fatalf("Check of %+v: err=%v", rs, err)
+		}
+	}
+
+	// An unlimited right entitles its limited forms.
+	e = Entitlement{{Type: "play"}}
+	for _, rs := range []RightSpec{{Type: "play"}, {Type: "play_time", Seconds: 7200}, {Type: "play_interval", Start: 1, End: 2}} {
+		if err := e.Check(rs); err != nil {
+			t.Fatalf("Check of %+v failed. err=%s", rs, err)
+		}
+	}
+	if err := e.Check(RightSpec{Type: "record_time", Seconds: 1}); err == nil {
+		t.Fatalf("record entitled by play.")
+	}
+}
+
+func TestCounters(t *testing.T) {
+	certId := "b8c35868-4b94-4ad9-a0bc-c85e9a03b1de"
+	cl := NewCommonLicense([]string{"123456789"}, nil, certId)
+	cl.SetRights(NewPlayRight(), NewRecordRight(), NewCopyRight())
+
+	if ok, _ := cl.Allowed(ActionCopy); !ok {
+		t.Fatalf("copy not allowed without counters.")
+	}
+
+	// play or record, but not copy
+	cl.AddCounter(NewOrCounter(1, 2))
+	cl.AddCounter(NewNotCounter(3))
+
+	if _, err := cl.Sign(loadSigner(t), true); err != nil {
+		t.Fatalf("Sign failed. err=%s", err)
+	}
+	str, err := cl.Base64String()
+	if err != nil {
+		t.Fatalf("Base64String failed. err=%s", err)
+	}
+	data, err := base64.StdEncoding.DecodeString(str)
+	if err != nil {
+		t.Fatalf("Decode failed. err=%s", err)
+	}
+	parsed, err := VerifyLicense(data, loadPublicKeys(t, certId))
+	if err != nil {
+		t.Fatalf("VerifyLicense failed. err=%s", err)
+	}
+	if len(parsed.Counters) != 2 || parsed.Counters[1].Index != 2 {
+		t.Fatalf("counters mismatch. got %+v", parsed.Counters)
+	}
+
+	cases := []struct {
+		action  Action
+		allowed bool
+	}{
+		{ActionPlay, true},
+		{ActionRecord, true},
+		{ActionCopy, false},
+		{ActionStore, false},
+	}
+	for _, c := range cases {
+		ok, err := parsed.Allowed(c.action)
+		if err != nil {
+			t.Fatalf("Allowed failed. err=%s", err)
+		}
+		if ok != c.allowed {
+			t.Fatalf("action 0x%02X: got %v, want %v", c.action, ok, c.allowed)
+		}
+	}
+
+	xor := NewXorCounter(1, 2)
+	if ok, _ := xor.Eval(NewRights(NewPlayRight(), NewPlayTimesRight(1)), ActionPlay); ok {
+		t.Fatalf("xor of two play rights is true.")
+	}
+	and := NewAndCounter(1, 4)
+	if _, err := and.Eval(parsed.Rights, ActionPlay); err == nil {
+		t.Fatalf("unknown rights index accepted.")
+	}
+}
+
+func TestLicenseIdAndUnitsNum(t *testing.T) {
+	kids := []string{"123456789", "987345678"}
+	objs := []string{"579de65b-67af-4041-9267-3db266102964"}
+	cl1 := NewCommonLicense(kids, objs, "cert")
+	cl2 := NewCommonLicense(kids, objs, "cert")
+	if cl1.Header.Id == cl2.Header.Id {
+		t.Fatalf("two licenses share id %d.", cl1.Header.Id)
+	}
+
+	cl1.AddCounter(NewOrCounter(1))
+	if _, err := cl1.Sign(loadSigner(t), true); err != nil {
+		t.Fatalf("Sign failed. err=%s", err)
+	}
+	parsed, err := ParseCommonLicense(cl1.Serialize(true, true))
+	if err != nil {
+		t.Fatalf("Parse failed. err=%s", err)
+	}
+	// keys, objects, rights, policys, counters and signature
+	units := len(parsed.Keys) + len(parsed.Objects) + len(parsed.Rights) +
+		len(parsed.Policys) + len(parsed.Counters) + 1
+	if units != 8 || int(parsed.Header.UnitsNum) != units {
+		t.Fatalf("units num mismatch. got %d, want %d", parsed.Header.UnitsNum, units)
+	}
+
+	many := make([]string, 200)
+	for i := range many {
+		many[i] = "kid"
+	}
+	if _, err := NewCommonLicense(many, nil, "cert").Sign(loadSigner(t), false); err != errTooManyUnits {
+		t.Fatalf("too many units signed. err=%v", err)
+	}
+
+	SetIdAllocator(NewMonotonicIdAllocator(100))
+	defer SetIdAllocator(RandomIdAllocator{})
+	if id := NewCommonLicense(kids, nil, "cert").Header.Id; id != 101 {
+		t.Fatalf("monotonic id: got %d, want 101", id)
+	}
+}
+
+func TestFileRegistry(t *testing.T) {
+	dir, err := ioutil.TempDir("", "registry")
+	if err != nil {
+		t.Fatalf("TempDir failed. err=%s", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "licenses.jsonl")
+
+	reg, err := OpenFileRegistry(path)
+	if err != nil {
+		t.Fatalf("OpenFileRegistry failed. err=%s", err)
+	}
+	cl := NewCommonLicense([]string{"123456789"}, nil, "cert")
+	if err := reg.Register(NewRecord(cl, "device-1")); err != nil {
+		t.Fatalf("Register failed. err=%s", err)
+	}
+	if err := reg.Register(NewRecord(cl, "device-2")); err != errDuplicatedId {
+		t.Fatalf("duplicated id registered. err=%v", err)
+	}
+	if err := reg.Revoke(cl.Header.Id); err != nil {
+		t.Fatalf("Revoke failed. err=%s", err)
+	}
+	reg.Close()
+
+	reg, err = OpenFileRegistry(path)
+	if err != nil {
+		t.Fatalf("OpenFileRegistry failed. err=%s", err)
+	}
+	defer reg.Close()
+	r, err := reg.Lookup(cl.Header.Id)
+	if err != nil {
+		t.Fatalf("Lookup failed. err=%s", err)
+	}
+	if r.DeviceId != "device-1" || !r.Revoked || len(r.Kids) != 1 {
+		t.Fatalf("record mismatch. got %+v", r)
+	}
+	if reg.MaxId() != cl.Header.Id {
+		t.Fatalf("max id mismatch.")
+	}
+	if _, err := reg.Lookup(cl.Header.Id + 1); err != errUnknownId {
+		t.Fatalf("unknown id found. err=%v", err)
+	}
+
+	// A revocation that isn't written leaves the license valid.
+	cl = NewCommonLicense([]string{"123456789"}, nil, "cert")
+	reg.Register(NewRecord(cl, "device-1"))
+	reg.file.Close()
+	if err := reg.Revoke(cl.Header.Id); err == nil {
+		t.Fatalf("Revoke on closed file succeeded.")
+	}
+	if r, _ := reg.Lookup(cl.Header.Id); r.Revoked {
+		t.Fatalf("revoked in memory only.")
+	}
+}
+
+func writePem(t *testing.T, dir, name, pemType string, der []byte) string {
+	path := filepath.Join(dir, name)
+	data := pem.EncodeToMemory(&pem.Block{Type: pemType, Bytes: der})
+	if err := ioutil.WriteFile(path, data, 0600); err != nil {
+		t.Fatalf("WriteFile failed. err=%s", err)
+	}
+	return path
+}
+
+func TestSignatureAlgorithms(t *testing.T) {
+	dir, err := ioutil.TempDir("", "license")
+	if err != nil {
+		t.Fatalf("TempDir failed. err=%s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("GenerateKey failed. err=%s", err)
+	}
+	rsaDer, _ := x509.MarshalPKCS8PrivateKey(rsaKey)
+
+	type signatureCase struct {
+		pemFile string
+		pub     crypto.PublicKey
+		algId   uint8
+	}
+	cases := []signatureCase{
+		{writePem(t, dir, "rsa.pem", "PRIVATE KEY", rsaDer), &rsaKey.PublicKey, algorithmSignature_RSA_SHA1_2048},
+	}
+	// SM2 private keys need the gmsm build tag.
+	if sm2.PrivateKeys() {
+		sm2Key, err := sm2.GenerateKey(rand.Reader)
+		if err != nil {
+			t.Fatalf("GenerateKey failed. err=%s", err)
+		}
+		sm2Der, _ := sm2.MarshalPKCS8PrivateKey(sm2Key)
+		cases = append(cases, signatureCase{writePem(t, dir, "sm2.pem", "PRIVATE KEY", sm2Der), &sm2Key.PublicKey, algorithmSignature_SM2_256})
+	}
+	for _, c := range cases {
+		certId := "b8c35868-4b94-4ad9-a0bc-c85e9a03b1de"
+		cl := NewCommonLicense([]string{"123456789"}, nil, certId)
+		signer, err := LoadPemSigner(c.pemFile, "")
+		if err != nil {
+			t.Fatalf("LoadPemSigner failed. err=%s", err)
+		}
+		if _, err := cl.Sign(signer, true); err != nil {
+			t.Fatalf("Sign failed. err=%s", err)
+		}
+		data := cl.Serialize(true, true)
+
+		parsed, err := VerifyLicense(data, PublicKeys{certId: c.pub})
+		if err != nil {
+			t.Fatalf("VerifyLicense of algorithm 0x%02X failed. err=%s", c.algId, err)
+		}
+		if parsed.Signature.AlgorithmId != c.algId {
+			t.Fatalf("algorithm mismatch. got 0x%02X, want 0x%02X", parsed.Signature.AlgorithmId, c.algId)
+		}
+
+		data[10] ^= 0x01
+		if _, err := VerifyLicense(data, PublicKeys{certId: c.pub}); err == nil {
+			t.Fatalf("tampered license of algorithm 0x%02X verified.", c.algId)
+		}
+	}
+
+	// RSA 2048 with SHA-256 is used only if the client negotiates it, and only
+	// by a key that can sign under it.
+	caps := &Capabilities{SignatureAlgorithms: []int{algorithmSignature_RSA_SHA256_2048}}
+	for _, c := range cases {
+		certId := "b8c35868-4b94-4ad9-a0bc-c85e9a03b1de"
+		cl := NewCommonLicense([]string{"123456789"}, nil, certId)
+		if err := cl.Negotiate(caps); err != nil {
+			t.Fatalf("Negotiate failed. err=%s", err)
+		}
+		signer, _ := LoadPemSigner(c.pemFile, "")
+		if _, err := cl.Sign(SigningKey{Signer: signer}, true); err != nil {
+			t.Fatalf("Sign failed. err=%s", err)
+		}
+		parsed, err := VerifyLicense(cl.Serialize(true, true), PublicKeys{certId: c.pub})
+		if err != nil {
+			t.Fatalf("VerifyLicense failed. err=%s", err)
+		}
+		want := c.algId
+		if c.algId == algorithmSignature_RSA_SHA1_2048 {
+			want = algorithmSignature_RSA_SHA256_2048
+		}
+		if parsed.Signature.AlgorithmId != want {
+			t.Fatalf("negotiated algorithm mismatch. got 0x%02X, want 0x%02X", parsed.Signature.AlgorithmId, want)
+		}
+	}
+
+	// The algorithm id must match the key.
+	body, sig := []byte("body"), []byte("sig")
+	params := sm2.P256().Params()
+	sm2Pub := &sm2.PublicKey{Curve: sm2.P256(), X: params.Gx, Y: params.Gy}
+	if err := verifySignature(algorithmSignature_RSA_SHA256_2048, sm2Pub, body, sig); err != errPublicKeyMismatch {
+		t.Fatalf("SM2 key accepted for RSA. err=%v", err)
+	}
+	if err := verifySignature(algorithmSignature_RSA_SHA1_1024, &rsaKey.PublicKey, body, sig); err != errPublicKeyMismatch {
+		t.Fatalf("RSA 2048 key accepted for RSA 1024. err=%v", err)
+	}
+}
+
+func TestSignerConcurrent(t *testing.T) {
+	certId := "47946232-dad5-4b46-b1e6-4f0b581108dc"
+	signer, err := LoadPemSigner(privatePemFile, certId)
+	if err != nil {
+		t.Fatalf("LoadPemSigner failed. err=%s", err)
+	}
+	pks := loadPublicKeys(t, certId)
+
+	wg := sync.WaitGroup{}
+	errs := make(chan error, 8)
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// The certificate id of the signer replaces the one of the license.
+			cl := NewCommonLicense([]string{"123456789"}, nil, "")
+			if _, err := cl.Sign(signer, true); err != nil {
+				errs <- err
+				return
+			}
+			if _, err := VerifyLicense(cl.Serialize(true, true), pks); err != nil {
+				errs <- err
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Fatalf("concurrent signing failed. err=%s", err)
+	}
+}
+
+func TestKeyring(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keyring")
+	if err != nil {
+		t.Fatalf("TempDir failed. err=%s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	nextKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("GenerateKey failed. err=%s", err)
+	}
+	nextDer, _ := x509.MarshalPKCS8PrivateKey(nextKey)
+	writePem(t, dir, "next.pem", "PRIVATE KEY", nextDer)
+	keyFile, _ := filepath.Abs(privatePemFile)
+
+	start := time.Unix(1600000000, 0).UTC()
+	rollover := start.Add(30 * 24 * time.Hour)
+	specs := []KeySpec{{CertId: "first", KeyFile: keyFile, NotBefore: start}}
+	specs, err = ScheduleRollover(specs, KeySpec{CertId: "next", KeyFile: "next.pem", NotBefore: rollover}, time.Hour)
+	if err != nil {
+		t.Fatalf("ScheduleRollover failed. err=%s", err)
+	}
+	if _, err := ScheduleRollover(specs, KeySpec{CertId: "early", NotBefore: start}, time.Hour); err != errRolloverTime {
+		t.Fatalf("rollover before the latest key: err=%v", err)
+	}
+
+	path := filepath.Join(dir, "keyring.json")
+	if err := WriteKeySpecs(path, specs); err != nil {
+		t.Fatalf("WriteKeySpecs failed. err=%s", err)
+	}
+	specs, err = ReadKeySpecs(path)
+	if err != nil {
+		t.Fatalf("ReadKeySpecs failed. err=%s", err)
+	}
+	if len(specs) != 2 || !specs[0].NotAfter.Equal(rollover.Add(time.Hour)) {
+		t.Fatalf("key specs mismatch. got %+v", specs)
+	}
+
+	kr, err := LoadKeyring(dir, specs, nil)
+	if err != nil {
+		t.Fatalf("LoadKeyring failed. err=%s", err)
+	}
+
+	sign := func(at time.Time) []byte {
+		kr.now = func() time.Time { return at }
+		key, err := kr.Current()
+		if err != nil {
+			t.Fatalf("Current failed. err=%s", err)
+		}
+		cl := NewCommonLicense([]string{"123456789"}, nil, "")
+		if _, err := cl.Sign(key, true); err != nil {
+			t.Fatalf("Sign failed. err=%s", err)
+		}
+		return cl.Serialize(true, true)
+	}
+
+	// Before rollover, the first key signs.
+	old := sign(rollover.Add(-time.Minute))
+	parsed, err := VerifyLicense(old, kr)
+	if err != nil {
+		t.Fatalf("VerifyLicense failed. err=%s", err)
+	}
+	if string(parsed.Signature.CertificatId) != "first" {
+		t.Fatalf("signed by %q before rollover.", parsed.Signature.CertificatId)
+	}
+	if len(kr.Published()) != 2 {
+		t.Fatalf("scheduled key not published.")
+	}
+
+	// After rollover, the next key signs, and licenses of the first one
+	// verify until the overlap ends.
+	cur := sign(rollover)
+	parsed, err = VerifyLicense(cur, kr)
+	if err != nil {
+		t.Fatalf("VerifyLicense failed. err=%s", err)
+	}
+	if parsed.Signature.AlgorithmId != algorithmSignature_RSA_SHA1_2048 || string(parsed.Signature.CertificatId) != "next" {
+		t.Fatalf("signed by %q after rollover.", parsed.Signature.CertificatId)
+	}
+	if _, err := VerifyLicense(old, kr); err != nil {
+		t.Fatalf("license of the previous key failed within overlap. err=%s", err)
+	}
+
+	kr.now = func() time.Time { return rollover.Add(time.Hour) }
+	if _, err := VerifyLicense(old, kr); err == nil {
+		t.Fatalf("license of expired key verified.")
+	}
+	if _, err := VerifyLicense(cur, kr); err != nil {
+		t.Fatalf("VerifyLicense failed. err=%s", err)
+	}
+
+	kr.now = func() time.Time { return start.Add(-time.Minute) }
+	if _, err := kr.Current(); err != errNoSigningKey {
+		t.Fatalf("key before its window: err=%v", err)
+	}
+
+	// Keys kept in a token roll over the same way as key files.
+	tokenSpecs, err := ScheduleRollover(specs, KeySpec{CertId: "token", TokenKey: "key-3", NotBefore: rollover.Add(time.Hour)}, time.Hour)
+	if err != nil {
+		t.Fatalf("ScheduleRollover failed. err=%s", err)
+	}
+	if _, err := LoadKeyring(dir, tokenSpecs, nil); !errors.Is(err, errNoToken) {
+		t.Fatalf("token key loaded without token: err=%v", err)
+	}
+	tokens := testTokenKeys{"key-3": nextKey}
+	kr, err = LoadKeyring(dir, specs, tokens)
+	if err != nil {
+		t.Fatalf("LoadKeyring failed. err=%s", err)
+	}
+	kr.now = func() time.Time { return rollover }
+
+	// A key that fails check isn't loaded on reload.
+	errCheck := errors.New("check failed")
+	err = kr.Reload(dir, tokenSpecs, func(k SigningKey) error {
+		if k.CertificateId() == "token" {
+			return errCheck
+		}
+		return nil
+	})
+	if err != errCheck || len(kr.Published()) != 2 {
+		t.Fatalf("reload with failed check: err=%v", err)
+	}
+	if err := kr.Reload(dir, tokenSpecs, nil); err != nil {
+		t.Fatalf("Reload failed. err=%s", err)
+	}
+	kr.now = func() time.Time { return rollover.Add(time.Hour) }
+	key, err := kr.Current()
+	if err != nil || key.CertificateId() != "token" {
+		t.Fatalf("token key not current after rollover. err=%v", err)
+	}
+}
+
+// testTokenKeys is a token of in-memory keys by CKA_ID.
+type testTokenKeys map[string]crypto.Signer
+
+func (tk testTokenKeys) TokenSigner(keyId, certId string) (Signer, error) {
+	key, ok := tk[keyId]
+	if !ok {
+		return nil, errors.New("no such key")
+	}
+	return NewKeySigner(key, certId)
+}
+
+func TestChinaDrmBundle(t *testing.T) {
+	certId := "b8c35868-4b94-4ad9-a0bc-c85e9a03b1de"
+	pks := loadPublicKeys(t, certId)
+	cdl := NewChinaDrmLicense(1001, []string{"kid-1"}, nil, certId)
+	cdl.AddContent(1002, []string{"kid-2", "kid-3"})
+	cdl.AddCounter(NewAndCounter(1))
+
+	for _, c := range cdl.Contents {
+		if int(c.Length) != len(c.Bytes())-unitHeaderLen {
+			t.Fatalf("content %d length mismatch. got %d", c.ContentId, c.Length)
+		}
+	}
+
+	for _, withCnt := range []bool{true, false} {
+		if err := cdl.Sign(loadSigner(t), withCnt); err != nil {
+			t.Fatalf("Sign failed. err=%s", err)
+		}
+		str, err := cdl.Base64String()
+		if err != nil {
+			t.Fatalf("Base64String failed. err=%s", err)
+		}
+		data, err := base64.StdEncoding.DecodeString(str)
+		if err != nil {
+			t.Fatalf("DecodeString failed. err=%s", err)
+		}
+
+		// What is emitted is what is signed.
+		parsed, err := VerifyChinaDrmLicense(data, pks)
+		if err != nil {
+			t.Fatalf("VerifyChinaDrmLicense withCnt=%v failed. err=%s", withCnt, err)
+		}
+		if len(parsed.Contents) != 2 || parsed.Contents[1].Index != 2 || len(parsed.Contents[1].Keys) != 2 {
+			t.Fatalf("contents mismatch. got %+v", parsed.Contents)
+		}
+		if (len(parsed.Counters) == 1) != withCnt {
+			t.Fatalf("counters mismatch withCnt=%v. got %d", withCnt, len(parsed.Counters))
+		}
+		if int(parsed.Header.UnitsNum) != cdl.unitsNum(withCnt) {
+			t.Fatalf("units number mismatch. got %d", parsed.Header.UnitsNum)
+		}
+		// Content units come right after the license header.
+		if data[licenseHeaderLength+unitHeaderLen] != unitTypeContent {
+			t.Fatalf("content unit misplaced.")
+		}
+	}
+
+	noContent := NewCommonLicense([]string{"kid-1"}, nil, certId)
+	if _, err := ParseChinaDrmLicense(noContent.Serialize(true, true)); err != errNoContent {
+		t.Fatalf("license without content: err=%v", err)
+	}
+}
+
+func TestMarshalValidation(t *testing.T) {
+	long := string(bytes.Repeat([]byte{'k'}, 256))
+	signer := loadSigner(t)
+
+	cases := []struct {
+		name string
+		cl   func() *CommonLicense
+		err  error
+	}{
+		{"key id", func() *CommonLicense {
+			return NewCommonLicense([]string{long}, nil, "cert")
+		}, errFieldTooLong},
+		{"auth object", func() *CommonLicense {
+			return NewCommonLicense(nil, []string{strings.Repeat(long, 256)}, "cert")
+		}, errFieldTooLong},
+		{"key id length", func() *CommonLicense {
+			cl := NewCommonLicense([]string{"kid"}, nil, "cert")
+			cl.Keys[0].KeyId = []byte("other kid")
+			return cl
+		}, errLengthMismatch},
+		{"unit length", func() *CommonLicense {
+			cl := NewCommonLicense([]string{"kid"}, nil, "cert")
+			cl.Policys[0].Length++
+			return cl
+		}, errLengthMismatch},
+		{"key rules number", func() *CommonLicense {
+			cl := NewCommonLicense([]string{"kid"}, nil, "cert")
+			cl.Policys[0].KeyRulesNum++
+			return cl
+		}, errLengthMismatch},
+		{"counter", func() *CommonLicense {
+			cl := NewCommonLicense([]string{"kid"}, nil, "cert")
+			cl.AddCounter(NewAndCounter(1))
+			cl.Counters[0].RightsIndex = append(cl.Counters[0].RightsIndex, 2)
+			return cl
+		}, errLengthMismatch},
+	}
+	for _, c := range cases {
+		if _, err := c.cl().Sign(signer, true); !errors.Is(err, c.err) {
+			t.Fatalf("%s: err=%v, want %v", c.name, err, c.err)
+		}
+		if _, err := c.cl().Marshal(true, false); !errors.Is(err, c.err) {
+			t.Fatalf("%s: Marshal err=%v, want %v", c.name, err, c.err)
+		}
+	}
+
+	longSigner, err := LoadPemSigner(privatePemFile, long)
+	if err != nil {
+		t.Fatalf("LoadPemSigner failed. err=%s", err)
+	}
+	if _, err := NewCommonLicense([]string{"kid"}, nil, "cert").Sign(longSigner, true); err != errCertIdLen {
+		t.Fatalf("long certificate id: err=%v", err)
+	}
+
+	cdl := NewChinaDrmLicense(1, []string{"kid"}, nil, "cert")
+	cdl.AddContent(2, []string{long})
+	if err := cdl.Sign(signer, true); !errors.Is(err, errFieldTooLong) {
+		t.Fatalf("long content key id: err=%v", err)
+	}
+
+	// Units number of the header must match the units.
+	cl := NewCommonLicense([]string{"kid"}, nil, "cert")
+	if _, err := cl.Sign(signer, true); err != nil {
+		t.Fatalf("Sign failed. err=%s", err)
+	}
+	data := cl.Serialize(true, true)
+	data[unitHeaderLen+1+8]++
+	if _, err := ParseCommonLicense(data); !errors.Is(err, errUnitsNum) {
+		t.Fatalf("wrong units number: err=%v", err)
+	}
+	if _, err := ParseCommonLicense(make([]byte, maxLicenseLen+1)); err != errLicenseTooLong {
+		t.Fatalf("oversized license: err=%v", err)
+	}
+
+	// A license changed after signing isn't encoded for clients.
+	cl.Keys[0].KeyId = []byte(long)
+	if _, err := cl.Base64String(); !errors.Is(err, errFieldTooLong) {
+		t.Fatalf("Base64String of invalid license: err=%v", err)
+	}
+
+	// Constructors that return an error check the lengths they store.
+	if _, err := NewEncryptedKey("kid", make([]byte, 16), NewDeviceKey(long, make([]byte, 16))); !errors.Is(err, errFieldTooLong) {
+		t.Fatalf("long upper key id: err=%v", err)
+	}
+	if _, err := NewPolicyBuilder(long).PlayTimes(1).Build(); !errors.Is(err, errFieldTooLong) {
+		t.Fatalf("long policy key id: err=%v", err)
+	}
+}
+
+// watermarkCodec is an extension carrying a watermark payload, which must not
+// be empty.
+type watermarkCodec struct{}
+
+func (watermarkCodec) Encode(v interface{}) ([]byte, error) {
+	return []byte(v.(string)), nil
+}
+
+func (watermarkCodec) Decode(data []byte) (interface{}, error) {
+	if len(data) == 0 {
+		return nil, errors.New("empty watermark")
+	}
+	return string(data), nil
+}
+
+func TestExtensionUnits(t *testing.T) {
+	const watermarkType = 0xD0
+	certId := "b8c35868-4b94-4ad9-a0bc-c85e9a03b1de"
+	pks := loadPublicKeys(t, certId)
+
+	if err := RegisterExtension(watermarkType, watermarkCodec{}); err != nil {
+		t.Fatalf("RegisterExtension failed. err=%s", err)
+	}
+	defer func() {
+		extLock.Lock()
+		delete(extCodecs, watermarkType)
+		extLock.Unlock()
+	}()
+	if err := RegisterExtension(watermarkType, watermarkCodec{}); !errors.Is(err, errDuplicatedExtension) {
+		t.Fatalf("duplicated type: err=%v", err)
+	}
+	if err := RegisterExtension(unitTypeKey, watermarkCodec{}); !errors.Is(err, errExtensionType) {
+		t.Fatalf("basic unit type: err=%v", err)
+	}
+	if _, err := NewExtensionUnit(0xD1, "x"); !errors.Is(err, errUnknownExtension) {
+		t.Fatalf("unregistered type: err=%v", err)
+	}
+
+	wm, err := NewExtensionUnit(watermarkType, "session-42")
+	if err != nil {
+		t.Fatalf("NewExtensionUnit failed. err=%s", err)
+	}
+	// A unit of a type this server doesn't know about.
+	vendor := ExtensionUnit{
+		UnitHeader: UnitHeader{Type: 0x07, Length: 3},
+		Data:       []byte{0xCA, 0xFE, 0x01},
+	}
+
+	cl := NewCommonLicense([]string{"kid"}, nil, certId)
+	cl.AddExtension(wm)
+	cl.AddExtension(vendor)
+	if _, err := cl.Sign(loadSigner(t), true); err != nil {
+		t.Fatalf("Sign failed. err=%s", err)
+	}
+	data := cl.Serialize(true, true)
+
+	parsed, err := VerifyLicense(data, pks)
+	if err != nil {
+		t.Fatalf("VerifyLicense failed. err=%s", err)
+	}
+	if len(parsed.Extensions) != 2 {
+		t.Fatalf("extensions mismatch. got %+v", parsed.Extensions)
+	}
+	v, err := parsed.Extensions.Get(watermarkType).Value()
+	if err != nil || v != "session-42" {
+		t.Fatalf("watermark mismatch. got %v, err=%v", v, err)
+	}
+	if u := parsed.Extensions.Get(0x07); u == nil || !bytes.Equal(u.Data, vendor.Data) {
+		t.Fatalf("unknown extension not kept. got %+v", u)
+	}
+	if _, err := parsed.Extensions.Get(0x07).Value(); !errors.Is(err, errUnknownExtension) {
+		t.Fatalf("value of unknown extension: err=%v", err)
+	}
+	// Unknown units survive a round trip inside the signed body.
+	if again := parsed.Serialize(true, true); !bytes.Equal(again, data) {
+		t.Fatalf("round trip mismatch.")
+	}
+
+	// Extension units keep their position, as signed by another server: the
+	// vendor unit right after the header, the watermark between the key and
+	// the policy.
+	other := NewCommonLicense([]string{"kid"}, nil, certId)
+	body := other.Serialize(true, false)
+	keyOff := unitHeaderLen + licenseHeaderLength
+	policyOff := unitOffset(t, body, unitTypePolicy, 0)
+	mid := append([]byte{}, body[:keyOff]...)
+	mid = append(mid, vendor.Bytes()...)
+	mid = append(mid, body[keyOff:policyOff]...)
+	mid = append(mid, wm.Bytes()...)
+	mid = append(mid, body[policyOff:]...)
+	// UnitsNum counts the extension units and the signature unit.
+	mid[unitHeaderLen+1+8] += 2
+	relayed, err := ParseCommonLicense(mid)
+	if err != nil {
+		t.Fatalf("ParseCommonLicense failed. err=%s", err)
+	}
+	if again := relayed.Serialize(true, false); !bytes.Equal(again, mid) {
+		t.Fatalf("extension units moved.\ngot  %x\nwant %x", again, mid)
+	}
+	relayed.Signature = newSignature(certId)
+	if _, err := relayed.Sign(loadSigner(t), true); err != nil {
+		t.Fatalf("Sign failed. err=%s", err)
+	}
+	signed := relayed.Serialize(true, true)
+	if !bytes.Equal(signed[:len(mid)], mid) {
+		t.Fatalf("signed body differs from the relayed one.")
+	}
+	renewed, err := VerifyLicense(signed, pks)
+	if err != nil {
+		t.Fatalf("VerifyLicense failed. err=%s", err)
+	}
+	if again := renewed.Serialize(true, true); !bytes.Equal(again, signed) {
+		t.Fatalf("round trip of relayed license mismatch.")
+	}
+
+	// Units of registered types must decode.
+	cl.Extensions[0] = ExtensionUnit{UnitHeader: UnitHeader{Type: watermarkType, Index: 1}}
+	if _, err := ParseCommonLicense(cl.Serialize(true, true)); err == nil {
+		t.Fatalf("ParseCommonLicense accepted an invalid watermark.")
+	}
+	cl.Extensions[0].Type = 0xB0
+	if _, err := cl.Marshal(true, true); !errors.Is(err, errExtensionType) {
+		t.Fatalf("extension of unreserved type: err=%v", err)
+	}
+}
+
+func TestLicenseVersions(t *testing.T) {
+	certId := "b8c35868-4b94-4ad9-a0bc-c85e9a03b1de"
+	pks := loadPublicKeys(t, certId)
+	signer := loadSigner(t)
+
+	versions := []struct {
+		caps *Capabilities
+		ver  uint8
+	}{
+		{nil, licenseVersion1},
+		{&Capabilities{}, licenseVersion1},
+		{&Capabilities{Versions: []int{1}}, licenseVersion1},
+		{&Capabilities{Versions: []int{2, 1, 3}}, licenseVersion2},
+	}
+	for _, v := range versions {
+		if ver, err := v.caps.Version(); err != nil || ver != v.ver {
+			t.Fatalf("Version of %+v: got %d, err=%v", v.caps, ver, err)
+		}
+	}
+	if _, err := (&Capabilities{Versions: []int{3}}).Version(); !errors.Is(err, errNoCommonVersion) {
+		t.Fatalf("no common version: err=%v", err)
+	}
+
+	// Times out of uint32 range need version 2.
+	end := time.Unix(1<<33, 0)
+	plc, err := NewPolicyBuilder("kid").EndTime(end).Build()
+	if err != nil {
+		t.Fatalf("Build policy failed. err=%s", err)
+	}
+	if _, err := NewPolicyBuilder("kid").PlayTimes(1).TimeSpan(1 << 33 * time.Second).Build(); !errors.Is(err, errRuleValue) {
+		t.Fatalf("time span out of range: err=%v", err)
+	}
+	cl := NewCommonLicense([]string{"kid"}, nil, certId)
+	cl.SetPolicy(plc)
+	if err := cl.Negotiate(nil); !errors.Is(err, errRuleValue) {
+		t.Fatalf("64 bits end time in version 1: err=%v", err)
+	}
+	// Without Negotiate, the license is still version 1, which clients read
+	// time rules of as 32 bits.
+	if _, err := cl.Sign(signer, true); !errors.Is(err, errRuleWidth) {
+		t.Fatalf("sign 64 bits end time in version 1: err=%v", err)
+	}
+	if _, err := ParseCommonLicense(cl.Serialize(true, false)); !errors.Is(err, errRuleWidth) {
+		t.Fatalf("parse 64 bits end time in version 1: err=%v", err)
+	}
+
+	// Extension units are only issued to clients which support them, and
+	// units may be longer than 64KiB since version 2.
+	cl.AddExtension(ExtensionUnit{
+		UnitHeader: UnitHeader{Type: 0x07, Length: 1 << 17},
+		Data:       bytes.Repeat([]byte{0x5A}, 1<<17),
+	})
+	if err := cl.Negotiate(&Capabilities{Versions: []int{1, 2}}); !errors.Is(err, errUnsupportedUnit) {
+		t.Fatalf("extension unknown to client: err=%v", err)
+	}
+	caps := &Capabilities{Versions: []int{1, 2}, UnitTypes: []int{0x07}}
+	if err := cl.Negotiate(caps); err != nil {
+		t.Fatalf("Negotiate failed. err=%s", err)
+	}
+	if _, err := cl.Sign(signer, true); err != nil {
+		t.Fatalf("Sign failed. err=%s", err)
+	}
+	data := cl.Serialize(true, true)
+	parsed, err := VerifyLicense(data, pks)
+	if err != nil {
+		t.Fatalf("VerifyLicense failed. err=%s", err)
+	}
+	if parsed.Header.Version != licenseVersion2 || len(parsed.Extensions) != 1 || len(parsed.Extensions[0].Data) != 1<<17 {
+		t.Fatalf("version 2 license mismatch. version %d, %d extensions", parsed.Header.Version, len(parsed.Extensions))
+	}
+	rules, err := parsed.Policys.Get("kid").Rules()
+	if err != nil || !rules.EndTime.Equal(end) {
+		t.Fatalf("end time mismatch. got %v, err=%v", rules.EndTime, err)
+	}
+
+	if err := cl.SetVersion(licenseVersion1); !errors.Is(err, errRuleValue) {
+		t.Fatalf("64 bits end time in version 1: err=%v", err)
+	}
+	cl.SetPolicy(NewPolicy("kid"))
+	if err := cl.SetVersion(licenseVersion1); err != nil {
+		t.Fatalf("SetVersion failed. err=%s", err)
+	}
+	if _, err := cl.Sign(signer, true); !errors.Is(err, errFieldTooLong) {
+		t.Fatalf("unit longer than 64KiB in version 1: err=%v", err)
+	}
+	// The extension is not dropped for an old client, it's left to the
+	// caller to issue a license without it.
+	if err := cl.Negotiate(&Capabilities{Versions: []int{1}}); !errors.Is(err, errUnsupportedUnit) || len(cl.Extensions) != 1 {
+		t.Fatalf("Negotiate with old client: %d extensions, err=%v", len(cl.Extensions), err)
+	}
+	cl.Extensions = nil
+	if err := cl.Negotiate(&Capabilities{Versions: []int{1}}); err != nil {
+		t.Fatalf("Negotiate failed. err=%s", err)
+	}
+	if _, err := cl.Sign(signer, true); err != nil {
+		t.Fatalf("Sign failed. err=%s", err)
+	}
+	if parsed, err := VerifyLicense(cl.Serialize(true, true), pks); err != nil || parsed.Header.Version != licenseVersion1 {
+		t.Fatalf("VerifyLicense of version 1 failed. err=%v", err)
+	}
+}
+
+type failingKeySource struct{}
+
+func (failingKeySource) ContentKey(kid string) ([]byte, error) {
+	return nil, errors.New("no seed")
+}
+
+func TestNewCommonLicenseFrom(t *testing.T) {
+	sr, err := key.NewSeedRegistry(key.DefaultSeeds())
+	if err != nil {
+		t.Fatalf("NewSeedRegistry failed. err=%s", err)
+	}
+	if _, err := NewCommonLicenseFrom(sr, []string{"kid-1"}, nil, "cert"); err == nil {
+		t.Fatalf("license issued for a kid not assigned to a seed.")
+	}
+	for _, kid := range []string{"kid-1", "kid-2"} {
+		if _, err := sr.Assign(kid); err != nil {
+			t.Fatalf("Assign failed. err=%s", err)
+		}
+	}
+	cl, err := NewCommonLicenseFrom(sr, []string{"kid-1", "kid-2"}, nil, "cert")
+	if err != nil {
+		t.Fatalf("NewCommonLicenseFrom failed. err=%s", err)
+	}
+	// The default seeds derive the keys NewCommonLicense always did.
+	dflt := NewCommonLicense([]string{"kid-1", "kid-2"}, nil, "cert")
+	for i := range cl.Keys {
+		if !bytes.Equal(cl.Keys[i].KeyData, dflt.Keys[i].KeyData) {
+			t.Fatalf("key of %s mismatch.", cl.Keys[i].KeyId)
+		}
+	}
+
+	if _, err := NewCommonLicenseFrom(failingKeySource{}, []string{"kid-1"}, nil, "cert"); err == nil {
+		t.Fatalf("NewCommonLicenseFrom ignored key source error.")
+	}
+}
@@ -0,0 +1,399 @@
+/*
+	Opendrm, an open source implementation of industry-grade DRM
+	(Digital Rights Management) or Key System.
+	Copyright (C) 2018  wilkk
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+/*
+	This file decodes the binary form of licenses produced by Serialize back into
+	license structs. The input is walked unit by unit, using the Type and Length
+	fields of each unit header.
+*/
+
+package license
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+)
+
+var (
+	errTruncated      = errors.New("license: data truncated")
+	errNoHeader       = errors.New("license: first unit is not license header")
+	errTrailingData   = errors.New("license: unit has trailing data")
+	errDataAfterSig   = errors.New("license: data after signature unit")
+	errUnexpectedUnit = errors.New("license: unexpected unit")
+	errNoContent      = errors.New("license: no content unit")
+	errNoContentKey   = errors.New("license: content unit has no key")
+	errLicenseTooLong = errors.New("license: data too long")
+	errUnitsNum       = errors.New("license: units number does not match units")
+	errKeyType        = errors.New("license: invalid key type")
+)
+
+// A license has at most 255 units after its header, each of them shorter than
+// 64KiB. Real licenses are far smaller, so data is capped before decoding.
+const maxLicenseLen = 1 << 20
+
+// decoder reads big endian fields from a byte slice. The first error is kept
+// in err and all later reads return zero values.
+type decoder struct {
+	data []byte
+	off  int
+	err  error
+	// unit Length is 32 bits, since license version 2
+	wide bool
+}
+
+func (d *decoder) remaining() int {
+	return len(d.data) - d.off
+}
+
+func (d *decoder) next(n int) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if n < 0 || d.remaining() < n {
+		d.err = errTruncated
+		return nil
+	}
+	b := d.data[d.off : d.off+n]
+	d.off += n
+	return b
+}
+
+func (d *decoder) uint8() uint8 {
+	b := d.next(1)
+	if b == nil {
+		return 0
+	}
+	return b[0]
+}
+
+func (d *decoder) uint16() uint16 {
+	b := d.next(2)
+	if b == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint16(b)
+}
+
+func (d *decoder) uint32() uint32 {
+	b := d.next(4)
+	if b == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint32(b)
+}
+
+func (d *decoder) uint64() uint64 {
+	b := d.next(8)
+	if b == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint64(b)
+}
+
+// bytes returns a copy of the next n bytes.
+func (d *decoder) bytes(n int) []byte {
+	b := d.next(n)
+	if b == nil {
+		return nil
+	}
+	return append([]byte{}, b...)
+}
+
+func (d *decoder) unitHeader() UnitHeader {
+	hdr := UnitHeader{
+		Type:  d.uint8(),
+		Index: d.uint8(),
+	}
+	if d.wide {
+		hdr.Length = d.uint32()
+	} else {
+		hdr.Length = uint32(d.uint16())
+	}
+	return hdr
+}
+
+// unit returns the header and a decoder over the data part of next unit.
+func (d *decoder) unit() (UnitHeader, *decoder) {
+	hdr := d.unitHeader()
+	return hdr, &decoder{data: d.next(int(hdr.Length)), err: d.err}
+}
+
+// done reports the first error of d, or errTrailingData if the data part of
+// a unit is not consumed completely.
+func (d *decoder) done() error {
+	if d.err != nil {
+		return d.err
+	}
+	if d.remaining() != 0 {
+		return errTrailingData
+	}
+	return nil
+}
+
+func parseLicenseHeader(hdr UnitHeader, d *decoder) (LicenseHeader, error) {
+	lh := LicenseHeader{
+		UnitHeader: hdr,
+		Version:    d.uint8(),
+		Id:         d.uint64(),
+		UnitsNum:   d.uint8(),
+	}
+	return lh, d.done()
+}
+
+func parseAuthObject(hdr UnitHeader, d *decoder) (AuthObject, error) {
+	ao := AuthObject{
+		UnitHeader: hdr,
+		ObjectType: d.uint8(),
+	}
+	ao.ObjectId = d.bytes(d.remaining())
+	return ao, d.done()
+}
+
+func parseKey(hdr UnitHeader, d *decoder) (Key, error) {
+	k := Key{
+		UnitHeader:  hdr,
+		AlgorithmId: d.uint8(),
+		KeyDataLen:  d.uint16(),
+	}
+	k.KeyData = d.bytes(int(k.KeyDataLen))
+
+	// Auxiliary info and upper key info are optional, which is told by the
+	// length of unit.
+	if d.remaining() > 0 {
+		k.KeyType = d.uint8()
+		k.KeyIdLen = d.uint8()
+		k.KeyId = d.bytes(int(k.KeyIdLen))
+		if d.err == nil && k.KeyType == 0 {
+			return k, errKeyType
+		}
+	}
+	if d.remaining() > 0 {
+		k.UpperKeyType = d.uint8()
+		k.UpperKeyIdLen = d.uint8()
+		k.UpperKeyId = d.bytes(int(k.UpperKeyIdLen))
+		if d.err == nil && k.UpperKeyType == 0 {
+			return k, errUpperKeyType
+		}
+	}
+	return k, d.done()
+}
+
+func parseKeyRules(num uint8, d *decoder) KeyRules {
+	krs := KeyRules{}
+	for i := 0; i < int(num) && d.err == nil; i++ {
+		kr := KeyRule{
+			KeyRuleType: d.uint8(),
+			KeyRuleLen:  d.uint8(),
+		}
+		kr.KeyRuleData = d.bytes(int(kr.KeyRuleLen))
+		krs = append(krs, kr)
+	}
+	return krs
+}
+
+func parsePolicy(hdr UnitHeader, d *decoder) (Policy, error) {
+	p := Policy{
+		UnitHeader: hdr,
+		KeyType:    d.uint8(),
+		KeyIdLen:   d.uint8(),
+	}
+	p.KeyId = d.bytes(int(p.KeyIdLen))
+	p.KeyRulesNum = d.uint8()
+	p.KeyRules = parseKeyRules(p.KeyRulesNum, d)
+	return p, d.done()
+}
+
+func parseRight(hdr UnitHeader, d *decoder) (Right, error) {
+	r := Right{
+		UnitHeader: hdr,
+		RightData:  d.bytes(d.remaining()),
+	}
+	if len(r.RightData) == 0 {
+		r.RightData = nil
+	}
+	if err := d.done(); err != nil {
+		return r, err
+	}
+	return r, r.Validate()
+}
+
+func parseCounter(hdr UnitHeader, d *decoder) (Counter, error) {
+	c := Counter{
+		UnitHeader:     hdr,
+		RightsIndexNum: d.uint16(),
+	}
+	c.RightsIndex = d.bytes(int(c.RightsIndexNum))
+	return c, d.done()
+}
+
+func parseSignature(hdr UnitHeader, d *decoder) (Signature, error) {
+	s := Signature{
+		UnitHeader:      hdr,
+		AlgorithmId:     d.uint8(),
+		CertificatIdLen: d.uint8(),
+	}
+	s.CertificatId = d.bytes(int(s.CertificatIdLen))
+	s.SignatureLen = d.uint16()
+	s.SignatureData = d.bytes(int(s.SignatureLen))
+	return s, d.done()
+}
+
+func parseContent(hdr UnitHeader, d *decoder) (Content, error) {
+	c := Content{
+		UnitHeader: hdr,
+		ContentId:  d.uint64(),
+		Keys:       ContentKeys{},
+	}
+	for d.err == nil && d.remaining() > 0 {
+		ck := ContentKey{KeyIdLen: d.uint8()}
+		ck.KeyId = d.bytes(int(ck.KeyIdLen))
+		c.Keys = append(c.Keys, ck)
+	}
+	if d.err == nil && len(c.Keys) == 0 {
+		return c, errNoContentKey
+	}
+	return c, d.done()
+}
+
+// parseLicense decodes data into cl. Content units are only accepted if
+// contents is not nil.
+func parseLicense(data []byte, cl *CommonLicense, contents *Contents) error {
+	if len(data) > maxLicenseLen {
+		return errLicenseTooLong
+	}
+	ver, err := licenseVersion(data)
+	if err != nil {
+		return err
+	}
+	d := &decoder{data: data, wide: ver >= licenseVersion2}
+
+	hdr, ud := d.unit()
+	if d.err != nil {
+		return d.err
+	}
+	if hdr.Type != unitTypeHeader {
+		return errNoHeader
+	}
+	lh, err := parseLicenseHeader(hdr, ud)
+	if err != nil {
+		return err
+	}
+	if lh.Version != ver {
+		return fmt.Errorf("%w: %d", errVersion, lh.Version)
+	}
+	cl.Header = lh
+
+	hasSig := false
+	units := 0
+	// others counts the units parsed but extension ones.
+	others := 0
+	for ; d.remaining() > 0; units++ {
+		if hasSig {
+			return errDataAfterSig
+		}
+		if units == math.MaxUint8 {
+			return errTooManyUnits
+		}
+
+		hdr, ud := d.unit()
+		if d.err != nil {
+			return d.err
+		}
+
+		switch {
+		case hdr.Type == unitTypeContent && contents != nil:
+			var c Content
+			c, err = parseContent(hdr, ud)
+			*contents = append(*contents, c)
+		case hdr.Type == unitTypeAuthObject:
+			var ao AuthObject
+			ao, err = parseAuthObject(hdr, ud)
+			cl.Objects = append(cl.Objects, ao)
+		case hdr.Type == unitTypeKey:
+			var k Key
+			k, err = parseKey(hdr, ud)
+			cl.Keys = append(cl.Keys, k)
+		case hdr.Type == unitTypePolicy:
+			var p Policy
+			p, err = parsePolicy(hdr, ud)
+			if err == nil {
+				err = p.checkVersion(ver)
+			}
+			cl.Policys = append(cl.Policys, p)
+		case hdr.Type >= unitTypeRightsMin && hdr.Type <= unitTypeRightsMax:
+			var r Right
+			r, err = parseRight(hdr, ud)
+			cl.Rights = append(cl.Rights, r)
+		case hdr.Type >= unitTypeCounterMin && hdr.Type <= unitTypeCounterMax:
+			var c Counter
+			c, err = parseCounter(hdr, ud)
+			cl.Counters = append(cl.Counters, c)
+		case IsExtensionType(hdr.Type):
+			var eu ExtensionUnit
+			eu, err = parseExtension(hdr, ud)
+			eu.after = others + 1
+			cl.Extensions = append(cl.Extensions, eu)
+		case hdr.Type == unitTypeSignature:
+			cl.Signature, err = parseSignature(hdr, ud)
+			hasSig = true
+		default:
+			err = fmt.Errorf("%w: type 0x%02X", errUnexpectedUnit, hdr.Type)
+		}
+		if err != nil {
+			return err
+		}
+		if !IsExtensionType(hdr.Type) {
+			others++
+		}
+	}
+
+	// UnitsNum counts the signature unit, which may not be added yet.
+	if units > int(lh.UnitsNum) || (hasSig && units != int(lh.UnitsNum)) {
+		return fmt.Errorf("%w: %d units, units number %d", errUnitsNum, units, lh.UnitsNum)
+	}
+
+	return nil
+}
+
+// ParseCommonLicense decodes the binary form of a common license, as produced
+// by CommonLicense.Serialize.
+func ParseCommonLicense(data []byte) (*CommonLicense, error) {
+	cl := &CommonLicense{}
+	if err := parseLicense(data, cl, nil); err != nil {
+		return nil, err
+	}
+
+	return cl, nil
+}
+
+// ParseChinaDrmLicense decodes the binary form of a ChinaDRM license, as
+// produced by ChinaDrmLicense.Serialize.
+func ParseChinaDrmLicense(data []byte) (*ChinaDrmLicense, error) {
+	cdl := &ChinaDrmLicense{}
+	if err := parseLicense(data, &cdl.CommonLicense, &cdl.Contents); err != nil {
+		return nil, err
+	}
+	if len(cdl.Contents) == 0 {
+		return nil, errNoContent
+	}
+
+	return cdl, nil
+}
@@ -0,0 +1,327 @@
+//go:build pkcs11
+// +build pkcs11
+
+/*
+	Opendrm, an open source implementation of industry-grade DRM
+	(Digital Rights Management) or Key System.
+	Copyright (C) 2018  wilkk
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+/*
+	PKCS11Signer signs licenses by an RSA private key that never leaves a
+	PKCS#11 token (an HSM, or SoftHSM for local tests). A PKCS11Token opens
+	the keys of a keyring by CKA_ID, so that keys roll over in the token. It's
+	built with the pkcs11 build tag, as it needs cgo and github.com/miekg/pkcs11.
+*/
+
+package license
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"errors"
+	"fmt"
+	"math/big"
+
+	"github.com/miekg/pkcs11"
+)
+
+var (
+	errModule       = errors.New("license: cannot load pkcs11 module")
+	errTokenKey     = errors.New("license: pkcs11 key not found")
+	errTokenKeyDup  = errors.New("license: more than one pkcs11 key with the label")
+	errSignerClosed = errors.New("license: pkcs11 signer closed")
+)
+
+type PKCS11Config struct {
+	// Module is the path of the PKCS#11 library, such as libsofthsm2.so.
+	Module string
+	Slot   uint
+	Pin    string
+	// Label is the CKA_LABEL of the private key of OpenPKCS11Signer.
+	Label string
+	// PoolSize is the max number of sessions open at once, 1 if it's 0.
+	PoolSize int
+}
+
+// PKCS11Token is a token logged in to, whose private keys sign licenses as
+// PKCS11Signers. Sessions are opened as needed and kept in a pool shared by
+// the signers, so that concurrent licenses are signed in parallel up to
+// PoolSize. It implements TokenKeys, for keyrings of token keys.
+type PKCS11Token struct {
+	ctx  *pkcs11.Ctx
+	slot uint
+	// login is kept open, as the token logs out when its last session is
+	// closed.
+	login    pkcs11.SessionHandle
+	sessions chan pkcs11.SessionHandle
+	// tokens limits the number of open sessions.
+	tokens chan struct{}
+}
+
+// PKCS11Signer is a Signer of a private key in a PKCS11Token. The
+// certificate id is the CKA_ID of the key, unless one is given.
+type PKCS11Signer struct {
+	token  *PKCS11Token
+	key    pkcs11.ObjectHandle
+	pub    *rsa.PublicKey
+	algId  uint8
+	certId string
+	// owned is set if Close closes the token as well.
+	owned bool
+}
+
+// OpenPKCS11Token loads the module and logs in to the token in the slot.
+func OpenPKCS11Token(conf PKCS11Config) (*PKCS11Token, error) {
+	ctx := pkcs11.New(conf.Module)
+	if ctx == nil {
+		return nil, fmt.Errorf("%w: %s", errModule, conf.Module)
+	}
+	if err := ctx.Initialize(); err != nil {
+		ctx.Destroy()
+		return nil, err
+	}
+
+	size := conf.PoolSize
+	if size <= 0 {
+		size = 1
+	}
+	pt := &PKCS11Token{
+		ctx:      ctx,
+		slot:     conf.Slot,
+		sessions: make(chan pkcs11.SessionHandle, size),
+		tokens:   make(chan struct{}, size),
+	}
+	if err := pt.init(conf); err != nil {
+		pt.Close()
+		return nil, err
+	}
+
+	return pt, nil
+}
+
+func (pt *PKCS11Token) init(conf PKCS11Config) error {
+	sh, err := pt.ctx.OpenSession(conf.Slot, pkcs11.CKF_SERIAL_SESSION)
+	if err != nil {
+		return err
+	}
+	pt.login = sh
+	// Sessions share the login state, so the pooled ones are logged in as well.
+	if err := pt.ctx.Login(sh, pkcs11.CKU_USER, conf.Pin); err != nil {
+		if e, ok := err.(pkcs11.Error); !ok || e != pkcs11.CKR_USER_ALREADY_LOGGED_IN {
+			return err
+		}
+	}
+	return nil
+}
+
+// OpenPKCS11Signer opens the token of conf and finds the private key labeled
+// conf.Label. Closing the signer closes the token.
+func OpenPKCS11Signer(conf PKCS11Config) (*PKCS11Signer, error) {
+	pt, err := OpenPKCS11Token(conf)
+	if err != nil {
+		return nil, err
+	}
+
+	ps, err := pt.signer(pkcs11.NewAttribute(pkcs11.CKA_LABEL, conf.Label), conf.Label, "")
+	if err != nil {
+		pt.Close()
+		return nil, err
+	}
+	ps.owned = true
+	return ps, nil
+}
+
+// TokenSigner finds the private key whose CKA_ID is keyId. An empty certId
+// is keyId.
+func (pt *PKCS11Token) TokenSigner(keyId, certId string) (Signer, error) {
+	return pt.signer(pkcs11.NewAttribute(pkcs11.CKA_ID, []byte(keyId)), keyId, certId)
+}
+
+// signer finds the private key of attr, which is named name in errors.
+func (pt *PKCS11Token) signer(attr *pkcs11.Attribute, name, certId string) (*PKCS11Signer, error) {
+	if pt.ctx == nil {
+		return nil, errSignerClosed
+	}
+
+	key, err := findKey(pt.ctx, pt.login, attr, name)
+	if err != nil {
+		return nil, err
+	}
+	attrs, err := pt.ctx.GetAttributeValue(pt.login, key, []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_ID, nil),
+		pkcs11.NewAttribute(pkcs11.CKA_MODULUS, nil),
+		pkcs11.NewAttribute(pkcs11.CKA_PUBLIC_EXPONENT, nil),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	pub := &rsa.PublicKey{
+		N: new(big.Int).SetBytes(attrs[1].Value),
+		E: int(new(big.Int).SetBytes(attrs[2].Value).Int64()),
+	}
+	algId, err := signatureAlgorithm(pub)
+	if err != nil {
+		return nil, err
+	}
+	if certId == "" {
+		certId = string(attrs[0].Value)
+	}
+
+	return &PKCS11Signer{
+		token:  pt,
+		key:    key,
+		pub:    pub,
+		algId:  algId,
+		certId: certId,
+	}, nil
+}
+
+func findKey(ctx *pkcs11.Ctx, sh pkcs11.SessionHandle, attr *pkcs11.Attribute, name string) (pkcs11.ObjectHandle, error) {
+	err := ctx.FindObjectsInit(sh, []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_PRIVATE_KEY),
+		pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, pkcs11.CKK_RSA),
+		attr,
+	})
+	if err != nil {
+		return 0, err
+	}
+	defer ctx.FindObjectsFinal(sh)
+
+	objs, _, err := ctx.FindObjects(sh, 2)
+	if err != nil {
+		return 0, err
+	}
+	switch len(objs) {
+	case 0:
+		return 0, fmt.Errorf("%w: %q", errTokenKey, name)
+	case 1:
+		return objs[0], nil
+	default:
+		return 0, fmt.Errorf("%w: %q", errTokenKeyDup, name)
+	}
+}
+
+// get takes an idle session, or opens one if less than PoolSize are open.
+func (pt *PKCS11Token) get() (pkcs11.SessionHandle, error) {
+	select {
+	case sh := <-pt.sessions:
+		return sh, nil
+	case pt.tokens <- struct{}{}:
+		sh, err := pt.ctx.OpenSession(pt.slot, pkcs11.CKF_SERIAL_SESSION)
+		if err != nil {
+			<-pt.tokens
+			return 0, err
+		}
+		return sh, nil
+	}
+}
+
+func (pt *PKCS11Token) put(sh pkcs11.SessionHandle) {
+	pt.sessions <- sh
+}
+
+func (pt *PKCS11Token) closeSession(sh pkcs11.SessionHandle) {
+	pt.ctx.CloseSession(sh)
+	<-pt.tokens
+}
+
+// Close closes the sessions, logs out and unloads the module. It must not be
+// called while licenses are being signed.
+func (pt *PKCS11Token) Close() error {
+	if pt.ctx == nil {
+		return nil
+	}
+
+	for {
+		select {
+		case sh := <-pt.sessions:
+			pt.closeSession(sh)
+			continue
+		default:
+		}
+		break
+	}
+	if pt.login != 0 {
+		pt.ctx.Logout(pt.login)
+		pt.ctx.CloseSession(pt.login)
+	}
+	err := pt.ctx.Finalize()
+	pt.ctx.Destroy()
+	pt.ctx = nil
+
+	return err
+}
+
+func (ps *PKCS11Signer) AlgorithmId() uint8 {
+	return ps.algId
+}
+
+func (ps *PKCS11Signer) CertificateId() string {
+	return ps.certId
+}
+
+func (ps *PKCS11Signer) Public() crypto.PublicKey {
+	return ps.pub
+}
+
+func (ps *PKCS11Signer) Sign(data []byte) ([]byte, error) {
+	return ps.SignWith(ps.algId, data)
+}
+
+func (ps *PKCS11Signer) SignWith(algId uint8, data []byte) ([]byte, error) {
+	pt := ps.token
+	if pt.ctx == nil {
+		return nil, errSignerClosed
+	}
+	if err := checkKey(algId, ps.pub); err != nil {
+		return nil, err
+	}
+
+	mech := pkcs11.CKM_SHA1_RSA_PKCS
+	if algId == algorithmSignature_RSA_SHA256_2048 {
+		mech = pkcs11.CKM_SHA256_RSA_PKCS
+	}
+
+	sh, err := pt.get()
+	if err != nil {
+		return nil, err
+	}
+	err = pt.ctx.SignInit(sh, []*pkcs11.Mechanism{pkcs11.NewMechanism(uint(mech), nil)}, ps.key)
+	if err != nil {
+		// The session may be left in an operation, don't reuse it.
+		pt.closeSession(sh)
+		return nil, err
+	}
+	sig, err := pt.ctx.Sign(sh, data)
+	if err != nil {
+		pt.closeSession(sh)
+		return nil, err
+	}
+	pt.put(sh)
+
+	return sig, nil
+}
+
+// Close closes the token of a signer opened by OpenPKCS11Signer. Signers of
+// a shared token are closed with the token.
+func (ps *PKCS11Signer) Close() error {
+	if !ps.owned {
+		return nil
+	}
+	return ps.token.Close()
+}
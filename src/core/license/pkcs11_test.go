@@ -0,0 +1,187 @@
+//go:build pkcs11
+// +build pkcs11
+
+/*
+	Opendrm, an open source implementation of industry-grade DRM
+	(Digital Rights Management) or Key System.
+	Copyright (C) 2018  wilkk
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// To run against SoftHSM:
+//
+//	softhsm2-util --init-token --free --label opendrm --pin 1234 --so-pin 1234
+//	PKCS11_MODULE=/usr/lib/softhsm/libsofthsm2.so PKCS11_PIN=1234 \
+//		go test -tags pkcs11 -run PKCS11 core/license
+
+package license
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/pkcs11"
+)
+
+// genTokenKey generates an RSA 2048 key pair labeled label in the first token,
+// and returns its slot.
+func genTokenKey(t *testing.T, module, pin, label string, id []byte) uint {
+	ctx := pkcs11.New(module)
+	if ctx == nil {
+		t.Fatalf("Load module %s failed.", module)
+	}
+	defer ctx.Destroy()
+	if err := ctx.Initialize(); err != nil {
+		t.Fatalf("Initialize failed. err=%s", err)
+	}
+	defer ctx.Finalize()
+
+	slots, err := ctx.GetSlotList(true)
+	if err != nil || len(slots) == 0 {
+		t.Fatalf("No token found. err=%v", err)
+	}
+	sh, err := ctx.OpenSession(slots[0], pkcs11.CKF_SERIAL_SESSION|pkcs11.CKF_RW_SESSION)
+	if err != nil {
+		t.Fatalf("OpenSession failed. err=%s", err)
+	}
+	defer ctx.CloseSession(sh)
+	if err := ctx.Login(sh, pkcs11.CKU_USER, pin); err != nil {
+		t.Fatalf("Login failed. err=%s", err)
+	}
+	defer ctx.Logout(sh)
+
+	_, _, err = ctx.GenerateKeyPair(sh,
+		[]*pkcs11.Mechanism{pkcs11.NewMechanism(pkcs11.CKM_RSA_PKCS_KEY_PAIR_GEN, nil)},
+		[]*pkcs11.Attribute{
+			pkcs11.NewAttribute(pkcs11.CKA_TOKEN, true),
+			pkcs11.NewAttribute(pkcs11.CKA_VERIFY, true),
+			pkcs11.NewAttribute(pkcs11.CKA_MODULUS_BITS, 2048),
+			pkcs11.NewAttribute(pkcs11.CKA_PUBLIC_EXPONENT, []byte{1, 0, 1}),
+			pkcs11.NewAttribute(pkcs11.CKA_LABEL, label),
+			pkcs11.NewAttribute(pkcs11.CKA_ID, id),
+		},
+		[]*pkcs11.Attribute{
+			pkcs11.NewAttribute(pkcs11.CKA_TOKEN, true),
+			pkcs11.NewAttribute(pkcs11.CKA_PRIVATE, true),
+			pkcs11.NewAttribute(pkcs11.CKA_SENSITIVE, true),
+			pkcs11.NewAttribute(pkcs11.CKA_SIGN, true),
+			pkcs11.NewAttribute(pkcs11.CKA_LABEL, label),
+			pkcs11.NewAttribute(pkcs11.CKA_ID, id),
+		})
+	if err != nil {
+		t.Fatalf("GenerateKeyPair failed. err=%s", err)
+	}
+
+	return slots[0]
+}
+
+func TestPKCS11Signer(t *testing.T) {
+	module := os.Getenv("PKCS11_MODULE")
+	pin := os.Getenv("PKCS11_PIN")
+	if module == "" {
+		t.Skip("PKCS11_MODULE not set")
+	}
+
+	label := fmt.Sprintf("opendrm-license-%d", time.Now().UnixNano())
+	certId := "47946232-dad5-4b46-b1e6-4f0b581108dc"
+	slot := genTokenKey(t, module, pin, label, []byte(certId))
+
+	ps, err := OpenPKCS11Signer(PKCS11Config{
+		Module:   module,
+		Slot:     slot,
+		Pin:      pin,
+		Label:    label,
+		PoolSize: 4,
+	})
+	if err != nil {
+		t.Fatalf("OpenPKCS11Signer failed. err=%s", err)
+	}
+	defer ps.Close()
+
+	if ps.AlgorithmId() != algorithmSignature_RSA_SHA1_2048 {
+		t.Fatalf("algorithm mismatch. got 0x%02X", ps.AlgorithmId())
+	}
+	pks := PublicKeys{certId: ps.Public()}
+
+	wg := sync.WaitGroup{}
+	errs := make(chan error, 16)
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// The certificate id comes from the CKA_ID of the key.
+			cl := NewCommonLicense([]string{"123456789"}, nil, "")
+			if _, err := cl.Sign(ps, true); err != nil {
+				errs <- err
+				return
+			}
+			if _, err := VerifyLicense(cl.Serialize(true, true), pks); err != nil {
+				errs <- err
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Fatalf("Sign by token failed. err=%s", err)
+	}
+}
+
+func TestPKCS11Keyring(t *testing.T) {
+	module := os.Getenv("PKCS11_MODULE")
+	pin := os.Getenv("PKCS11_PIN")
+	if module == "" {
+		t.Skip("PKCS11_MODULE not set")
+	}
+
+	keyId := fmt.Sprintf("opendrm-key-%d", time.Now().UnixNano())
+	slot := genTokenKey(t, module, pin, keyId, []byte(keyId))
+
+	pt, err := OpenPKCS11Token(PKCS11Config{
+		Module:   module,
+		Slot:     slot,
+		Pin:      pin,
+		PoolSize: 2,
+	})
+	if err != nil {
+		t.Fatalf("OpenPKCS11Token failed. err=%s", err)
+	}
+	defer pt.Close()
+
+	kr, err := LoadKeyring("", []KeySpec{{CertId: "token", TokenKey: keyId}}, pt)
+	if err != nil {
+		t.Fatalf("LoadKeyring failed. err=%s", err)
+	}
+	key, err := kr.Current()
+	if err != nil {
+		t.Fatalf("Current failed. err=%s", err)
+	}
+	cl := NewCommonLicense([]string{"123456789"}, nil, "")
+	if _, err := cl.Sign(key, true); err != nil {
+		t.Fatalf("Sign failed. err=%s", err)
+	}
+	if _, err := VerifyLicense(cl.Serialize(true, true), kr); err != nil {
+		t.Fatalf("VerifyLicense failed. err=%s", err)
+	}
+
+	if _, err := LoadKeyring("", []KeySpec{{CertId: "none", TokenKey: keyId + "-none"}}, pt); !errors.Is(err, errTokenKey) {
+		t.Fatalf("missing token key: err=%v", err)
+	}
+}
@@ -0,0 +1,226 @@
+/*
+	Opendrm, an open source implementation of industry-grade DRM
+	(Digital Rights Management) or Key System.
+	Copyright (C) 2018  wilkk
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package license
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"time"
+)
+
+var (
+	errRuleValue      = errors.New("license: key rule value out of uint32 range")
+	errRuleWindow     = errors.New("license: start time is after end time")
+	errRuleDataLen    = errors.New("license: invalid key rule data length")
+	errRuleDuplicated = errors.New("license: key rule duplicated")
+	errUnknownRule    = errors.New("license: unknown key rule type")
+)
+
+// PolicyBuilder builds the Policy unit of a KID from any combination of key
+// rules. The first invalid rule is reported by Build.
+//
+//	plc, err := NewPolicyBuilder(kid).
+//		EndTime(time.Now().AddDate(0, 0, 30)).
+//		TimeSpan(48 * time.Hour).
+//		Build()
+type PolicyBuilder struct {
+	kid   string
+	rules KeyRules
+	err   error
+}
+
+func NewPolicyBuilder(kid string) *PolicyBuilder {
+	return &PolicyBuilder{
+		kid: kid,
+	}
+}
+
+// rule sets the uint32 rule of ruleType. A rule set twice keeps the last value.
+// StartTime and EndTime out of uint32 range are set in 64 bits, which only
+// licenses of version 2 can carry.
+func (pb *PolicyBuilder) rule(ruleType uint8, value int64) *PolicyBuilder {
+	if pb.err != nil {
+		return pb
+	}
+	if value < 0 || (value > math.MaxUint32 && !isTimeRule(ruleType)) {
+		pb.err = fmt.Errorf("%w: rule 0x%02X", errRuleValue, ruleType)
+		return pb
+	}
+
+	var data []byte
+	if value > math.MaxUint32 {
+		data = make([]byte, 8)
+		binary.BigEndian.PutUint64(data, uint64(value))
+	} else {
+		data = make([]byte, 4)
+		binary.BigEndian.PutUint32(data, uint32(value))
+	}
+	kr := KeyRule{
+		KeyRuleType: ruleType,
+		KeyRuleLen:  uint8(len(data)),
+		KeyRuleData: data,
+	}
+
+	for i := range pb.rules {
+		if pb.rules[i].KeyRuleType == ruleType {
+			pb.rules[i] = kr
+			return pb
+		}
+	}
+	pb.rules = append(pb.rules, kr)
+
+	return pb
+}
+
+// StartTime sets the time before which the key can't be used.
+func (pb *PolicyBuilder) StartTime(t time.Time) *PolicyBuilder {
+	return pb.rule(keyRuleTypeStartTime, t.Unix())
+}
+
+// EndTime sets the time after which the key can't be used.
+func (pb *PolicyBuilder) EndTime(t time.Time) *PolicyBuilder {
+	return pb.rule(keyRuleTypeEndTime, t.Unix())
+}
+
+// PlayTimes sets how many times the content can be played.
+func (pb *PolicyBuilder) PlayTimes(n uint32) *PolicyBuilder {
+	return pb.rule(keyRuleTypePlayTimes, int64(n))
+}
+
+// TimeSpan sets how long the key can be used since it's first used, in seconds.
+func (pb *PolicyBuilder) TimeSpan(d time.Duration) *PolicyBuilder {
+	return pb.rule(keyRuleTypeTimeSpan, int64(d/time.Second))
+}
+
+// AccuTimeSpan sets the accumulated time that the content can be played, in
+// seconds.
+func (pb *PolicyBuilder) AccuTimeSpan(d time.Duration) *PolicyBuilder {
+	return pb.rule(keyRuleTypeAccuTimeSpan, int64(d/time.Second))
+}
+
+// Build creates the Policy unit with all rules set.
+func (pb *PolicyBuilder) Build() (Policy, error) {
+	if pb.err != nil {
+		return Policy{}, pb.err
+	}
+
+	plc := Policy{
+		UnitHeader: UnitHeader{
+			Type:  0x04,
+			Index: 0x01,
+		},
+		KeyType:     keyTypeContent,
+		KeyIdLen:    uint8(len(pb.kid)),
+		KeyId:       []byte(pb.kid),
+		KeyRulesNum: uint8(len(pb.rules)),
+		KeyRules:    append(KeyRules{}, pb.rules...),
+	}
+
+	rules, err := plc.Rules()
+	if err != nil {
+		return Policy{}, err
+	}
+	if rules.StartTime != nil && rules.EndTime != nil && rules.StartTime.After(*rules.EndTime) {
+		return Policy{}, errRuleWindow
+	}
+	plc.Length = uint32(len(plc.Bytes()) - unitHeaderLen)
+	if err := plc.validate(); err != nil {
+		return Policy{}, err
+	}
+
+	return plc, nil
+}
+
+// Value decodes the uint32 data of kr.
+func (kr *KeyRule) Value() (uint32, error) {
+	if kr.KeyRuleLen != 4 || len(kr.KeyRuleData) != 4 {
+		return 0, errRuleDataLen
+	}
+	return binary.BigEndian.Uint32(kr.KeyRuleData), nil
+}
+
+// value decodes the data of kr, which is uint32, or uint64 for StartTime and
+// EndTime since license version 2. Values are kept in int64 range, as times
+// are.
+func (kr *KeyRule) value() (uint64, error) {
+	if !isTimeRule(kr.KeyRuleType) || kr.KeyRuleLen != 8 || len(kr.KeyRuleData) != 8 {
+		v, err := kr.Value()
+		return uint64(v), err
+	}
+
+	v := binary.BigEndian.Uint64(kr.KeyRuleData)
+	if v > math.MaxInt64 {
+		return 0, fmt.Errorf("%w: rule 0x%02X", errRuleValue, kr.KeyRuleType)
+	}
+	return v, nil
+}
+
+// PolicyRules is the decoded form of key rules of a Policy unit. A nil field
+// means the rule is absent.
+type PolicyRules struct {
+	StartTime    *time.Time
+	EndTime      *time.Time
+	PlayTimes    *uint32
+	TimeSpan     *time.Duration
+	AccuTimeSpan *time.Duration
+}
+
+// Rules decodes the key rules of p. Unknown rule types are reported as error,
+// since a restriction that is not understood can't be enforced.
+func (p *Policy) Rules() (PolicyRules, error) {
+	prs := PolicyRules{}
+	seen := map[uint8]bool{}
+	for i := range p.KeyRules {
+		kr := &p.KeyRules[i]
+		if seen[kr.KeyRuleType] {
+			return PolicyRules{}, fmt.Errorf("%w: 0x%02X", errRuleDuplicated, kr.KeyRuleType)
+		}
+		seen[kr.KeyRuleType] = true
+
+		v, err := kr.value()
+		if err != nil {
+			return PolicyRules{}, err
+		}
+
+		switch kr.KeyRuleType {
+		case keyRuleTypeStartTime:
+			t := time.Unix(int64(v), 0)
+			prs.StartTime = &t
+		case keyRuleTypeEndTime:
+			t := time.Unix(int64(v), 0)
+			prs.EndTime = &t
+		case keyRuleTypePlayTimes:
+			n := uint32(v)
+			prs.PlayTimes = &n
+		case keyRuleTypeTimeSpan:
+			d := time.Duration(v) * time.Second
+			prs.TimeSpan = &d
+		case keyRuleTypeAccuTimeSpan:
+			d := time.Duration(v) * time.Second
+			prs.AccuTimeSpan = &d
+		default:
+			return PolicyRules{}, fmt.Errorf("%w: 0x%02X", errUnknownRule, kr.KeyRuleType)
+		}
+	}
+
+	return prs, nil
+}
@@ -0,0 +1,280 @@
+/*
+	Opendrm, an open source implementation of industry-grade DRM
+	(Digital Rights Management) or Key System.
+	Copyright (C) 2018  wilkk
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+/*
+	Every license is identified by the Id of its license header. Ids are drawn
+	from an IdAllocator, and issued licenses are recorded in a Registry, so
+	that they can be told apart for support and revocation.
+*/
+
+package license
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	errDuplicatedId = errors.New("license: license id already registered")
+	errUnknownId    = errors.New("license: license id not registered")
+	errRevoked      = errors.New("license: license revoked")
+)
+
+type IdAllocator interface {
+	NextId() uint64
+}
+
+// RandomIdAllocator draws license ids from crypto/rand. Ids are unique across
+// servers and restarts with overwhelming probability.
+type RandomIdAllocator struct{}
+
+func (RandomIdAllocator) NextId() uint64 {
+	b := make([]byte, 8)
+	// crypto/rand.Read never returns an error.
+	rand.Read(b)
+	return binary.BigEndian.Uint64(b)
+}
+
+// MonotonicIdAllocator hands out increasing license ids from a starting value.
+type MonotonicIdAllocator struct {
+	last uint64
+}
+
+// NewMonotonicIdAllocator creates an allocator whose first id is last+1. To keep
+// ids unique across restarts, pass the largest id issued so far.
+func NewMonotonicIdAllocator(last uint64) *MonotonicIdAllocator {
+	return &MonotonicIdAllocator{
+		last: last,
+	}
+}
+
+func (ma *MonotonicIdAllocator) NextId() uint64 {
+	return atomic.AddUint64(&ma.last, 1)
+}
+
+var idAllocator IdAllocator = RandomIdAllocator{}
+
+// SetIdAllocator sets the allocator of license ids used by NewCommonLicense.
+func SetIdAllocator(a IdAllocator) {
+	idAllocator = a
+}
+
+func nextLicenseId() uint64 {
+	return idAllocator.NextId()
+}
+
+// Record is the registry entry of an issued license.
+type Record struct {
+	Id       uint64    `json:"id"`
+	IssuedAt time.Time `json:"issued_at"`
+	DeviceId string    `json:"device_id,omitempty"`
+	Kids     []string  `json:"kids"`
+	CertId   string    `json:"cert_id"`
+	Revoked  bool      `json:"revoked,omitempty"`
+}
+
+// NewRecord creates the registry entry of cl, issued to deviceId.
+func NewRecord(cl *CommonLicense, deviceId string) Record {
+	kids := []string{}
+	for _, k := range cl.Keys {
+		kids = append(kids, string(k.KeyId))
+	}
+
+	return Record{
+		Id:       cl.Header.Id,
+		IssuedAt: time.Now(),
+		DeviceId: deviceId,
+		Kids:     kids,
+		CertId:   string(cl.Signature.CertificatId),
+	}
+}
+
+type Registry interface {
+	// Register records an issued license, it fails if the id is registered.
+	Register(r Record) error
+	Lookup(id uint64) (Record, error)
+	Revoke(id uint64) error
+}
+
+// CheckRegistered returns the record of cl in reg, or an error if cl isn't
+// registered or has been revoked.
+func CheckRegistered(reg Registry, cl *CommonLicense) (Record, error) {
+	r, err := reg.Lookup(cl.Header.Id)
+	if err != nil {
+		return Record{}, err
+	}
+	if r.Revoked {
+		return Record{}, fmt.Errorf("%w: %d", errRevoked, r.Id)
+	}
+	return r, nil
+}
+
+// MemoryRegistry is a Registry that lives as long as the process.
+type MemoryRegistry struct {
+	lock    sync.Mutex
+	records map[uint64]Record
+}
+
+func NewMemoryRegistry() *MemoryRegistry {
+	return &MemoryRegistry{
+		records: map[uint64]Record{},
+	}
+}
+
+func (mr *MemoryRegistry) Register(r Record) error {
+	mr.lock.Lock()
+	defer mr.lock.Unlock()
+
+	if _, ok := mr.records[r.Id]; ok {
+		return errDuplicatedId
+	}
+	mr.records[r.Id] = r
+	return nil
+}
+
+func (mr *MemoryRegistry) Lookup(id uint64) (Record, error) {
+	mr.lock.Lock()
+	defer mr.lock.Unlock()
+
+	r, ok := mr.records[id]
+	if !ok {
+		return Record{}, errUnknownId
+	}
+	return r, nil
+}
+
+func (mr *MemoryRegistry) Revoke(id uint64) error {
+	mr.lock.Lock()
+	defer mr.lock.Unlock()
+
+	r, ok := mr.records[id]
+	if !ok {
+		return errUnknownId
+	}
+	r.Revoked = true
+	mr.records[id] = r
+	return nil
+}
+
+// MaxId returns the largest registered id, to seed a MonotonicIdAllocator.
+func (mr *MemoryRegistry) MaxId() uint64 {
+	mr.lock.Lock()
+	defer mr.lock.Unlock()
+
+	max := uint64(0)
+	for id := range mr.records {
+		if id > max {
+			max = id
+		}
+	}
+	return max
+}
+
+// FileRegistry is a Registry persisted as a file of JSON lines. Each change
+// is appended as the latest record of its id, and the file is replayed when
+// opened.
+type FileRegistry struct {
+	*MemoryRegistry
+
+	lock sync.Mutex
+	file *os.File
+}
+
+func OpenFileRegistry(path string) (*FileRegistry, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	mr := NewMemoryRegistry()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		r := Record{}
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			file.Close()
+			return nil, err
+		}
+		mr.records[r.Id] = r
+	}
+	if err := scanner.Err(); err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return &FileRegistry{
+		MemoryRegistry: mr,
+		file:           file,
+	}, nil
+}
+
+func (fr *FileRegistry) append(r Record) error {
+	data, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	if _, err := fr.file.Write(append(data, '\n')); err != nil {
+		return err
+	}
+	return fr.file.Sync()
+}
+
+func (fr *FileRegistry) Register(r Record) error {
+	fr.lock.Lock()
+	defer fr.lock.Unlock()
+
+	if err := fr.MemoryRegistry.Register(r); err != nil {
+		return err
+	}
+	if err := fr.append(r); err != nil {
+		fr.MemoryRegistry.lock.Lock()
+		delete(fr.records, r.Id)
+		fr.MemoryRegistry.lock.Unlock()
+		return err
+	}
+	return nil
+}
+
+// Revoke records the revocation on disk before in memory, so that the two
+// agree if the write fails.
+func (fr *FileRegistry) Revoke(id uint64) error {
+	fr.lock.Lock()
+	defer fr.lock.Unlock()
+
+	r, err := fr.MemoryRegistry.Lookup(id)
+	if err != nil {
+		return err
+	}
+	r.Revoked = true
+	if err := fr.append(r); err != nil {
+		return err
+	}
+	return fr.MemoryRegistry.Revoke(id)
+}
+
+func (fr *FileRegistry) Close() error {
+	return fr.file.Close()
+}
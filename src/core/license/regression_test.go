@@ -0,0 +1,496 @@
+/*
+	Opendrm, an open source implementation of industry-grade DRM
+	(Digital Rights Management) or Key System.
+	Copyright (C) 2018  wilkk
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+/*
+	Regression fixtures of the license format. Licenses covering every unit
+	type are kept in testdata/regression, and are checked byte by byte against
+	what the encoder produces, round tripped through the parser and verified
+	by the keys in test/. Run 'go test -update' to rewrite them after an
+	intended format change, and review the diff.
+
+	The fixtures are written by this encoder, so they catch changes of the
+	format, not departures from GY/T 277. The vectors assembled from the
+	standard are in conformance_test.go.
+
+	The parsers take licenses from clients, the fuzz targets check that they
+	never panic and only accept well formed licenses:
+
+		go test -fuzz FuzzParseCommonLicense core/license
+*/
+
+package license
+
+import (
+	"bytes"
+	"crypto/rsa"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+var update = flag.Bool("update", false, "rewrite fixture licenses in testdata")
+
+const fixtureCertId = "b8c35868-4b94-4ad9-a0bc-c85e9a03b1de"
+
+var fixtureTime = time.Date(2018, 6, 1, 0, 0, 0, 0, time.UTC)
+
+func fixtureKey(n byte) []byte {
+	return bytes.Repeat([]byte{n}, 16)
+}
+
+func fixturePolicy(t *testing.T, kid string, index uint8) Policy {
+	p, err := NewPolicyBuilder(kid).
+		StartTime(fixtureTime).
+		EndTime(fixtureTime.AddDate(1, 0, 0)).
+		PlayTimes(10).
+		TimeSpan(48 * time.Hour).
+		AccuTimeSpan(10 * time.Hour).
+		Build()
+	if err != nil {
+		t.Fatalf("Build policy failed. err=%s", err)
+	}
+	p.Index = index
+	return p
+}
+
+func fixtureRights(t *testing.T) Rights {
+	must := func(r Right, err error) Right {
+		if err != nil {
+			t.Fatalf("New right failed. err=%s", err)
+		}
+		return r
+	}
+
+	return NewRights(
+		NewPlayRight(),
+		NewPlayTimesRight(3),
+		must(NewPlayTimeRight(2*time.Hour)),
+		must(NewPlayIntervalRight(fixtureTime, fixtureTime.AddDate(0, 1, 0))),
+		NewRecordRight(),
+		must(NewRecordIntervalRight(fixtureTime, fixtureTime.AddDate(0, 0, 7))),
+		must(NewRecordTimeRight(time.Hour)),
+		NewCopyRight(),
+		NewStoreRight(),
+		NewForwardRight(),
+		NewExecuteRight(),
+		NewSuperRight(),
+	)
+}
+
+// fixtureCommon builds a license with every kind of unit. Fields that are
+// random or taken from the clock in NewCommonLicense are fixed.
+func fixtureCommon(t *testing.T) *CommonLicense {
+	cl := NewCommonLicense(nil, nil, fixtureCertId)
+	cl.Header.Id = 0x0102030405060708
+
+	clear := NewKey("kid-clear", fixtureKey(1))
+	aes, err := NewEncryptedKey("kid-aes", fixtureKey(2), NewDeviceKey("device-1", fixtureKey(0xd0)))
+	if err != nil {
+		t.Fatalf("NewEncryptedKey failed. err=%s", err)
+	}
+	biz := NewBusinessKey("operator-1", fixtureKey(0xb0))
+	biz.AlgorithmId = algorithmBlockCipher_SM4_128
+	sm4, err := NewEncryptedKey("kid-sm4", fixtureKey(3), biz)
+	if err != nil {
+		t.Fatalf("NewEncryptedKey failed. err=%s", err)
+	}
+	dev := NewDeviceKey("device-1", fixtureKey(0xd0))
+	dev.AlgorithmId = algorithmBlockCipher_3DES_64_112
+	des, err := NewEncryptedKey("kid-3des", fixtureKey(4), dev)
+	if err != nil {
+		t.Fatalf("NewEncryptedKey failed. err=%s", err)
+	}
+	cl.Keys = Keys{clear, aes, sm4, des}
+
+	cl.Objects = AuthObjects{
+		NewAuthObject(authObjTypeAccount, "account-1"),
+		NewAuthObject(authObjTypeDevice, "device-1"),
+		NewAuthObject(authObjTypeIp, "10.0.0.1"),
+	}
+	for i := range cl.Keys {
+		cl.Keys[i].Index = uint8(i + 1)
+		cl.SetPolicy(fixturePolicy(t, string(cl.Keys[i].KeyId), uint8(i+1)))
+	}
+	for i := range cl.Objects {
+		cl.Objects[i].Index = uint8(i + 1)
+	}
+
+	cl.Rights = fixtureRights(t)
+	cl.AddCounter(NewAndCounter(1, 2))
+	cl.AddCounter(NewOrCounter(3, 4))
+	cl.AddCounter(NewNotCounter(5))
+	cl.AddCounter(NewXorCounter(6, 7))
+
+	return cl
+}
+
+func fixtureChinaDrm(t *testing.T) *ChinaDrmLicense {
+	cdl := NewChinaDrmLicense(12345678900, nil, nil, fixtureCertId)
+	cdl.CommonLicense = *fixtureCommon(t)
+	cdl.Contents = Contents{*NewContent(12345678900, []string{"kid-clear", "kid-aes"})}
+	cdl.AddContent(12345678901, []string{"kid-sm4", "kid-3des"})
+	return &cdl
+}
+
+type fixtureCase struct {
+	name string
+	// build returns the signed license and its binary form.
+	build func(t *testing.T, signer Signer) []byte
+	// parse parses and serializes data again.
+	parse  func(data []byte) ([]byte, error)
+	verify func(data []byte, keys CertResolver) error
+}
+
+var fixtureCases = []fixtureCase{
+	{
+		name: "common_minimal",
+		build: func(t *testing.T, signer Signer) []byte {
+			cl := NewCommonLicense([]string{"kid-1"}, nil, fixtureCertId)
+			cl.Header.Id = 1
+			cl.Keys[0].KeyData = fixtureKey(1)
+			cl.SetPolicy(fixturePolicy(t, "kid-1", 1))
+			if _, err := cl.Sign(signer, false); err != nil {
+				t.Fatalf("Sign failed. err=%s", err)
+			}
+			return cl.Serialize(false, true)
+		},
+		parse:  reserializeCommon,
+		verify: verifyCommon,
+	},
+	{
+		name: "common_full",
+		build: func(t *testing.T, signer Signer) []byte {
+			cl := fixtureCommon(t)
+			if _, err := cl.Sign(signer, true); err != nil {
+				t.Fatalf("Sign failed. err=%s", err)
+			}
+			return cl.Serialize(true, true)
+		},
+		parse:  reserializeCommon,
+		verify: verifyCommon,
+	},
+	{
+		name: "common_v2",
+		build: func(t *testing.T, signer Signer) []byte {
+			cl := fixtureCommon(t)
+			// An end time out of uint32 range, which needs version 2.
+			plc, err := NewPolicyBuilder("kid-clear").
+				StartTime(time.Unix(1500000000, 0)).
+				EndTime(time.Unix(1<<33, 0)).
+				Build()
+			if err != nil {
+				t.Fatalf("Build policy failed. err=%s", err)
+			}
+			cl.SetPolicy(plc)
+			if err := cl.Negotiate(&Capabilities{Versions: []int{1, 2}}); err != nil {
+				t.Fatalf("Negotiate failed. err=%s", err)
+			}
+			if _, err := cl.Sign(signer, true); err != nil {
+				t.Fatalf("Sign failed. err=%s", err)
+			}
+			return cl.Serialize(true, true)
+		},
+		parse:  reserializeCommon,
+		verify: verifyCommon,
+	},
+	{
+		name: "chinadrm_bundle",
+		build: func(t *testing.T, signer Signer) []byte {
+			cdl := fixtureChinaDrm(t)
+			if err := cdl.Sign(signer, true); err != nil {
+				t.Fatalf("Sign failed. err=%s", err)
+			}
+			return cdl.Serialize(true, true)
+		},
+		parse: func(data []byte) ([]byte, error) {
+			cdl, err := ParseChinaDrmLicense(data)
+			if err != nil {
+				return nil, err
+			}
+			return cdl.Serialize(len(cdl.Counters) > 0, true), nil
+		},
+		verify: func(data []byte, keys CertResolver) error {
+			_, err := VerifyChinaDrmLicense(data, keys)
+			return err
+		},
+	},
+}
+
+func reserializeCommon(data []byte) ([]byte, error) {
+	cl, err := ParseCommonLicense(data)
+	if err != nil {
+		return nil, err
+	}
+	return cl.Serialize(len(cl.Counters) > 0, true), nil
+}
+
+func verifyCommon(data []byte, keys CertResolver) error {
+	_, err := VerifyLicense(data, keys)
+	return err
+}
+
+func fixtureFile(name string) string {
+	return filepath.Join("testdata", "regression", name+".bin")
+}
+
+func readFixture(t *testing.T, name string) []byte {
+	data, err := ioutil.ReadFile(fixtureFile(name))
+	if err != nil {
+		t.Fatalf("ReadFile failed, run 'go test -update' to create it. err=%s", err)
+	}
+	return data
+}
+
+func TestFixtureLicenses(t *testing.T) {
+	// RSA PKCS #1 v1.5 signatures are deterministic, so signed licenses are
+	// reproducible.
+	signer := loadSigner(t)
+	pks := loadPublicKeys(t, fixtureCertId)
+
+	for _, c := range fixtureCases {
+		data := c.build(t, signer)
+		if *update {
+			if err := ioutil.WriteFile(fixtureFile(c.name), data, 0644); err != nil {
+				t.Fatalf("WriteFile failed. err=%s", err)
+			}
+		}
+
+		fixture := readFixture(t, c.name)
+		if !bytes.Equal(data, fixture) {
+			t.Fatalf("%s: encoding differs from fixture.\ngot  %s\nwant %s", c.name, hex.EncodeToString(data), hex.EncodeToString(fixture))
+		}
+
+		again, err := c.parse(fixture)
+		if err != nil {
+			t.Fatalf("%s: parse failed. err=%s", c.name, err)
+		}
+		if !bytes.Equal(again, fixture) {
+			t.Fatalf("%s: serialize(parse(fixture)) differs from fixture.", c.name)
+		}
+
+		if err := c.verify(fixture, pks); err != nil {
+			t.Fatalf("%s: verify failed. err=%s", c.name, err)
+		}
+	}
+}
+
+// TestFixtureUnits walks the units of the bundle license by their headers,
+// and checks that every unit type is covered and counted in the header.
+func TestFixtureUnits(t *testing.T) {
+	data := readFixture(t, "chinadrm_bundle")
+
+	seen := map[uint8]bool{}
+	units := 0
+	for off := 0; off < len(data); units++ {
+		if len(data)-off < unitHeaderLen {
+			t.Fatalf("unit header truncated at %d", off)
+		}
+		uType := data[off]
+		length := int(binary.BigEndian.Uint16(data[off+2:]))
+		if uType >= unitTypeRightsMin && uType <= unitTypeRightsMax {
+			// One of each group of rights.
+			uType &= 0xF0
+		}
+		if uType >= unitTypeCounterMin && uType <= unitTypeCounterMax {
+			uType = unitTypeCounterMin
+		}
+		seen[uType] = true
+
+		if uType == unitTypeHeader && length != licenseHeaderLength {
+			t.Fatalf("license header length %d", length)
+		}
+		off += unitHeaderLen + length
+		if off > len(data) {
+			t.Fatalf("unit 0x%02X overruns data", data[off])
+		}
+	}
+
+	// UnitsNum counts the units after the license header.
+	if unitsNum := int(data[unitHeaderLen+1+8]); unitsNum != units-1 {
+		t.Fatalf("units number %d, walked %d units after header", unitsNum, units-1)
+	}
+	all := []uint8{
+		unitTypeHeader, unitTypeContent, unitTypeAuthObject, unitTypeKey, unitTypePolicy,
+		0x10, 0x20, 0x30, 0x40, 0x50, 0x60, 0x80, unitTypeCounterMin, unitTypeSignature,
+	}
+	for _, uType := range all {
+		if !seen[uType] {
+			t.Fatalf("no unit of type 0x%02X in fixture license", uType)
+		}
+	}
+}
+
+// mutate returns a copy of data changed by f.
+func mutate(data []byte, f func(b []byte) []byte) []byte {
+	return f(append([]byte{}, data...))
+}
+
+// unitOffset returns the offset of the n-th unit of type uType.
+func unitOffset(t *testing.T, data []byte, uType uint8, n int) int {
+	for off := 0; off+unitHeaderLen <= len(data); {
+		if data[off] == uType {
+			if n == 0 {
+				return off
+			}
+			n--
+		}
+		off += unitHeaderLen + int(binary.BigEndian.Uint16(data[off+2:]))
+	}
+	t.Fatalf("no unit of type 0x%02X", uType)
+	return 0
+}
+
+func TestMalformedLicenses(t *testing.T) {
+	fixture := readFixture(t, "common_full")
+	pks := loadPublicKeys(t, fixtureCertId)
+	keyOff := unitOffset(t, fixture, unitTypeKey, 1)
+	sigOff := unitOffset(t, fixture, unitTypeSignature, 0)
+	// AlgorithmId, CertificatIdLen and CertificatId come before SignatureLen.
+	sigLenOff := sigOff + unitHeaderLen + 1 + 1 + len(fixtureCertId)
+
+	cases := []struct {
+		name string
+		data []byte
+		err  error // nil if any error will do
+	}{
+		{"empty", []byte{}, errTruncated},
+		{"truncated header", fixture[:unitHeaderLen+3], errTruncated},
+		{"truncated signature", fixture[:len(fixture)-1], errTruncated},
+		{"signature without data", fixture[:sigOff+unitHeaderLen], errTruncated},
+		{"trailing data", append(append([]byte{}, fixture...), 0), errDataAfterSig},
+		{"header not first", fixture[unitHeaderLen+licenseHeaderLength:], errNoHeader},
+		{"version does not match layout", mutate(fixture, func(b []byte) []byte {
+			b[unitHeaderLen] = licenseVersion2
+			return b
+		}), errVersion},
+		{"unknown unit type", mutate(fixture, func(b []byte) []byte {
+			b[keyOff] = 0xB0
+			return b
+		}), errUnexpectedUnit},
+		{"content unit in common license", mutate(fixture, func(b []byte) []byte {
+			b[keyOff] = unitTypeContent
+			return b
+		}), errUnexpectedUnit},
+		{"unit length too long", mutate(fixture, func(b []byte) []byte {
+			binary.BigEndian.PutUint16(b[keyOff+2:], uint16(len(b)))
+			return b
+		}), errTruncated},
+		{"unit length too short", mutate(fixture, func(b []byte) []byte {
+			binary.BigEndian.PutUint16(b[keyOff+2:], 2)
+			return b
+		}), nil},
+		{"key data length", mutate(fixture, func(b []byte) []byte {
+			binary.BigEndian.PutUint16(b[keyOff+unitHeaderLen+1:], 0xFFFF)
+			return b
+		}), errTruncated},
+		{"signature length too long", mutate(fixture, func(b []byte) []byte {
+			binary.BigEndian.PutUint16(b[sigLenOff:], 0xFFFF)
+			return b
+		}), errTruncated},
+		{"signature length too short", mutate(fixture, func(b []byte) []byte {
+			binary.BigEndian.PutUint16(b[sigLenOff:], 1)
+			return b
+		}), errTrailingData},
+	}
+	for _, c := range cases {
+		_, err := VerifyLicense(c.data, pks)
+		if err == nil {
+			t.Fatalf("%s: malformed license accepted.", c.name)
+		}
+		if c.err != nil && !errors.Is(err, c.err) {
+			t.Fatalf("%s: err=%v, want %v", c.name, err, c.err)
+		}
+	}
+
+	// Well formed, but the signed body or the signature is changed.
+	tampered := [][]byte{
+		mutate(fixture, func(b []byte) []byte {
+			b[keyOff+unitHeaderLen+3] ^= 0x01
+			return b
+		}),
+		mutate(fixture, func(b []byte) []byte {
+			b[len(b)-1] ^= 0x01
+			return b
+		}),
+	}
+	for i, data := range tampered {
+		if _, err := ParseCommonLicense(data); err != nil {
+			t.Fatalf("tampered license %d: Parse failed. err=%s", i, err)
+		}
+		if _, err := VerifyLicense(data, pks); !errors.Is(err, rsa.ErrVerification) {
+			t.Fatalf("tampered license %d: err=%v", i, err)
+		}
+	}
+}
+
+func addFixtureSeeds(f *testing.F) {
+	for _, c := range fixtureCases {
+		data, err := ioutil.ReadFile(fixtureFile(c.name))
+		if err != nil {
+			f.Fatalf("ReadFile failed. err=%s", err)
+		}
+		f.Add(data)
+	}
+}
+
+// checkParsed checks that a license accepted by the parser is well formed, so
+// that it can be marshaled and parsed again.
+func checkParsed(t *testing.T, cl *CommonLicense, marshal func(withCnt, withSig bool) ([]byte, error), parse func([]byte) error) {
+	withSig := cl.Signature.Type == unitTypeSignature
+	data, err := marshal(len(cl.Counters) > 0, withSig)
+	if err != nil {
+		t.Fatalf("Marshal of parsed license failed. err=%s", err)
+	}
+	if err := parse(data); err != nil {
+		t.Fatalf("Parse of marshaled license failed. err=%s", err)
+	}
+}
+
+func FuzzParseCommonLicense(f *testing.F) {
+	addFixtureSeeds(f)
+	f.Fuzz(func(t *testing.T, data []byte) {
+		cl, err := ParseCommonLicense(data)
+		if err != nil {
+			return
+		}
+		checkParsed(t, cl, cl.Marshal, func(data []byte) error {
+			_, err := ParseCommonLicense(data)
+			return err
+		})
+	})
+}
+
+func FuzzParseChinaDrmLicense(f *testing.F) {
+	addFixtureSeeds(f)
+	f.Fuzz(func(t *testing.T, data []byte) {
+		cdl, err := ParseChinaDrmLicense(data)
+		if err != nil {
+			return
+		}
+		checkParsed(t, &cdl.CommonLicense, cdl.Marshal, func(data []byte) error {
+			_, err := ParseChinaDrmLicense(data)
+			return err
+		})
+	})
+}
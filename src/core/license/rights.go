@@ -0,0 +1,316 @@
+/*
+	Opendrm, an open source implementation of industry-grade DRM
+	(Digital Rights Management) or Key System.
+	Copyright (C) 2018  wilkk
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+/*
+	Typed constructors and decoders of Right units, following the Right Type
+	table in commondrm.go.
+*/
+
+package license
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"time"
+)
+
+var (
+	errUnknownRight  = errors.New("license: unknown rights type")
+	errRightDataLen  = errors.New("license: invalid rights data length")
+	errRightValue    = errors.New("license: rights value out of uint32 range")
+	errRightInterval = errors.New("license: rights start time is after end time")
+	errRightNoTimes  = errors.New("license: rights type has no times")
+	errRightNoTime   = errors.New("license: rights type has no time")
+	errRightNoSpan   = errors.New("license: rights type has no time interval")
+	errNotEntitled   = errors.New("license: right is not entitled")
+	errRightLevel    = errors.New("license: rights level out of range")
+	errRightNoLevel  = errors.New("license: rights type has no level")
+)
+
+// Data length of each rights type, in bytes.
+var rightDataLen = map[uint8]int{
+	rightsTypePlay:           0,
+	rightsTypePlayTimes:      4,
+	rightsTypePlayTime:       4,
+	rightsTypePlayInterval:   8,
+	rightsTypePlayProtected:  1,
+	rightsTypePlayQuality:    1,
+	rightsTypeRecord:         0,
+	rightsTypeRecordInterval: 8,
+	rightsTypeRecordTime:     4,
+	rightsTypeCopy:           0,
+	rightsTypeStore:          0,
+	rightsTypeForward:        0,
+	rightsTypeExecute:        0,
+	rightsTypeSuperRight:     0,
+	rightsTypeTimes:          4,
+	rightsTypeTime:           4,
+	rightsTypeInterval:       8,
+	rightsTypeProtection:     1,
+}
+
+// Highest value of each rights type with a level.
+var rightMaxLevel = map[uint8]uint8{
+	rightsTypePlayProtected: 2,
+	rightsTypePlayQuality:   3,
+	rightsTypeProtection:    2,
+}
+
+func uint32Data(vs ...int64) ([]byte, error) {
+	data := make([]byte, 4*len(vs))
+	for i, v := range vs {
+		if v < 0 || v > math.MaxUint32 {
+			return nil, errRightValue
+		}
+		binary.BigEndian.PutUint32(data[4*i:], uint32(v))
+	}
+	return data, nil
+}
+
+func newTimeRight(rType uint8, d time.Duration) (Right, error) {
+	data, err := uint32Data(int64(d / time.Second))
+	if err != nil {
+		return Right{}, err
+	}
+	return NewRight(rType, data), nil
+}
+
+func newIntervalRight(rType uint8, start, end time.Time) (Right, error) {
+	if start.After(end) {
+		return Right{}, errRightInterval
+	}
+	data, err := uint32Data(start.Unix(), end.Unix())
+	if err != nil {
+		return Right{}, err
+	}
+	return NewRight(rType, data), nil
+}
+
+func NewPlayRight() Right {
+	return NewRight(rightsTypePlay, nil)
+}
+
+// NewPlayTimesRight allows the content to be played n times.
+func NewPlayTimesRight(n uint32) Right {
+	data, _ := uint32Data(int64(n))
+	return NewRight(rightsTypePlayTimes, data)
+}
+
+// NewPlayTimeRight allows the content to be played for d, in seconds.
+func NewPlayTimeRight(d time.Duration) (Right, error) {
+	return newTimeRight(rightsTypePlayTime, d)
+}
+
+// NewPlayIntervalRight allows the content to be played between start and end.
+func NewPlayIntervalRight(start, end time.Time) (Right, error) {
+	return newIntervalRight(rightsTypePlayInterval, start, end)
+}
+
+func NewRecordRight() Right {
+	return NewRight(rightsTypeRecord, nil)
+}
+
+// NewRecordIntervalRight allows the content to be recorded between start and end.
+func NewRecordIntervalRight(start, end time.Time) (Right, error) {
+	return newIntervalRight(rightsTypeRecordInterval, start, end)
+}
+
+// NewRecordTimeRight allows the content to be recorded for d, in seconds.
+func NewRecordTimeRight(d time.Duration) (Right, error) {
+	return newTimeRight(rightsTypeRecordTime, d)
+}
+
+func NewCopyRight() Right {
+	return NewRight(rightsTypeCopy, nil)
+}
+
+func NewStoreRight() Right {
+	return NewRight(rightsTypeStore, nil)
+}
+
+func NewForwardRight() Right {
+	return NewRight(rightsTypeForward, nil)
+}
+
+func NewExecuteRight() Right {
+	return NewRight(rightsTypeExecute, nil)
+}
+
+// NewSuperRight grants all rights.
+func NewSuperRight() Right {
+	return NewRight(rightsTypeSuperRight, nil)
+}
+
+// Validate checks that r is a known rights type with valid data.
+func (r *Right) Validate() error {
+	n, ok := rightDataLen[r.Type]
+	if !ok {
+		return fmt.Errorf("%w: 0x%02X", errUnknownRight, r.Type)
+	}
+	if len(r.RightData) != n || int(r.Length) != n {
+		return fmt.Errorf("%w: type 0x%02X", errRightDataLen, r.Type)
+	}
+
+	if n == 8 {
+		start, end, _ := r.Interval()
+		if start.After(end) {
+			return errRightInterval
+		}
+	}
+	if n == 1 && r.RightData[0] > rightMaxLevel[r.Type] {
+		return fmt.Errorf("%w: type 0x%02X", errRightLevel, r.Type)
+	}
+
+	return nil
+}
+
+// Times returns the times of a play by times or by times right.
+func (r *Right) Times() (uint32, error) {
+	if r.Type != rightsTypePlayTimes && r.Type != rightsTypeTimes {
+		return 0, errRightNoTimes
+	}
+	if len(r.RightData) != 4 {
+		return 0, errRightDataLen
+	}
+	return binary.BigEndian.Uint32(r.RightData), nil
+}
+
+// Duration returns the time of a play, record or other by time right.
+func (r *Right) Duration() (time.Duration, error) {
+	if r.Type != rightsTypePlayTime && r.Type != rightsTypeRecordTime && r.Type != rightsTypeTime {
+		return 0, errRightNoTime
+	}
+	if len(r.RightData) != 4 {
+		return 0, errRightDataLen
+	}
+	return time.Duration(binary.BigEndian.Uint32(r.RightData)) * time.Second, nil
+}
+
+// Interval returns the time interval of a play, record or other by time
+// interval right.
+func (r *Right) Interval() (start, end time.Time, err error) {
+	if r.Type != rightsTypePlayInterval && r.Type != rightsTypeRecordInterval && r.Type != rightsTypeInterval {
+		return time.Time{}, time.Time{}, errRightNoSpan
+	}
+	if len(r.RightData) != 8 {
+		return time.Time{}, time.Time{}, errRightDataLen
+	}
+	start = time.Unix(int64(binary.BigEndian.Uint32(r.RightData)), 0)
+	end = time.Unix(int64(binary.BigEndian.Uint32(r.RightData[4:])), 0)
+	return start, end, nil
+}
+
+// Level returns the protection level or the quality of a right with one.
+func (r *Right) Level() (uint8, error) {
+	if _, ok := rightMaxLevel[r.Type]; !ok {
+		return 0, errRightNoLevel
+	}
+	if len(r.RightData) != 1 {
+		return 0, errRightDataLen
+	}
+	return r.RightData[0], nil
+}
+
+// RightSpec describes a right asked for in a license request.
+type RightSpec struct {
+	// One of play, play_times, play_time, play_interval, record,
+	// record_interval, record_time, copy, store, forward, execute.
+	Type    string `json:"type"`
+	Times   uint32 `json:"times,omitempty"`   // play_times
+	Seconds int64  `json:"seconds,omitempty"` // play_time, record_time
+	Start   int64  `json:"start,omitempty"`   // *_interval, seconds since 1970-01-01 00:00:00
+	End     int64  `json:"end,omitempty"`     // *_interval, seconds since 1970-01-01 00:00:00
+}
+
+// Right creates the Right unit described by rs. Super right can't be asked for.
+func (rs *RightSpec) Right() (Right, error) {
+	d := time.Duration(rs.Seconds) * time.Second
+	start, end := time.Unix(rs.Start, 0), time.Unix(rs.End, 0)
+
+	switch rs.Type {
+	case "play":
+		return NewPlayRight(), nil
+	case "play_times":
+		return NewPlayTimesRight(rs.Times), nil
+	case "play_time":
+		return NewPlayTimeRight(d)
+	case "play_interval":
+		return NewPlayIntervalRight(start, end)
+	case "record":
+		return NewRecordRight(), nil
+	case "record_interval":
+		return NewRecordIntervalRight(start, end)
+	case "record_time":
+		return NewRecordTimeRight(d)
+	case "copy":
+		return NewCopyRight(), nil
+	case "store":
+		return NewStoreRight(), nil
+	case "forward":
+		return NewForwardRight(), nil
+	case "execute":
+		return NewExecuteRight(), nil
+	default:
+		return Right{}, fmt.Errorf("%w: %q", errUnknownRight, rs.Type)
+	}
+}
+
+// Entitlement is the rights a content is sold with, kept on the server. Rights
+// asked for in a license request are granted only within it.
+type Entitlement []RightSpec
+
+// Check returns an error unless rs is entitled: its type is entitled with no
+// smaller limits, or rs is a limited form of an entitled play or record right.
+func (e Entitlement) Check(rs RightSpec) error {
+	for _, es := range e {
+		if es.allows(rs) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: %q", errNotEntitled, rs.Type)
+}
+
+// allows reports whether rs is no wider than es.
+func (es *RightSpec) allows(rs RightSpec) bool {
+	unlimited := ""
+	switch rs.Type {
+	case "play_times", "play_time", "play_interval":
+		unlimited = "play"
+	case "record_time", "record_interval":
+		unlimited = "record"
+	}
+	if es.Type == unlimited {
+		return true
+	}
+	if es.Type != rs.Type {
+		return false
+	}
+
+	switch rs.Type {
+	case "play_times":
+		return rs.Times <= es.Times
+	case "play_time", "record_time":
+		return rs.Seconds <= es.Seconds
+	case "play_interval", "record_interval":
+		return es.Start <= rs.Start && rs.End <= es.End
+	}
+	return true
+}
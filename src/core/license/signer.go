@@ -0,0 +1,321 @@
+/*
+	Opendrm, an open source implementation of industry-grade DRM
+	(Digital Rights Management) or Key System.
+	Copyright (C) 2018  wilkk
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+/*
+	A Signer holds the private key of a license server, and signs the
+	signature unit of licenses. A Verifier checks signatures by a public key.
+	Keys are loaded once, so a Signer can be shared by concurrent requests.
+*/
+
+package license
+
+import (
+	"core/crypto/sm2"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+)
+
+type Signer interface {
+	// AlgorithmId returns the signature algorithm of the signature unit.
+	AlgorithmId() uint8
+	// CertificateId returns the id of the certificate of the signing key,
+	// empty if the license keeps its own.
+	CertificateId() string
+	// Sign signs the serialized license body.
+	Sign(data []byte) ([]byte, error)
+	// Public returns the public key that verifies the signatures.
+	Public() crypto.PublicKey
+}
+
+// AlgorithmSigner is a Signer that can also sign under other algorithms of its
+// key, e.g. RSA 2048 with SHA-256 for clients that negotiate it.
+type AlgorithmSigner interface {
+	Signer
+	SignWith(algId uint8, data []byte) ([]byte, error)
+}
+
+type Verifier interface {
+	// Verify checks sig over data signed under algId.
+	Verify(algId uint8, data, sig []byte) error
+}
+
+// KeySigner is a Signer of an in-memory private key.
+type KeySigner struct {
+	key    crypto.Signer
+	algId  uint8
+	certId string
+}
+
+// NewKeySigner creates a Signer of key, which is an RSA 1024, RSA 2048 or SM2
+// private key. The signature algorithm is chosen by the kind of key.
+func NewKeySigner(key crypto.Signer, certId string) (*KeySigner, error) {
+	algId, err := signatureAlgorithm(key.Public())
+	if err != nil {
+		return nil, err
+	}
+
+	return &KeySigner{
+		key:    key,
+		algId:  algId,
+		certId: certId,
+	}, nil
+}
+
+// ParsePemSigner creates a Signer of the private key in pem data. RSA keys in
+// PKCS#1 or PKCS#8 form and SM2 keys in PKCS#8 or SEC 1 form are accepted.
+func ParsePemSigner(data []byte, certId string) (*KeySigner, error) {
+	key, err := parsePrivateKey(data)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewKeySigner(key, certId)
+}
+
+// LoadPemSigner reads the private key from pemFile once, and creates a Signer
+// of it.
+func LoadPemSigner(pemFile string, certId string) (*KeySigner, error) {
+	data, err := ioutil.ReadFile(pemFile)
+	if err != nil {
+		return nil, err
+	}
+
+	return ParsePemSigner(data, certId)
+}
+
+func (ks *KeySigner) AlgorithmId() uint8 {
+	return ks.algId
+}
+
+func (ks *KeySigner) CertificateId() string {
+	return ks.certId
+}
+
+func (ks *KeySigner) Public() crypto.PublicKey {
+	return ks.key.Public()
+}
+
+func (ks *KeySigner) Sign(data []byte) ([]byte, error) {
+	return signData(ks.algId, ks.key, data)
+}
+
+func (ks *KeySigner) SignWith(algId uint8, data []byte) ([]byte, error) {
+	return signData(algId, ks.key, data)
+}
+
+// KeyVerifier is a Verifier of a public key.
+type KeyVerifier struct {
+	pub crypto.PublicKey
+}
+
+func NewVerifier(pub crypto.PublicKey) *KeyVerifier {
+	return &KeyVerifier{
+		pub: pub,
+	}
+}
+
+func (kv *KeyVerifier) Verify(algId uint8, data, sig []byte) error {
+	return verifySignature(algId, kv.pub, data, sig)
+}
+
+// ParsePublicKeyPem reads an RSA or SM2 public key in PKIX form, or the public
+// key of a certificate, from pem data.
+func ParsePublicKeyPem(data []byte) (crypto.PublicKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("license: no pem block found")
+	}
+
+	switch block.Type {
+	case "PUBLIC KEY":
+		pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			// crypto/x509 doesn't know SM2 curve.
+			return sm2.ParsePKIXPublicKey(block.Bytes)
+		}
+		return pub, nil
+	case "RSA PUBLIC KEY":
+		return x509.ParsePKCS1PublicKey(block.Bytes)
+	case "CERTIFICATE":
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		return cert.PublicKey, nil
+	default:
+		return nil, fmt.Errorf("%w: pem type %q", errUnknownKey, block.Type)
+	}
+}
+
+// MarshalPublicKeyPem encodes an RSA or SM2 public key in PKIX form in pem.
+func MarshalPublicKeyPem(pub crypto.PublicKey) ([]byte, error) {
+	var der []byte
+	var err error
+	switch pub := pub.(type) {
+	case *sm2.PublicKey:
+		der, err = sm2.MarshalPKIXPublicKey(pub)
+	default:
+		der, err = x509.MarshalPKIXPublicKey(pub)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), nil
+}
+
+// parsePrivateKey reads an RSA key in PKCS#1 or PKCS#8 form, or an SM2 key in
+// PKCS#8 or SEC 1 form from pem data.
+func parsePrivateKey(data []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("license: no pem block found")
+	}
+
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		return sm2.ParseECPrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			// crypto/x509 doesn't know SM2 curve.
+			return sm2.ParsePKCS8PrivateKey(block.Bytes)
+		}
+		signer, ok := key.(crypto.Signer)
+		if !ok {
+			return nil, errUnknownKey
+		}
+		return signer, nil
+	default:
+		return nil, fmt.Errorf("%w: pem type %q", errUnknownKey, block.Type)
+	}
+}
+
+// signatureAlgorithm returns the signature algorithm used for signing by the
+// private key of pub, one of GY/T 277.
+func signatureAlgorithm(pub crypto.PublicKey) (uint8, error) {
+	switch pub := pub.(type) {
+	case *rsa.PublicKey:
+		switch pub.N.BitLen() {
+		case 1024:
+			return algorithmSignature_RSA_SHA1_1024, nil
+		case 2048:
+			return algorithmSignature_RSA_SHA1_2048, nil
+		}
+	case *sm2.PublicKey:
+		return algorithmSignature_SM2_256, nil
+	}
+
+	return 0, errUnknownKey
+}
+
+// signatureHash returns the hash of data that is signed under algId. For SM2,
+// it's e = SM3(Z || data) of pub.
+func signatureHash(algId uint8, pub crypto.PublicKey, data []byte) (crypto.Hash, []byte, error) {
+	switch algId {
+	case algorithmSignature_RSA_SHA1_1024, algorithmSignature_RSA_SHA1_2048:
+		digest := sha1.Sum(data)
+		return crypto.SHA1, digest[:], nil
+	case algorithmSignature_RSA_SHA256_2048:
+		digest := sha256.Sum256(data)
+		return crypto.SHA256, digest[:], nil
+	case algorithmSignature_SM2_256:
+		sm2Pub, ok := pub.(*sm2.PublicKey)
+		if !ok {
+			return 0, nil, errPublicKeyMismatch
+		}
+		return 0, sm2.Digest(sm2Pub, []byte(sm2.DefaultUID), data), nil
+	default:
+		return 0, nil, fmt.Errorf("%w: 0x%02X", errUnknownAlgorithm, algId)
+	}
+}
+
+// checkKey checks that pub is the kind of key that algId signs with.
+func checkKey(algId uint8, pub crypto.PublicKey) error {
+	switch algId {
+	case algorithmSignature_RSA_SHA1_1024, algorithmSignature_RSA_SHA1_2048, algorithmSignature_RSA_SHA256_2048:
+		rsaPub, ok := pub.(*rsa.PublicKey)
+		if !ok {
+			return errPublicKeyMismatch
+		}
+		bits := 2048
+		if algId == algorithmSignature_RSA_SHA1_1024 {
+			bits = 1024
+		}
+		if rsaPub.N.BitLen() != bits {
+			return errPublicKeyMismatch
+		}
+	case algorithmSignature_SM2_256:
+		if _, ok := pub.(*sm2.PublicKey); !ok {
+			return errPublicKeyMismatch
+		}
+	default:
+		return fmt.Errorf("%w: 0x%02X", errUnknownAlgorithm, algId)
+	}
+
+	return nil
+}
+
+// signData signs data by priv under algId.
+func signData(algId uint8, priv crypto.Signer, data []byte) ([]byte, error) {
+	if err := checkKey(algId, priv.Public()); err != nil {
+		return nil, err
+	}
+
+	hash, digest, err := signatureHash(algId, priv.Public(), data)
+	if err != nil {
+		return nil, err
+	}
+
+	return priv.Sign(rand.Reader, digest, hash)
+}
+
+// verifySignature checks sig over the signed body according to algId.
+func verifySignature(algId uint8, pub crypto.PublicKey, body, sig []byte) error {
+	if err := checkKey(algId, pub); err != nil {
+		return err
+	}
+
+	hash, digest, err := signatureHash(algId, pub, body)
+	if err != nil {
+		return err
+	}
+
+	switch pub := pub.(type) {
+	case *rsa.PublicKey:
+		return rsa.VerifyPKCS1v15(pub, hash, digest, sig)
+	case *sm2.PublicKey:
+		if !sm2.Verify(pub, digest, sig) {
+			return errVerification
+		}
+		return nil
+	default:
+		return errPublicKeyMismatch
+	}
+}
@@ -0,0 +1,229 @@
+/*
+	Opendrm, an open source implementation of industry-grade DRM
+	(Digital Rights Management) or Key System.
+	Copyright (C) 2018  wilkk
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+/*
+	Length fields of units are narrow (uint8, uint16, or the unit Length of
+	version 1 licenses). Constructors that return an error, such as
+	PolicyBuilder.Build and NewEncryptedKey, check the unit they build; the
+	others store lengths by plain conversion. Either way, before a license is
+	signed, marshaled or encoded by Base64String, every length field is
+	checked against the data it describes, so that a value that doesn't fit is
+	reported instead of being wrapped into a corrupt license. Serialize is
+	the unchecked form, for licenses that are already valid.
+*/
+
+package license
+
+import (
+	"errors"
+	"fmt"
+	"math"
+)
+
+var (
+	errFieldTooLong   = errors.New("license: field too long")
+	errLengthMismatch = errors.New("license: length field does not match data")
+)
+
+// checkField checks that the length field of a field of n bytes is lenField
+// and fits in max.
+func checkField(name string, lenField, n, max int) error {
+	if n > max {
+		return fmt.Errorf("%w: %s is %d bytes, at most %d", errFieldTooLong, name, n, max)
+	}
+	if lenField != n {
+		return fmt.Errorf("%w: %s is %d bytes, length field is %d", errLengthMismatch, name, n, lenField)
+	}
+	return nil
+}
+
+// checkUnit checks the Length of a unit whose serialized form is b.
+func checkUnit(hdr UnitHeader, b []byte) error {
+	name := fmt.Sprintf("unit 0x%02X/%d", hdr.Type, hdr.Index)
+	return checkField(name, int(hdr.Length), len(b)-unitHeaderLen, math.MaxUint32)
+}
+
+func (lh *LicenseHeader) validate() error {
+	if lh.Type != unitTypeHeader || lh.Length != licenseHeaderLength {
+		return fmt.Errorf("%w: license header", errLengthMismatch)
+	}
+	if lh.Version != licenseVersion1 && lh.Version != licenseVersion2 {
+		return fmt.Errorf("%w: %d", errVersion, lh.Version)
+	}
+	return nil
+}
+
+func (ao *AuthObject) validate() error {
+	return checkUnit(ao.UnitHeader, ao.Bytes())
+}
+
+func (k *Key) validate() error {
+	if err := checkField("key data", int(k.KeyDataLen), len(k.KeyData), math.MaxUint16); err != nil {
+		return err
+	}
+	if err := checkField("key id", int(k.KeyIdLen), len(k.KeyId), math.MaxUint8); err != nil {
+		return err
+	}
+	if err := checkField("upper key id", int(k.UpperKeyIdLen), len(k.UpperKeyId), math.MaxUint8); err != nil {
+		return err
+	}
+	// Upper key info follows auxiliary info.
+	if k.UpperKeyType != 0 && k.KeyType == 0 {
+		return errKeyType
+	}
+	return checkUnit(k.UnitHeader, k.Bytes())
+}
+
+func (p *Policy) validate() error {
+	if err := checkField("policy key id", int(p.KeyIdLen), len(p.KeyId), math.MaxUint8); err != nil {
+		return err
+	}
+	if err := checkField("key rules", int(p.KeyRulesNum), len(p.KeyRules), math.MaxUint8); err != nil {
+		return err
+	}
+	for _, kr := range p.KeyRules {
+		if err := checkField("key rule", int(kr.KeyRuleLen), len(kr.KeyRuleData), math.MaxUint8); err != nil {
+			return err
+		}
+	}
+	return checkUnit(p.UnitHeader, p.Bytes())
+}
+
+func (c *Counter) validate() error {
+	if err := checkField("rights index", int(c.RightsIndexNum), len(c.RightsIndex), math.MaxUint16); err != nil {
+		return err
+	}
+	return checkUnit(c.UnitHeader, c.Bytes())
+}
+
+func (s *Signature) validate() error {
+	if err := checkField("certificate id", int(s.CertificatIdLen), len(s.CertificatId), math.MaxUint8); err != nil {
+		return err
+	}
+	if err := checkField("signature", int(s.SignatureLen), len(s.SignatureData), math.MaxUint16); err != nil {
+		return err
+	}
+	return checkUnit(s.UnitHeader, s.Bytes())
+}
+
+func (c *Content) validate() error {
+	for _, ck := range c.Keys {
+		if err := checkField("content key id", int(ck.KeyIdLen), len(ck.KeyId), math.MaxUint8); err != nil {
+			return err
+		}
+	}
+	return checkUnit(c.UnitHeader, c.Bytes())
+}
+
+// checkUnitsLen checks that units fit in the unit Length of the license
+// version.
+func (cl *CommonLicense) checkUnitsLen(units [][]byte) error {
+	for _, u := range units {
+		if n := len(u) - unitHeaderLen; n > maxUnitLen(cl.Header.Version) {
+			return fmt.Errorf("%w: unit 0x%02X/%d is %d bytes in version %d", errFieldTooLong, u[0], u[1], n, cl.Header.Version)
+		}
+	}
+	return nil
+}
+
+// validate checks all units of cl that are serialized.
+func (cl *CommonLicense) validate(withCnt, withSig bool) error {
+	if cl.unitsNum(withCnt) > math.MaxUint8 {
+		return errTooManyUnits
+	}
+	if err := cl.Header.validate(); err != nil {
+		return err
+	}
+	if err := cl.checkUnitsLen(cl.bodyUnits(withCnt)); err != nil {
+		return err
+	}
+	for i := range cl.Objects {
+		if err := cl.Objects[i].validate(); err != nil {
+			return err
+		}
+	}
+	for i := range cl.Keys {
+		if err := cl.Keys[i].validate(); err != nil {
+			return err
+		}
+	}
+	for i := range cl.Policys {
+		if err := cl.Policys[i].validate(); err != nil {
+			return err
+		}
+		if err := cl.Policys[i].checkVersion(cl.Header.Version); err != nil {
+			return err
+		}
+	}
+	for i := range cl.Rights {
+		if err := cl.Rights[i].Validate(); err != nil {
+			return err
+		}
+	}
+	if withCnt {
+		for i := range cl.Counters {
+			if err := cl.Counters[i].validate(); err != nil {
+				return err
+			}
+		}
+	}
+	for i := range cl.Extensions {
+		if err := cl.Extensions[i].validate(); err != nil {
+			return err
+		}
+	}
+	if withSig {
+		if err := cl.Signature.validate(); err != nil {
+			return err
+		}
+		return cl.checkUnitsLen([][]byte{cl.Signature.Bytes()})
+	}
+	return nil
+}
+
+// Marshal is Serialize with the length fields of every unit checked first.
+func (cl *CommonLicense) Marshal(withCnt, withSig bool) ([]byte, error) {
+	if err := cl.validate(withCnt, withSig); err != nil {
+		return nil, err
+	}
+	return cl.Serialize(withCnt, withSig), nil
+}
+
+func (cdl *ChinaDrmLicense) validate(withCnt, withSig bool) error {
+	if cdl.unitsNum(withCnt) > math.MaxUint8 {
+		return errTooManyUnits
+	}
+	for i := range cdl.Contents {
+		if err := cdl.Contents[i].validate(); err != nil {
+			return err
+		}
+		if err := cdl.checkUnitsLen([][]byte{cdl.Contents[i].Bytes()}); err != nil {
+			return err
+		}
+	}
+	return cdl.CommonLicense.validate(withCnt, withSig)
+}
+
+// Marshal is Serialize with the length fields of every unit checked first.
+func (cdl *ChinaDrmLicense) Marshal(withCnt, withSig bool) ([]byte, error) {
+	if err := cdl.validate(withCnt, withSig); err != nil {
+		return nil, err
+	}
+	return cdl.Serialize(withCnt, withSig), nil
+}
@@ -0,0 +1,245 @@
+/*
+	Opendrm, an open source implementation of industry-grade DRM
+	(Digital Rights Management) or Key System.
+	Copyright (C) 2018  wilkk
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+/*
+	Licenses are issued in one of two format versions, told by Version of the
+	license header:
+
+	  - version 1 is GY/T 277 as is, unit Length is 16 bits and StartTime and
+	    EndTime key rules are 32 bits seconds.
+	  - version 2 widens unit Length to 32 bits, StartTime and EndTime key rules
+	    to 64 bits, and allows key rule types beyond the basic ones.
+
+	The layout of units but the header is the same in both versions. A client
+	states the versions and the optional unit and key rule types it supports in
+	Capabilities, and Negotiate picks the richest version the client knows.
+	Clients which don't state any get version 1.
+*/
+
+package license
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+)
+
+const (
+	licenseVersion1 = 1
+	licenseVersion2 = 2
+
+	unitHeaderLenV2 = 6
+)
+
+var (
+	errVersion         = errors.New("license: unsupported license version")
+	errNoCommonVersion = errors.New("license: no license version supported by client")
+	errUnsupportedRule = errors.New("license: key rule type not supported by client")
+	errUnsupportedUnit = errors.New("license: extension unit type not supported by client")
+	errRuleWidth       = errors.New("license: time key rule must be 32 bits in version 1")
+)
+
+// Capabilities is what a client supports, as stated in its license request.
+type Capabilities struct {
+	// License format versions.
+	Versions []int `json:"versions"`
+	// Extension unit types, see extension.go.
+	UnitTypes []int `json:"unit_types,omitempty"`
+	// Key rule types beyond the basic ones, which need version 2.
+	RuleTypes []int `json:"rule_types,omitempty"`
+	// Signature algorithms beyond GY/T 277, 0x43 for RSA 2048 with SHA-256.
+	SignatureAlgorithms []int `json:"signature_algorithms,omitempty"`
+}
+
+func containsType(ts []int, t uint8) bool {
+	for _, v := range ts {
+		if v == int(t) {
+			return true
+		}
+	}
+	return false
+}
+
+// Version returns the richest license version listed in caps, version 1 if
+// caps is nil or lists no version.
+func (caps *Capabilities) Version() (uint8, error) {
+	if caps == nil || len(caps.Versions) == 0 {
+		return licenseVersion1, nil
+	}
+	for _, ver := range []uint8{licenseVersion2, licenseVersion1} {
+		if containsType(caps.Versions, ver) {
+			return ver, nil
+		}
+	}
+	return 0, fmt.Errorf("%w: %v", errNoCommonVersion, caps.Versions)
+}
+
+// Negotiate sets cl to the richest version that caps lists. A signature
+// algorithm beyond GY/T 277 is used only if caps lists it. Key rules and
+// extension units can't be removed as the restriction they carry would be
+// lost, so a key rule or an extension unit type unknown to the client is
+// reported as error. It must be called before cl is signed.
+func (cl *CommonLicense) Negotiate(caps *Capabilities) error {
+	ver, err := caps.Version()
+	if err != nil {
+		return err
+	}
+	if caps == nil {
+		caps = &Capabilities{}
+	}
+
+	for _, p := range cl.Policys {
+		for _, kr := range p.KeyRules {
+			if !isBasicRule(kr.KeyRuleType) && !containsType(caps.RuleTypes, kr.KeyRuleType) {
+				return fmt.Errorf("%w: 0x%02X", errUnsupportedRule, kr.KeyRuleType)
+			}
+		}
+	}
+
+	for _, eu := range cl.Extensions {
+		if !containsType(caps.UnitTypes, eu.Type) {
+			return fmt.Errorf("%w: 0x%02X", errUnsupportedUnit, eu.Type)
+		}
+	}
+
+	if containsType(caps.SignatureAlgorithms, algorithmSignature_RSA_SHA256_2048) {
+		cl.sigAlgId = algorithmSignature_RSA_SHA256_2048
+	}
+
+	return cl.SetVersion(ver)
+}
+
+// SetVersion sets the license version of cl, and converts the width of time
+// key rules to it. Key rules that version 1 can't carry are reported as error.
+func (cl *CommonLicense) SetVersion(ver uint8) error {
+	if ver != licenseVersion1 && ver != licenseVersion2 {
+		return fmt.Errorf("%w: %d", errVersion, ver)
+	}
+
+	for i := range cl.Policys {
+		if err := cl.Policys[i].setVersion(ver); err != nil {
+			return err
+		}
+	}
+	cl.Header.Version = ver
+
+	return nil
+}
+
+func isBasicRule(ruleType uint8) bool {
+	return ruleType >= keyRuleTypeStartTime && ruleType <= keyRuleTypeAccuTimeSpan
+}
+
+func isTimeRule(ruleType uint8) bool {
+	return ruleType == keyRuleTypeStartTime || ruleType == keyRuleTypeEndTime
+}
+
+func (p *Policy) setVersion(ver uint8) error {
+	for i := range p.KeyRules {
+		kr := &p.KeyRules[i]
+		if ver == licenseVersion1 && !isBasicRule(kr.KeyRuleType) {
+			return fmt.Errorf("%w: 0x%02X needs version 2", errUnknownRule, kr.KeyRuleType)
+		}
+		if !isTimeRule(kr.KeyRuleType) {
+			continue
+		}
+
+		v, err := kr.value()
+		if err != nil {
+			return err
+		}
+		var data []byte
+		if ver == licenseVersion1 {
+			if v > math.MaxUint32 {
+				return fmt.Errorf("%w: rule 0x%02X", errRuleValue, kr.KeyRuleType)
+			}
+			data = make([]byte, 4)
+			binary.BigEndian.PutUint32(data, uint32(v))
+		} else {
+			data = make([]byte, 8)
+			binary.BigEndian.PutUint64(data, v)
+		}
+		kr.KeyRuleLen = uint8(len(data))
+		kr.KeyRuleData = data
+	}
+	p.Length = uint32(len(p.Bytes()) - unitHeaderLen)
+
+	return nil
+}
+
+// checkVersion checks that the key rules of p can be read by clients of
+// version ver: time rules are 32 bits in version 1.
+func (p *Policy) checkVersion(ver uint8) error {
+	if ver != licenseVersion1 {
+		return nil
+	}
+	for _, kr := range p.KeyRules {
+		if isTimeRule(kr.KeyRuleType) && kr.KeyRuleLen != 4 {
+			return fmt.Errorf("%w: rule 0x%02X of %d bytes", errRuleWidth, kr.KeyRuleType, kr.KeyRuleLen)
+		}
+	}
+	return nil
+}
+
+// unitHeaderSize returns the length of unit header in version ver.
+func unitHeaderSize(ver uint8) int {
+	if ver >= licenseVersion2 {
+		return unitHeaderLenV2
+	}
+	return unitHeaderLen
+}
+
+// maxUnitLen returns the largest data part of a unit in version ver.
+func maxUnitLen(ver uint8) int {
+	if ver >= licenseVersion2 {
+		return math.MaxUint32
+	}
+	return math.MaxUint16
+}
+
+// writeUnit writes u, a unit in the layout of version 1, in the layout of
+// version ver. The Length is taken from the data of u, so that units longer
+// than 64KiB are kept whole in version 2.
+func writeUnit(buff *bytes.Buffer, ver uint8, u []byte) {
+	if ver < licenseVersion2 {
+		buff.Write(u)
+		return
+	}
+
+	data := u[unitHeaderLen:]
+	buff.Write(u[:2])
+	binary.Write(buff, binary.BigEndian, uint32(len(data)))
+	buff.Write(data)
+}
+
+// licenseVersion tells the version of a license by the Length of its header,
+// which is fixed, before the header is decoded.
+func licenseVersion(data []byte) (uint8, error) {
+	switch {
+	case len(data) < unitHeaderLenV2:
+		return 0, errTruncated
+	case binary.BigEndian.Uint16(data[2:]) == licenseHeaderLength:
+		return licenseVersion1, nil
+	case binary.BigEndian.Uint32(data[2:]) == licenseHeaderLength:
+		return licenseVersion2, nil
+	}
+	return 0, errNoHeader
+}
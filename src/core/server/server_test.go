@@ -31,7 +31,11 @@ func GenKey(w http.ResponseWriter, r *http.Request) {
 	//kid := r.Form["kid"]
 
 	kengen := key.NewKeyGenerator(nil)
-	key, kid := kengen.GenRandKey()
+	key, kid, err := kengen.GenRandKey()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
 	resp := struct {
 		Key []byte
 		KId string